@@ -74,8 +74,9 @@ func exit() {
 	os.Exit(exitStatus)
 }
 
+// errorf reports an error on stderr, as stdout could be used for the dump itself.
 func errorf(format string, args ...interface{}) {
-	fmt.Printf(format, args...)
-	fmt.Println()
+	fmt.Fprintf(os.Stderr, format, args...)
+	fmt.Fprintln(os.Stderr)
 	setExitStatus(1)
 }
@@ -6,9 +6,101 @@ import (
 	"labix.org/v2/mgo"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
+var (
+	// storage flags shared by dump and restore
+	storageRetries    int
+	storageRetryDelay time.Duration
+	storageProfile    string
+	storageEndpoint   string
+	storageRegion     string
+	storagePathStyle  bool
+	storageKeyFile    string
+	storageKeyEnv     string
+	storageSSE        string
+	storageSSEKMSKey  string
+	storageSSECFile   string
+	// the rate limits are shared by every worker, in bytes or requests per second
+	storageUploadRate   storage.ByteSize
+	storageDownloadRate storage.ByteSize
+	storageRequestRate  float64
+	// storageClass and the object lock flags are only set by dump, as they only apply to saved objects.
+	storageClass           string
+	storageLockMode        string
+	storageLockRetainUntil string
+	storageLockLegalHold   bool
+	storageQuorum          int
+)
+
+// stringsFlag is a flag that may be given several times, collecting every value.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// deprecatedFlag is a boolean flag that is no longer used, warning whoever still gives it.
+type deprecatedFlag string
+
+func (d deprecatedFlag) String() string {
+	return ""
+}
+
+func (d deprecatedFlag) Set(value string) error {
+	fmt.Fprintln(os.Stderr, "Warning:", string(d))
+	return nil
+}
+
+func (d deprecatedFlag) IsBoolFlag() bool {
+	return true
+}
+
+// addStorageFlags adds the flags common to all commands reading or writing storage.
+func addStorageFlags(cmd *Command) {
+	cmd.Flag.IntVar(&storageRetries, "retries", storage.DefaultRetryPolicy.Attempts, "")
+	cmd.Flag.DurationVar(&storageRetryDelay, "retry-delay", storage.DefaultRetryPolicy.Delay, "")
+	cmd.Flag.StringVar(&storageProfile, "profile", "", "")
+	cmd.Flag.StringVar(&storageEndpoint, "endpoint", "", "")
+	cmd.Flag.StringVar(&storageRegion, "region", "", "")
+	cmd.Flag.BoolVar(&storagePathStyle, "path-style", false, "")
+	cmd.Flag.StringVar(&storageKeyFile, "encryption-key-file", "", "")
+	cmd.Flag.StringVar(&storageKeyEnv, "encryption-passphrase-env", "", "")
+	cmd.Flag.StringVar(&storageSSE, "sse", "", "")
+	cmd.Flag.StringVar(&storageSSEKMSKey, "sse-kms-key-id", "", "")
+	cmd.Flag.StringVar(&storageSSECFile, "sse-c-key-file", "", "")
+	cmd.Flag.Var(&storageUploadRate, "max-upload-rate", "")
+	cmd.Flag.Var(&storageDownloadRate, "max-download-rate", "")
+	cmd.Flag.Float64Var(&storageRequestRate, "max-request-rate", 0, "")
+}
+
+// encryptionKeys returns the keys given by flags, the first one being used to encrypt.
+func encryptionKeys() (keys []storage.Key, err error) {
+	if storageKeyFile != "" {
+		key, err := storage.ReadKeyFile(storageKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if storageKeyEnv != "" {
+		key, err := storage.PassphraseKey(os.Getenv(storageKeyEnv))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", storageKeyEnv, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
 // mongoSession gives a session or dies trying.
 func mongoSession(addr string) *mgo.Session {
 	fmt.Fprintln(os.Stderr, "Connecting to", addr)
@@ -20,28 +112,111 @@ func mongoSession(addr string) *mgo.Session {
 	return s
 }
 
-// selectStorage will figure out what kind of storage we're looking for in specified target.
-func selectStorage(target string, compression bool) (root string, store storage.SaveFetcher) {
-	if target == "-" {
-		errorf("%s", "TODO: Set stdin storage here")
+// storageOptions returns the storage flags as the default options of every target.
+func storageOptions() url.Values {
+	opts := url.Values{
+		"retries":     {strconv.Itoa(storageRetries)},
+		"retry-delay": {storageRetryDelay.String()},
+	}
+	if storageProfile != "" {
+		opts.Set("profile", storageProfile)
+	}
+	if storageEndpoint != "" {
+		opts.Set("endpoint", storageEndpoint)
+	}
+	if storageRegion != "" {
+		opts.Set("region", storageRegion)
+	}
+	if storagePathStyle {
+		opts.Set("path-style", "true")
+	}
+	if storageSSE != "" {
+		opts.Set("sse", storageSSE)
+	}
+	if storageSSEKMSKey != "" {
+		opts.Set("sse-kms-key-id", storageSSEKMSKey)
+	}
+	if storageSSECFile != "" {
+		opts.Set("sse-c-key-file", storageSSECFile)
+	}
+	if storageClass != "" {
+		opts.Set("storage-class", storageClass)
+	}
+	if storageLockMode != "" {
+		opts.Set("lock-mode", storageLockMode)
+	}
+	if storageLockRetainUntil != "" {
+		opts.Set("lock-retain-until", storageLockRetainUntil)
+	}
+	if storageLockLegalHold {
+		opts.Set("lock-legal-hold", "true")
+	}
+	return opts
+}
+
+// openStorage opens the storage of target or dies trying.
+func openStorage(target string) (root string, store storage.SaveFetcher) {
+	store, root, err := storage.Open(target, storageOptions())
+	if err != nil {
+		errorf("%v", err)
 		exit()
 	}
-	if strings.HasPrefix(target, "http") {
-		if u, err := url.Parse(target); err != nil {
-			errorf("%v", err)
-			exit()
-		} else {
-			store = storage.NewS3(fmt.Sprintf("%s://%s", u.Scheme, u.Host))
-			root = u.Path
+	return
+}
+
+// selectStorage will figure out what kind of storage we're looking for in specified targets, mirroring
+// objects to all of them when there are several.
+// Data is saved compressed with codec at level, or uncompressed if codec is nil, while the compression
+// of fetched data is always detected.
+func selectStorage(targets []string, codec storage.Codec, level int) (root string, store storage.SaveFetcher) {
+	// The limiters are shared by the storages of every target, as they usually share the same network.
+	upload := storage.NewLimiter(float64(storageUploadRate))
+	download := storage.NewLimiter(float64(storageDownloadRate))
+	requests := storage.NewLimiter(storageRequestRate)
+	limit := func(s storage.SaveFetcher) storage.SaveFetcher {
+		if upload == nil && download == nil && requests == nil {
+			return s
 		}
+		return storage.NewRateLimited(s, upload, download, requests)
+	}
+
+	root, store = openStorage(targets[0])
+	_, stream := store.(*storage.Stream)
+	if len(targets) == 1 {
+		store = limit(store)
 	} else {
-		store = storage.Filesystem{target}
-		root = ""
+		mirror := storage.NewMirror(storageQuorum)
+		for i, target := range targets {
+			if i > 0 {
+				root, store = openStorage(target)
+			}
+			// A stream has no paths to mirror objects to.
+			if _, ok := store.(*storage.Stream); ok {
+				errorf("Stdout can't be written to along with other targets")
+				exit()
+			}
+			mirror.Add(limit(store), root)
+		}
+		root, store = "", mirror
+	}
+
+	// Apply encryption, which has to happen after compression as encrypted data doesn't compress
+	keys, err := encryptionKeys()
+	if err != nil {
+		errorf("%v", err)
+		exit()
+	}
+	if len(keys) > 0 {
+		store = storage.NewEncryptedSaveFetcher(store, keys[0], keys[1:]...)
 	}
 
 	// Apply compression
-	if compression {
-		store = storage.NewGzipSaveFetcher(store)
+	store = storage.NewCompressSaveFetcher(store, codec, level)
+
+	// Checksum what is written before compression, so the whole way to the storage and back is verified.
+	// A stream has no room for the checksums next to the objects.
+	if !stream {
+		store = storage.NewChecksumSaveFetcher(store)
 	}
 
 	return
@@ -6,21 +6,29 @@ import (
 	"github.com/duego/mongotool/mongo"
 	"github.com/duego/mongotool/storage"
 	"io"
+	"labix.org/v2/mgo"
 	"math/rand"
 	"os"
 	"path"
+	"runtime"
 	"strings"
+	"sync"
 	"time"
 )
 
 var cmdDump = &Command{
-	UsageLine: "dump [-host address] [-collection name] [-concurrency num] [-target path]",
-	Short:     "dump database to S3 bucket, filesystem or stdout",
+	UsageLine: "dump [-host address] [-collection name] [-concurrency num] [-target path]...",
+	Short:     "dump database to S3, GCS, Azure, SFTP, filesystem or stdout",
 	Long: `
 Dump reads one or all collections of the specified database and
-stores the objects to a bucket on Amazon S3, filesystem path or standard output.
-For the authentication towards S3 to work, you need to set the environment
-variables AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.
+stores the objects to Amazon S3, Google Cloud Storage, Azure Blob Storage, SFTP, filesystem path or
+standard output.
+For the authentication towards S3, credentials are looked up in the environment
+variables AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN, then a web
+identity token from AWS_WEB_IDENTITY_TOKEN_FILE and AWS_ROLE_ARN, and finally the
+profile of the shared credentials file ~/.aws/credentials selected by AWS_PROFILE.
+
+The -profile flag selects a profile of the shared credentials file, ignoring the other sources.
 
 The -host flag specifies which host and database to read from.
 For example to select "test" database of localhost: localhost:27017/test
@@ -28,45 +36,147 @@ For example to select "test" database of localhost: localhost:27017/test
 The -collection flag causes dump to only read from one collection of
 the specified database, instead of all collections found.
 
-The -target flag specifies which of S3 bucket, filesystem or stdout to write to.
+The -target flag specifies where to write to: an S3 bucket, a Google Cloud Storage bucket
+("gs://"), an Azure Blob Storage container ("az://"), a SFTP server ("sftp://"), a directory
+or ".mtar" archive on the filesystem, or stdout. It may be repeated to write to several targets.
 
 S3 bucket is recognized when target path is in the form: "https://mongotool.s3.amazonaws.com/test".
 This would use the mongotool bucket with "test" as its root.
 
-Filesystem is used when a url is not recognized.
+S3 compatible services such as MinIO or Ceph RGW are used by setting -endpoint to
+their address, for example "http://minio:9000", together with a target in the form
+"s3://bucket/test". Set -path-style to address the bucket as "http://minio:9000/bucket"
+instead of "http://bucket.minio:9000", which also makes http targets in the form
+"http://minio:9000/bucket/test" use the first path element as bucket.
+The -region flag sets the region requests are signed for, otherwise it is guessed
+from the AWS host name, AWS_REGION or defaults to us-east-1.
+
+Options of the storage may also be given in the query of the target, taking precedence
+over the flags, for example "s3://bucket/test?region=eu-west-1&retries=10". S3 takes
+the options endpoint, region, path-style, profile, retries, retry-delay, sse,
+sse-kms-key-id, sse-c-key-file, storage-class, lock-mode, lock-retain-until and
+lock-legal-hold.
+
+Google Cloud Storage is used for targets in the form "gs://bucket/test", authenticating
+with the JSON key file of a service account named by GOOGLE_APPLICATION_CREDENTIALS or the
+credentials option. Requests go to the emulator set by STORAGE_EMULATOR_HOST, if any.
+GCS takes the options gcs-endpoint, credentials, retries and retry-delay.
+
+Azure Blob Storage is used for targets in the form "az://container/test", in the storage
+account named by AZURE_STORAGE_ACCOUNT or the account option. Requests are signed with the
+shared key in AZURE_STORAGE_KEY, or carry the SAS token in AZURE_STORAGE_SAS_TOKEN.
+Azure takes the options account, azure-endpoint, retries and retry-delay.
+
+SFTP is used for targets in the form "sftp://user@host:port/path/test", or
+"sftp://user@host/~/test" for a path in the home directory. It authenticates with the key
+given by the identity option, otherwise the keys of ssh-agent or ~/.ssh, and verifies the
+host against ~/.ssh/known_hosts or the known-hosts option. Chunks are written to temporary
+files and renamed once complete. SFTP takes the options identity, known-hosts and timeout.
+
+Filesystem is used for "file://" urls, or when the target is not a url.
+A path ending with ".mtar", such as "file:///tmp/prod.mtar", is written as one
+self-contained archive instead of a directory of chunks. The archive is a tar file holding
+every chunk, each compressed according to -compression, with an index at the end for
+restore to list them quickly. It is only complete once the dump has finished, and restore
+reads it back with the same path as -source.
+
+The -target flag may be given several times to write every chunk to all of the targets at
+once, such as a local NAS and S3 in another region, without dumping the database twice.
+Dumping fails if writing to any of them fails, unless -quorum sets how many targets a chunk
+has to be written to.
+
+Finally stdout is used if "-" is specified, writing all objects as one continuous
+tar stream that restore can read from stdin, for example:
 
-Finally stdout is used if "-" is specified.
+	mongotool dump -target - | ssh backup mongotool restore -source -
 
 Set -size to pick how many MB of bson we should read until moving on with the next chunk of data.
 
-The -compress flag specifies if we should compress data before hitting the target storage.
+The -compression flag specifies how data is compressed before hitting the target storage,
+in the form "codec" or "codec:level", for example "zstd:19". The available codecs are
+gzip, zstd, lz4 and xz. Set it to "none" to store data uncompressed. As the flag used to
+be a boolean, "true" and "false" are still accepted, standing for gzip and none.
+
+The -compression-procs flag specifies how many CPUs each worker may compress on, for
+the codecs supporting it. Gzip then compresses blocks of 1MB in parallel, written as
+separate gzip members that any gzip reader handles as one stream.
+
+The -encryption-key-file flag turns on client side encryption, using a key file of 32
+random bytes or 64 hex characters, such as one made by: openssl rand -hex 32
+The -encryption-passphrase-env flag instead names an environment variable holding a
+passphrase to derive the key from. Every object is encrypted with AES-256-GCM using a
+key of its own, and the id of the key is stored with it.
+
+The -sse flag has S3 encrypt saved objects with keys managed by S3 ("AES256") or by
+KMS ("aws:kms"), using the KMS key given by -sse-kms-key-id or the default one of the account.
+The -sse-c-key-file flag instead has S3 encrypt objects with a key of your own, read from a
+file of 32 random bytes or 64 hex characters. The same key is needed to restore them.
+
+The -storage-class flag sets the S3 storage class of every chunk, such as STANDARD_IA,
+GLACIER or DEEP_ARCHIVE, otherwise the default class of the bucket is used.
+Chunks archived in GLACIER or DEEP_ARCHIVE are restored by restore before reading them.
+
+The -object-lock-mode flag protects chunks with S3 Object Lock, so they can't be deleted or
+overwritten until -object-lock-retain-until, not even with the credentials used to dump them.
+In GOVERNANCE mode users with special permissions can still remove the lock, while nobody can
+in COMPLIANCE mode. The retain until date is given in RFC 3339 format, such as
+2030-01-01T00:00:00Z, or as a duration from the dump, such as 2160h for 90 days.
+Set -object-lock-legal-hold to also put chunks under a legal hold, keeping them until it is
+removed. The bucket needs to have Object Lock enabled.
+
+Every chunk is saved with the tags database, collections, dump-id, version and codec,
+as user metadata and object tags on S3 or in a ".tags.json" file next to it on filesystem.
+Tags S3 can't take as object tags, such as the list of collections, are only kept as metadata.
+Metadata is limited to 2KB on S3 and 8KB on GCS and Azure, so the largest tags, such as the
+list of collections of a large database, are left out of it when they don't fit.
+
+The SHA-256 checksum of every chunk is saved next to it as "<chunk>.sha256", except when
+writing to stdout, for restore to verify. Uploads to S3 are sent with their MD5 as well,
+which S3 verifies before saving them.
 
 The -concurrency flag specifies how many objects to dump to the target at the same time
 
 If the -progress flag is set to true, an object count will be displayed
+
+The -max-upload-rate and -max-download-rate flags limit how many bytes per second are written
+to and read from the storage, in sizes such as "50MB" or "512KB", shared by all workers so
+that the dump doesn't saturate the network. The -max-request-rate flag limits how many
+requests per second are made to the storage, counting every request sent to S3, GCS or Azure,
+such as every page of a listing, part of an upload or retry.
+
+The -retries flag specifies how many times a request to S3 is attempted before giving up,
+waiting an exponentially growing and randomized delay starting at -retry-delay in between.
 `,
 }
 
 var (
 	// dump flags
-	dumpHost        string
-	dumpCollection  string
-	dumpTarget      string
-	dumpProgress    bool
-	dumpConcurrency int
-	dumpSize        int
-	dumpCompress    bool
+	dumpHost          string
+	dumpCollection    string
+	dumpTargets       stringsFlag
+	dumpProgress      bool
+	dumpConcurrency   int
+	dumpSize          int
+	dumpCompress      string
+	dumpCompressProcs int
 )
 
 func init() {
 	cmdDump.Run = runDump
 	cmdDump.Flag.StringVar(&dumpHost, "host", "localhost:27017/test", "")
 	cmdDump.Flag.StringVar(&dumpCollection, "collection", "", "")
-	cmdDump.Flag.StringVar(&dumpTarget, "target", "https://mongotool.s3.amazonaws.com/dump", "")
+	cmdDump.Flag.Var(&dumpTargets, "target", "")
 	cmdDump.Flag.IntVar(&dumpSize, "size", 1000, "Megabytes per stored chunk")
 	cmdDump.Flag.BoolVar(&dumpProgress, "progress", true, "")
-	cmdDump.Flag.BoolVar(&dumpCompress, "compression", true, "")
+	cmdDump.Flag.StringVar(&dumpCompress, "compression", "gzip", "")
+	cmdDump.Flag.IntVar(&dumpCompressProcs, "compression-procs", runtime.NumCPU(), "")
 	cmdDump.Flag.IntVar(&dumpConcurrency, "concurrency", 1, "")
+	cmdDump.Flag.StringVar(&storageClass, "storage-class", "", "")
+	cmdDump.Flag.StringVar(&storageLockMode, "object-lock-mode", "", "")
+	cmdDump.Flag.StringVar(&storageLockRetainUntil, "object-lock-retain-until", "", "")
+	cmdDump.Flag.BoolVar(&storageLockLegalHold, "object-lock-legal-hold", false, "")
+	cmdDump.Flag.IntVar(&storageQuorum, "quorum", 0, "")
+	addStorageFlags(cmdDump)
 }
 
 func randString(length int) string {
@@ -80,15 +190,19 @@ func randString(length int) string {
 
 // Worker is responsible of writing the tar archive to storage.
 // The amount of object data read into each file is contrained to specified size.
-func worker(objects chan storage.Filer, errors chan error, store storage.Saver, root, suffix string, size int) {
+// Every chunk is saved with tags, if the storage supports them.
+// A chunk that can't be saved stops the dump through stop, leaving the objects to the other workers
+// rather than dropping them.
+func worker(objects chan storage.Filer, errors chan error, store storage.Saver, root, suffix string, size int, tags storage.Tagger, stop func()) {
 chunk:
 	for {
 		// New chunk of data for specified size
 		remaining := storage.ByteSize(size) * storage.MB
-		w, err := store.Save(path.Join(root, randString(8)+suffix))
+		w, err := storage.SaveTagged(store, path.Join(root, randString(8)+suffix), tags)
 		if err != nil {
-			errorf("Could not open writer: %v", err)
-			exit()
+			errors <- fmt.Errorf("Could not open writer: %v", err)
+			stop()
+			return
 		}
 		// Read objects into chunk
 		for o := range objects {
@@ -128,8 +242,41 @@ chunk:
 	}
 }
 
+// dumpTags returns the tags every chunk of the dump is saved with.
+func dumpTags(session *mgo.Session, codec storage.Codec) storage.Tags {
+	collections, err := mongo.Collections(session, dumpCollection)
+	if err != nil {
+		errorf("Error listing collections: %v", err)
+		exit()
+	}
+	codecName := "none"
+	if codec != nil {
+		codecName = codec.Name()
+	}
+	return storage.Tags{
+		"database":    session.DB("").Name,
+		"collections": strings.Join(collections, ","),
+		"dump-id":     time.Now().UTC().Format("20060102T150405Z") + "-" + randString(8),
+		"version":     version,
+		"codec":       codecName,
+	}
+}
+
 func runDump(cmd *Command, args []string) {
-	root, store := selectStorage(dumpTarget, dumpCompress)
+	codec, level, err := storage.ParseCodec(dumpCompress)
+	if err != nil {
+		errorf("%v", err)
+		exit()
+	}
+	if c, ok := codec.(storage.ParallelCodec); ok && dumpCompressProcs > 1 {
+		codec = c.Parallel(dumpCompressProcs)
+	}
+	if len(dumpTargets) == 0 {
+		dumpTargets = stringsFlag{"https://mongotool.s3.amazonaws.com/dump"}
+	}
+	root, store := selectStorage(dumpTargets, codec, level)
+	session := mongoSession(dumpHost)
+	tags := dumpTags(session, codec)
 
 	// Buffer additional objects exceeding one worker
 	objects := make(chan storage.Filer, dumpConcurrency-1)
@@ -137,22 +284,34 @@ func runDump(cmd *Command, args []string) {
 	// Errors from workers and final sync for any pending work
 	errc := make(chan error, 1)
 
+	// Closed by the first worker failing to save a chunk, to stop reading objects
+	stopped := make(chan bool)
+	var stopOnce sync.Once
+	stop := func() {
+		stopOnce.Do(func() { close(stopped) })
+	}
+
 	done := make(chan bool)
 	suffix := ".tar"
-	if dumpCompress {
-		suffix += ".gz"
+	if codec != nil {
+		suffix += codec.Ext()
 	}
 	for n := 0; n < dumpConcurrency; n++ {
 		go func() {
-			worker(objects, errc, store, root, suffix, dumpSize)
+			worker(objects, errc, store, root, suffix, dumpSize, tags, stop)
 			done <- true
 		}()
 	}
 
 	count := make(chan bool)
 	go func() {
-		for o := range mongo.Dump(mongoSession(dumpHost), dumpCollection) {
-			objects <- o
+	dump:
+		for o := range mongo.Dump(session, dumpCollection) {
+			select {
+			case objects <- o:
+			case <-stopped:
+				break dump
+			}
 			// Don't count indexes as "objects"
 			if !strings.HasSuffix(o.Path(), "/indexes.json") {
 				count <- true
@@ -191,4 +350,9 @@ func runDump(cmd *Command, args []string) {
 		}
 	}
 	fmt.Fprintln(os.Stderr)
+
+	// Some storages, such as archives, are only complete once closed.
+	if err := storage.Close(store); err != nil {
+		errorf("Error closing storage: %v", err)
+	}
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"github.com/duego/mongotool/mongo"
+	"github.com/duego/mongotool/storage"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"testing"
+)
+
+// fullStorage fails saving any object.
+type fullStorage struct {
+	*storage.Memory
+}
+
+func (f fullStorage) Save(path string) (io.WriteCloser, error) {
+	return nil, errors.New("disk full")
+}
+
+func TestWorker(t *testing.T) {
+	Convey("Given objects to dump", t, func() {
+		objects := make(chan storage.Filer, 10)
+		for n := 0; n < 10; n++ {
+			objects <- mongo.NewFile("test", "users", fmt.Sprint(n), []byte("foo"))
+		}
+		close(objects)
+		errc := make(chan error, 10)
+		stopped := false
+		stop := func() {
+			stopped = true
+		}
+
+		Convey("A worker failing to save a chunk should stop the dump without taking any object", func() {
+			worker(objects, errc, fullStorage{storage.NewMemory()}, "dump", ".tar", 1, nil, stop)
+			So(<-errc, ShouldNotBeNil)
+			So(stopped, ShouldBeTrue)
+			So(len(objects), ShouldEqual, 10)
+
+			Convey("Leaving every object to the other workers", func() {
+				mem := storage.NewMemory()
+				worker(objects, errc, mem, "dump", ".tar", 1, nil, stop)
+				So(<-errc, ShouldBeNil)
+				saved := 0
+				err := storage.Walk(mem, "dump", func(fpath string, err error) error {
+					if err != nil {
+						return err
+					}
+					r, err := mem.Fetch(fpath)
+					if err != nil {
+						return err
+					}
+					defer r.Close()
+					tr := tar.NewReader(r)
+					for {
+						if _, err := tr.Next(); err == io.EOF {
+							return nil
+						} else if err != nil {
+							return err
+						}
+						saved++
+					}
+				})
+				So(err, ShouldBeNil)
+				So(saved, ShouldEqual, 10)
+			})
+		})
+	})
+}
@@ -83,6 +83,9 @@ func help(args []string) {
 	os.Exit(2)
 }
 
+// version is stored with dumps, set it when building with: -ldflags "-X main.version=1.2.3"
+var version = "dev"
+
 var commands = []*Command{
 	cmdDump,
 	cmdRestore,
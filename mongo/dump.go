@@ -73,7 +73,27 @@ func (o *Object) SetBSON(raw bson.Raw) error {
 // GetBSON implements the bson.Getter, making it possible to pass the raw bson that should be put
 // into MongoDB instead of going through the marshalling process.
 func (o *Object) GetBSON() (interface{}, error) {
-	return bson.Raw{objectKind, o.Bson}, nil
+	return bson.Raw{Kind: objectKind, Data: o.Bson}, nil
+}
+
+// Collections returns the collections Dump reads, which is all collections of the database selected
+// by the session except the system ones, unless only collection is asked for.
+func Collections(s *mgo.Session, collection string) ([]string, error) {
+	if collection != "" {
+		return []string{collection}, nil
+	}
+	cols, err := s.DB("").CollectionNames()
+	if err != nil {
+		return nil, err
+	}
+	var collections []string
+	for _, col := range cols {
+		// Skip internal system collections
+		if !strings.HasPrefix(col, "system.") {
+			collections = append(collections, col)
+		}
+	}
+	return collections, nil
 }
 
 // Dump will stream all objects from a collection on the returned channel
@@ -88,23 +108,13 @@ func Dump(s *mgo.Session, collection string) <-chan *File {
 		// Get the database selected by the connection string
 		db := s.DB("")
 
-		var collections []string
-		if collection == "" {
-			if cols, err := db.CollectionNames(); err != nil {
-				log.Println(err)
-				return
-			} else {
-				collections = cols
-			}
-		} else {
-			collections = append(collections, collection)
+		collections, err := Collections(s, collection)
+		if err != nil {
+			log.Println(err)
+			return
 		}
 
 		for _, collection := range collections {
-			// Skip internal system collections
-			if strings.HasPrefix(collection, "system.") {
-				continue
-			}
 			col := db.C(collection)
 
 			// Dump indexes
@@ -13,42 +13,114 @@ import (
 	"labix.org/v2/mgo/bson"
 	"os"
 	"strings"
+	"time"
 )
 
 var cmdRestore = &Command{
 	UsageLine: "restore [-host address] [-source path]",
-	Short:     "restore database from S3 bucket, filesystem or stdin",
+	Short:     "restore database from S3, GCS, Azure, SFTP, filesystem or stdin",
 	Long: `
-Restore reads objects from a bucket on Amazon S3, filesystem or standard input.
+Restore reads objects from Amazon S3, Google Cloud Storage, Azure Blob Storage, SFTP, filesystem or
+standard input.
 The objects are written to collections of the specified database.
-For the authentication towards S3 to work, you need to set the environment
-variables AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.
+For the authentication towards S3, credentials are looked up in the environment
+variables AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN, then a web
+identity token from AWS_WEB_IDENTITY_TOKEN_FILE and AWS_ROLE_ARN, and finally the
+profile of the shared credentials file ~/.aws/credentials selected by AWS_PROFILE.
+
+The -profile flag selects a profile of the shared credentials file, ignoring the other sources.
 
 The -host flag specifies which host and database to write to.
 For example to select "test" database of localhost: localhost:27017/test
 
-The -source flag specifies which of S3 bucket, filesystem or stdout to read from.
+The -source flag specifies where to read from: an S3 bucket, a Google Cloud Storage bucket
+("gs://"), an Azure Blob Storage container ("az://"), a SFTP server ("sftp://"), a directory
+or ".mtar" archive on the filesystem, or stdin.
 
 S3 bucket is recognized when target path is in the form: "https://mongotool.s3.amazonaws.com/test".
 This would use the mongotool bucket with "test" as its root.
 
-Filesystem is used when a url is not recognized.
+S3 compatible services such as MinIO or Ceph RGW are used by setting -endpoint to
+their address, for example "http://minio:9000", together with a target in the form
+"s3://bucket/test". Set -path-style to address the bucket as "http://minio:9000/bucket"
+instead of "http://bucket.minio:9000", which also makes http targets in the form
+"http://minio:9000/bucket/test" use the first path element as bucket.
+The -region flag sets the region requests are signed for, otherwise it is guessed
+from the AWS host name, AWS_REGION or defaults to us-east-1.
+
+Options of the storage may also be given in the query of the source, taking precedence
+over the flags, for example "s3://bucket/test?region=eu-west-1&retries=10". S3 takes
+the options endpoint, region, path-style, profile, retries, retry-delay, sse,
+sse-kms-key-id and sse-c-key-file.
+
+Google Cloud Storage is used for sources in the form "gs://bucket/test", authenticating
+with the JSON key file of a service account named by GOOGLE_APPLICATION_CREDENTIALS or the
+credentials option. Requests go to the emulator set by STORAGE_EMULATOR_HOST, if any.
+GCS takes the options gcs-endpoint, credentials, retries and retry-delay.
+
+Azure Blob Storage is used for sources in the form "az://container/test", in the storage
+account named by AZURE_STORAGE_ACCOUNT or the account option. Requests are signed with the
+shared key in AZURE_STORAGE_KEY, or carry the SAS token in AZURE_STORAGE_SAS_TOKEN.
+Azure takes the options account, azure-endpoint, retries and retry-delay.
+
+SFTP is used for sources in the form "sftp://user@host:port/path/test", or
+"sftp://user@host/~/test" for a path in the home directory. It authenticates with the key
+given by the identity option, otherwise the keys of ssh-agent or ~/.ssh, and verifies the
+host against ~/.ssh/known_hosts or the known-hosts option. Chunks are written to temporary
+files and renamed once complete. SFTP takes the options identity, known-hosts and timeout.
+
+Filesystem is used for "file://" urls, or when the source is not a url.
+A path ending with ".mtar" is read as an archive written by dump, for example "/tmp/prod.mtar".
 
-Finally stdin is used if "-" is specified.
+Finally stdin is used if "-" is specified, reading the stream written by dump to stdout.
 
-Set -compression to false if the dump did not have compression enabled.
+Compression is detected for every object read, so dumps using any codec, or none
+at all, can be restored. The -compression flag is deprecated and ignored, only kept
+for compatibility.
+
+The -encryption-key-file flag turns on client side encryption, using a key file of 32
+random bytes or 64 hex characters, such as one made by: openssl rand -hex 32
+The -encryption-passphrase-env flag instead names an environment variable holding a
+passphrase to derive the key from. Every object is encrypted with AES-256-GCM using a
+key of its own, and the id of the key is stored with it.
+Restoring fails if an object is not encrypted, was encrypted with another key or has
+been tampered with. When both flags are given, objects encrypted with either key are read.
+
+The -sse-c-key-file flag gives the key objects were encrypted with by S3, when dumped with
+-sse-c-key-file. Objects encrypted with keys managed by S3 or KMS need no flags to be read.
+
+Chunks archived in the GLACIER or DEEP_ARCHIVE storage classes of S3 are detected when
+reading them. Restore then asks S3 to restore every archived chunk of the source and waits
+until they are all available before going on, checking them every -restore-poll.
+The -restore-days flag specifies for how many days the restored copies are kept, and
+-restore-tier how fast they are restored: Expedited, Standard or Bulk.
+
+Chunks are verified against the SHA-256 checksum saved next to them by dump, and chunks
+fetched from S3 against their MD5 when S3 knows it. Restoring fails naming the chunk when
+it is corrupted or truncated. Chunks dumped without a checksum are read unverified.
 
 Set -indexes to false to skip ensure indexes.
+
+The -max-upload-rate and -max-download-rate flags limit how many bytes per second are written
+to and read from the storage, in sizes such as "50MB" or "512KB", shared by all workers so
+that the restore doesn't saturate the network. The -max-request-rate flag limits how many
+requests per second are made to the storage, counting every request sent to S3, GCS or Azure,
+such as every page of a listing, part of an upload or retry.
+
+The -retries flag specifies how many times a request to S3 is attempted before giving up,
+waiting an exponentially growing and randomized delay starting at -retry-delay in between.
 `,
 }
 
 var (
 	// restore flags
-	restoreHost       string
-	restoreSource     string
-	restoreProgress   bool
-	restoreCompressed bool
-	restoreIndexes    bool
+	restoreHost     string
+	restoreSource   string
+	restoreProgress bool
+	restoreIndexes  bool
+	restoreDays     int
+	restoreTier     string
+	restorePoll     time.Duration
 )
 
 func init() {
@@ -56,8 +128,12 @@ func init() {
 	cmdRestore.Flag.StringVar(&restoreHost, "host", "localhost:27017/test", "")
 	cmdRestore.Flag.StringVar(&restoreSource, "source", "https://mongotool.s3.amazonaws.com/dump", "")
 	cmdRestore.Flag.BoolVar(&restoreProgress, "progress", true, "")
-	cmdRestore.Flag.BoolVar(&restoreCompressed, "compression", true, "")
+	cmdRestore.Flag.Var(deprecatedFlag("-compression is ignored, as compression is detected for every object"), "compression", "")
 	cmdRestore.Flag.BoolVar(&restoreIndexes, "indexes", true, "")
+	cmdRestore.Flag.IntVar(&restoreDays, "restore-days", 1, "")
+	cmdRestore.Flag.StringVar(&restoreTier, "restore-tier", storage.TierStandard, "")
+	cmdRestore.Flag.DurationVar(&restorePoll, "restore-poll", 5*time.Minute, "")
+	addStorageFlags(cmdRestore)
 }
 
 // entryToObject constructs a mongo object from the tar entry
@@ -98,25 +174,74 @@ func entryToIndexes(name string, r io.Reader) (col string, index []*mgo.Index, e
 	return
 }
 
+// restoreArchived restores every archived object under root, waiting until they can all be fetched.
+func restoreArchived(store storage.Fetcher, root string) error {
+	var archived []string
+	err := storage.Walk(store, root, func(fpath string, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := storage.Stat(store, fpath)
+		if err != nil || !info.Archived {
+			return err
+		}
+		archived = append(archived, fpath)
+		return storage.Restore(store, fpath, restoreDays, restoreTier)
+	})
+	if err != nil {
+		return err
+	}
+
+	for len(archived) > 0 {
+		fmt.Fprintf(os.Stderr, "\rWaiting for %d archived objects to be restored", len(archived))
+		time.Sleep(restorePoll)
+		remaining := archived[:0]
+		for _, fpath := range archived {
+			info, err := storage.Stat(store, fpath)
+			if err != nil {
+				return err
+			}
+			if info.Archived {
+				remaining = append(remaining, fpath)
+			}
+		}
+		archived = remaining
+	}
+	fmt.Fprintln(os.Stderr)
+	return nil
+}
+
 func runRestore(cmd *Command, args []string) {
-	root, store := selectStorage(restoreSource, restoreCompressed)
+	root, store := selectStorage([]string{restoreSource}, nil, storage.DefaultLevel)
+	// Closing ends the connections of storages such as SFTP.
+	defer storage.Close(store)
 	db := mongoSession(restoreHost).DB("")
 
 	var total int64
+	restored := false
 	colIndexes := make(map[string][]*mgo.Index, 0)
-	err := store.(storage.Walker).Walk(root, func(fpath string, err error) error {
-		if err != nil {
-			return err
-		}
+	restoreChunk := func(fpath string) error {
 		r, err := store.Fetch(fpath)
+		// Restore every archived object at once, rather than waiting for them one by one.
+		if storage.IsArchived(err) && !restored {
+			restored = true
+			if err := restoreArchived(store, root); err != nil {
+				return err
+			}
+			r, err = store.Fetch(fpath)
+		}
 		if err != nil {
 			return err
 		}
+		defer r.Close()
 		tr := tar.NewReader(r)
 		for {
 			h, err := tr.Next()
+			// The tar reader stops at the end of the archive, while checksums are only verified once
+			// everything has been read.
 			if err == io.EOF {
-				return nil
+				_, err = io.Copy(ioutil.Discard, r)
+				return err
 			}
 			if err != nil {
 				return err
@@ -146,6 +271,16 @@ func runRestore(cmd *Command, args []string) {
 				colIndexes[col] = indexes
 			}
 		}
+	}
+	err := storage.Walk(store, root, func(fpath string, err error) error {
+		if err == nil {
+			err = restoreChunk(fpath)
+		}
+		// Name the chunk, as a corrupted one would otherwise only give a tar or checksum error.
+		if err != nil {
+			return fmt.Errorf("Chunk %s: %v", fpath, err)
+		}
+		return nil
 	})
 	fmt.Fprintln(os.Stderr)
 
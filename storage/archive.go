@@ -0,0 +1,346 @@
+package storage
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ArchiveSuffix is the suffix of filesystem targets saved as a single Archive file.
+const ArchiveSuffix = ".mtar"
+
+const (
+	// archiveIndexName is the entry holding the index of the objects, after all of them.
+	archiveIndexName = ".mtar-index.json"
+	// archiveFooterName is the last entry, telling where the index is. Its data is one block.
+	archiveFooterName = ".mtar-footer.json"
+	archiveBlockSize  = 512
+)
+
+// archiveEntry is an object of an Archive, its data being Size bytes at Offset of the file.
+type archiveEntry struct {
+	Path    string            `json:"path"`
+	Offset  int64             `json:"offset"`
+	Size    int64             `json:"size"`
+	ModTime time.Time         `json:"modTime"`
+	Tags    map[string]string `json:"tags,omitempty"`
+}
+
+// archiveFooter tells where the index of an Archive is.
+type archiveFooter struct {
+	IndexOffset int64 `json:"indexOffset"`
+	IndexSize   int64 `json:"indexSize"`
+}
+
+// Archive implements the SaveFetcher for a single tar file holding every object, which any tar tool
+// can read as well. Objects saved concurrently are spooled to temporary files, then appended one at
+// a time. An index of the objects is added once the archive is closed, at the end of the file, so
+// that objects are found without reading the whole archive.
+//
+// Saving objects writes a new archive, replacing the one at Path when closed. Until then objects are
+// fetched from the new archive, otherwise from the one at Path. Archives without an index, such as
+// ones not closed in time, are read by going through every entry.
+type Archive struct {
+	Path string
+
+	mu sync.Mutex
+	// w is the new archive being written, with the index of what has been written to it.
+	w       *os.File
+	tw      *tar.Writer
+	cw      *countingWriter
+	written map[string]archiveEntry
+	// r is the archive at Path, with its index read when first needed.
+	r     *os.File
+	index map[string]archiveEntry
+}
+
+func NewArchive(fpath string) *Archive {
+	return &Archive{Path: fpath}
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (a *Archive) Save(fpath string) (io.WriteCloser, error) {
+	return a.SaveTags(fpath, nil)
+}
+
+// SaveTags saves the tags in the index of the archive.
+func (a *Archive) SaveTags(fpath string, tags Tagger) (io.WriteCloser, error) {
+	dir, name := path.Split(a.Path)
+	spool, err := ioutil.TempFile(dir, "."+name+tempMarker)
+	if err != nil {
+		return nil, err
+	}
+	w := &archiveWriter{File: spool, a: a, path: strings.TrimLeft(fpath, "/")}
+	if tags != nil {
+		w.tags = tags.Tags()
+	}
+	return w, nil
+}
+
+// archiveWriter spools an object, which is appended to the archive once closed.
+type archiveWriter struct {
+	*os.File
+	a    *Archive
+	path string
+	tags map[string]string
+}
+
+func (w *archiveWriter) Close() error {
+	defer os.Remove(w.File.Name())
+	defer w.File.Close()
+	info, err := w.File.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := w.File.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return w.a.append(w.path, w.File, info.Size(), w.tags)
+}
+
+// Abort removes the spooled object instead of appending it to the archive.
+func (w *archiveWriter) Abort() error {
+	w.File.Close()
+	return os.Remove(w.File.Name())
+}
+
+// append writes an object of size read from r to the new archive, creating it if needed.
+func (a *Archive) append(fpath string, r io.Reader, size int64, tags map[string]string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.w == nil {
+		dir, name := path.Split(a.Path)
+		if dir != "" {
+			if err := os.MkdirAll(dir, 0700); err != nil {
+				return err
+			}
+		}
+		// The archive is meant to be handed over, so it gets the usual mode rather than the one of a spool.
+		w, err := createTemp(dir, name)
+		if err != nil {
+			return err
+		}
+		a.w, a.cw = w, &countingWriter{w: w}
+		a.tw = tar.NewWriter(a.cw)
+		a.written = make(map[string]archiveEntry)
+	}
+	entry := archiveEntry{Path: fpath, Size: size, ModTime: time.Now().UTC().Truncate(time.Second), Tags: tags}
+	if err := a.tw.WriteHeader(&tar.Header{
+		Name:     fpath,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  entry.ModTime,
+		Typeflag: tar.TypeReg,
+	}); err != nil {
+		return err
+	}
+	entry.Offset = a.cw.n
+	if _, err := io.Copy(a.tw, r); err != nil {
+		return err
+	}
+	if err := a.tw.Flush(); err != nil {
+		return err
+	}
+	a.written[fpath] = entry
+	return nil
+}
+
+// Close completes the archive being written with its index, and moves it to Path.
+func (a *Archive) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.r != nil {
+		a.r.Close()
+		a.r, a.index = nil, nil
+	}
+	if a.w == nil {
+		return nil
+	}
+	err := a.finish()
+	if cerr := a.w.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(a.w.Name(), a.Path)
+	}
+	if err != nil {
+		os.Remove(a.w.Name())
+	}
+	a.w, a.tw, a.cw, a.written = nil, nil, nil, nil
+	return err
+}
+
+// finish writes the index and the footer pointing at it, followed by the end of the tar archive.
+func (a *Archive) finish() error {
+	entries := make([]archiveEntry, 0, len(a.written))
+	for _, e := range a.written {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	index, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	if err := a.tw.WriteHeader(&tar.Header{Name: archiveIndexName, Mode: 0644, Size: int64(len(index)), ModTime: now, Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+	footer := archiveFooter{IndexOffset: a.cw.n, IndexSize: int64(len(index))}
+	if _, err := a.tw.Write(index); err != nil {
+		return err
+	}
+	b, _ := json.Marshal(footer)
+	// The footer fills one block, so that it is found at a fixed distance from the end.
+	b = append(b, strings.Repeat(" ", archiveBlockSize-len(b)-1)+"\n"...)
+	if err := a.tw.WriteHeader(&tar.Header{Name: archiveFooterName, Mode: 0644, Size: int64(len(b)), ModTime: now, Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+	if _, err := a.tw.Write(b); err != nil {
+		return err
+	}
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	return a.w.Sync()
+}
+
+// entries returns the file and index objects are read from, the new archive if one is being written.
+func (a *Archive) entries() (*os.File, map[string]archiveEntry, error) {
+	if a.w != nil {
+		return a.w, a.written, nil
+	}
+	if a.r == nil {
+		r, err := os.Open(a.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+		index, err := readArchiveIndex(r)
+		if err != nil {
+			r.Close()
+			return nil, nil, fmt.Errorf("Could not read archive %s: %v", a.Path, err)
+		}
+		a.r, a.index = r, index
+	}
+	return a.r, a.index, nil
+}
+
+// readArchiveIndex reads the index at the end of the archive, or goes through the whole archive when
+// there is none.
+func readArchiveIndex(r *os.File) (map[string]archiveEntry, error) {
+	info, err := r.Stat()
+	if err != nil {
+		return nil, err
+	}
+	index := make(map[string]archiveEntry)
+	// The footer is followed by the two empty blocks ending the archive.
+	if offset := info.Size() - 4*archiveBlockSize; offset >= 0 {
+		tr := tar.NewReader(io.NewSectionReader(r, offset, 2*archiveBlockSize))
+		var footer archiveFooter
+		if h, err := tr.Next(); err == nil && h.Name == archiveFooterName && json.NewDecoder(tr).Decode(&footer) == nil {
+			var entries []archiveEntry
+			if err := json.NewDecoder(io.NewSectionReader(r, footer.IndexOffset, footer.IndexSize)).Decode(&entries); err != nil {
+				return nil, err
+			}
+			for _, e := range entries {
+				index[e.Path] = e
+			}
+			return index, nil
+		}
+	}
+
+	cr := &countingReader{r: io.NewSectionReader(r, 0, info.Size())}
+	tr := tar.NewReader(cr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return index, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if h.Typeflag != tar.TypeReg || strings.HasPrefix(path.Base(h.Name), ".mtar-") {
+			continue
+		}
+		index[h.Name] = archiveEntry{Path: h.Name, Offset: cr.n, Size: h.Size, ModTime: h.ModTime}
+	}
+}
+
+func (a *Archive) Fetch(fpath string) (io.ReadCloser, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	r, index, err := a.entries()
+	if err != nil {
+		return nil, err
+	}
+	e, ok := index[strings.TrimLeft(fpath, "/")]
+	if !ok {
+		return nil, &os.PathError{Op: "fetch", Path: fpath, Err: os.ErrNotExist}
+	}
+	return ioutil.NopCloser(io.NewSectionReader(r, e.Offset, e.Size)), nil
+}
+
+func (a *Archive) Walk(p string, walkfn WalkFunc) error {
+	a.mu.Lock()
+	_, index, err := a.entries()
+	var paths []string
+	p = strings.Trim(p, "/")
+	for name := range index {
+		if p == "" || name == p || strings.HasPrefix(name, p+"/") {
+			paths = append(paths, name)
+		}
+	}
+	a.mu.Unlock()
+	if err != nil {
+		return walkfn(p, err)
+	}
+	sort.Strings(paths)
+	for _, name := range paths {
+		if err := walkfn(name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *Archive) Stat(fpath string) (ObjectInfo, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, index, err := a.entries()
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	e, ok := index[strings.TrimLeft(fpath, "/")]
+	if !ok {
+		return ObjectInfo{}, &os.PathError{Op: "stat", Path: fpath, Err: os.ErrNotExist}
+	}
+	return ObjectInfo{Path: e.Path, Size: e.Size, ModTime: e.ModTime, Tags: e.Tags}, nil
+}
@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"archive/tar"
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestArchive(t *testing.T) {
+	Convey("Given an archive in a temporary directory", t, func() {
+		dir, err := ioutil.TempDir("", "mongotool")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		fpath := filepath.Join(dir, "dump"+ArchiveSuffix)
+		archive := NewArchive(fpath)
+
+		Convey("Objects saved concurrently are all written to one file once closed", func() {
+			var wg sync.WaitGroup
+			errs := make(chan error, 10)
+			for n := 0; n < 10; n++ {
+				wg.Add(1)
+				go func(n int) {
+					defer wg.Done()
+					w, err := archive.SaveTags(fmt.Sprintf("dump/%02d.tar", n), Tags{"dump-id": "1"})
+					if err == nil {
+						_, err = fmt.Fprintf(w, "chunk %d", n)
+					}
+					if err == nil {
+						err = w.Close()
+					}
+					errs <- err
+				}(n)
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				So(err, ShouldBeNil)
+			}
+			_, err := os.Stat(fpath)
+			So(os.IsNotExist(err), ShouldBeTrue)
+			So(archive.Close(), ShouldBeNil)
+
+			files, err := ioutil.ReadDir(dir)
+			So(err, ShouldBeNil)
+			So(len(files), ShouldEqual, 1)
+			fd, err := os.Create(filepath.Join(dir, "created"))
+			So(err, ShouldBeNil)
+			fd.Close()
+			created, err := os.Stat(filepath.Join(dir, "created"))
+			So(err, ShouldBeNil)
+			So(files[0].Mode(), ShouldEqual, created.Mode())
+			os.Remove(filepath.Join(dir, "created"))
+
+			Convey("Which is a tar archive holding every object, followed by the index", func() {
+				fd, err := os.Open(fpath)
+				So(err, ShouldBeNil)
+				defer fd.Close()
+				var names []string
+				tr := tar.NewReader(fd)
+				for {
+					h, err := tr.Next()
+					if err == io.EOF {
+						break
+					}
+					So(err, ShouldBeNil)
+					names = append(names, h.Name)
+				}
+				So(len(names), ShouldEqual, 12)
+				So(names[10], ShouldEqual, archiveIndexName)
+				So(names[11], ShouldEqual, archiveFooterName)
+			})
+
+			Convey("Which is read back using the index", func() {
+				archive := NewArchive(fpath)
+				defer archive.Close()
+				var paths []string
+				err := archive.Walk("dump", func(p string, err error) error {
+					paths = append(paths, p)
+					return err
+				})
+				So(err, ShouldBeNil)
+				So(len(paths), ShouldEqual, 10)
+				So(paths[0], ShouldEqual, "dump/00.tar")
+
+				info, err := archive.Stat("dump/03.tar")
+				So(err, ShouldBeNil)
+				So(info.Size, ShouldEqual, 7)
+				So(info.Tags, ShouldResemble, map[string]string{"dump-id": "1"})
+
+				r, err := archive.Fetch("dump/03.tar")
+				So(err, ShouldBeNil)
+				b, err := ioutil.ReadAll(r)
+				So(err, ShouldBeNil)
+				So(string(b), ShouldEqual, "chunk 3")
+			})
+		})
+
+		Convey("An archive without an index is read by going through it", func() {
+			fd, err := os.Create(fpath)
+			So(err, ShouldBeNil)
+			tw := tar.NewWriter(fd)
+			for _, name := range []string{"dump/a.tar", "dump/b.tar"} {
+				So(tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: 3, Typeflag: tar.TypeReg}), ShouldBeNil)
+				_, err := tw.Write([]byte(name[5:8]))
+				So(err, ShouldBeNil)
+			}
+			So(tw.Close(), ShouldBeNil)
+			So(fd.Close(), ShouldBeNil)
+
+			r, err := archive.Fetch("dump/b.tar")
+			So(err, ShouldBeNil)
+			b, err := ioutil.ReadAll(r)
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "b.t")
+			info, err := archive.Stat("dump/a.tar")
+			So(err, ShouldBeNil)
+			So(info.Size, ShouldEqual, 3)
+		})
+
+		Convey("Paths ending with the archive suffix are opened as an archive", func() {
+			store, _, err := Open(fpath, nil)
+			So(err, ShouldBeNil)
+			So(store, ShouldResemble, archive)
+			store, _, err = Open("file://"+fpath, nil)
+			So(err, ShouldBeNil)
+			So(store, ShouldResemble, archive)
+		})
+	})
+}
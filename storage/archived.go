@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Storage classes of S3 objects. Objects of the archive classes GLACIER and DEEP_ARCHIVE have to be
+// restored before they can be fetched.
+var StorageClasses = []string{
+	"STANDARD", "REDUCED_REDUNDANCY", "STANDARD_IA", "ONEZONE_IA", "INTELLIGENT_TIERING",
+	"GLACIER_IR", "GLACIER", "DEEP_ARCHIVE",
+}
+
+// Restore tiers, trading the time it takes to restore archived objects for their cost.
+const (
+	TierExpedited = "Expedited"
+	TierStandard  = "Standard"
+	TierBulk      = "Bulk"
+)
+
+// ArchivedError is returned when fetching an object that is archived and has to be restored first.
+type ArchivedError struct {
+	Path string
+}
+
+func (e *ArchivedError) Error() string {
+	return e.Path + " is archived and has to be restored before it can be fetched"
+}
+
+// IsArchived tells if err is an ArchivedError.
+func IsArchived(err error) bool {
+	_, ok := err.(*ArchivedError)
+	return ok
+}
+
+// Restore asks for the archived object on path to be restored for days if store is a Restorer.
+func Restore(store Fetcher, path string, days int, tier string) error {
+	if r, ok := store.(Restorer); ok {
+		return r.Restore(path, days, tier)
+	}
+	return ErrNotSupported
+}
+
+// validStorageClass tells if class is one of StorageClasses.
+func validStorageClass(class string) bool {
+	for _, c := range StorageClasses {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// s3Error is the error document S3 responds with.
+type s3Error struct {
+	Code    string
+	Message string
+}
+
+// readS3Error reads the error of a failed response, closing its body.
+func readS3Error(resp *http.Response) (e s3Error) {
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	xml.Unmarshal(b, &e)
+	return
+}
+
+// archived tells if the HEAD response of an object is for an archived object not yet restored.
+// The x-amz-restore header is ongoing-request="false" once a restored copy is available.
+func archived(h http.Header) bool {
+	switch h.Get("X-Amz-Storage-Class") {
+	case "GLACIER", "DEEP_ARCHIVE":
+		return !strings.Contains(h.Get("X-Amz-Restore"), `ongoing-request="false"`)
+	}
+	return false
+}
+
+// Restore starts restoring an archived object for days, which returns right away. Stat tells when the
+// object is no longer archived. Restoring an object already being restored is not an error.
+func (s S3) Restore(path string, days int, tier string) error {
+	if err := s.checkAwsKeys(); err != nil {
+		return err
+	}
+	if tier == "" {
+		tier = TierStandard
+	}
+	body := fmt.Sprintf("<RestoreRequest><Days>%d</Days><GlacierJobParameters><Tier>%s</Tier></GlacierJobParameters></RestoreRequest>", days, tier)
+	resp, err := s.Retry.Do(s.client, func() (*http.Request, error) {
+		return s.objectReq("POST", s.Bucket, path+"?restore", strings.NewReader(body))
+	})
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusAccepted:
+		resp.Body.Close()
+		return nil
+	}
+	e := readS3Error(resp)
+	if e.Code == "RestoreAlreadyInProgress" {
+		return nil
+	}
+	return errors.New(fmt.Sprintf("Could not restore %s: %d %s %s", path, resp.StatusCode, e.Code, e.Message))
+}
@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"github.com/duego/mongotool/storage/s3test"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestArchived(t *testing.T) {
+	Convey("Given objects saved to S3 with the GLACIER storage class", t, func() {
+		srv := s3test.NewServer()
+		defer srv.Close()
+		srv.RestoreDelay = 50 * time.Millisecond
+		defer setFakeAwsKeys()()
+		s3 := NewS3(srv.BucketURL("mongotool"))
+		s3.StorageClass = "GLACIER"
+		store := NewGzipSaveFetcher(s3)
+
+		w, err := store.Save("dump/object")
+		So(err, ShouldBeNil)
+		io.WriteString(w, "Foo")
+		So(w.Close(), ShouldBeNil)
+		o, _ := srv.Object("mongotool", "dump/object")
+		So(o.Header.Get("X-Amz-Storage-Class"), ShouldEqual, "GLACIER")
+
+		Convey("Fetching them should fail as archived", func() {
+			_, err := store.Fetch("dump/object")
+			So(IsArchived(err), ShouldBeTrue)
+			info, err := Stat(store, "dump/object")
+			So(err, ShouldBeNil)
+			So(info.StorageClass, ShouldEqual, "GLACIER")
+			So(info.Archived, ShouldBeTrue)
+		})
+
+		Convey("Once restored they should be fetched", func() {
+			So(Restore(store, "dump/object", 1, TierBulk), ShouldBeNil)
+			info, err := Stat(store, "dump/object")
+			So(err, ShouldBeNil)
+			So(info.Archived, ShouldBeTrue)
+
+			Convey("Asking again while it is restoring should not fail", func() {
+				So(Restore(store, "dump/object", 1, TierBulk), ShouldBeNil)
+			})
+
+			time.Sleep(srv.RestoreDelay)
+			info, err = Stat(store, "dump/object")
+			So(err, ShouldBeNil)
+			So(info.Archived, ShouldBeFalse)
+			r, err := store.Fetch("dump/object")
+			So(err, ShouldBeNil)
+			b, _ := ioutil.ReadAll(r)
+			So(string(b), ShouldEqual, "Foo")
+		})
+
+		Convey("Restoring objects that are not archived should fail", func() {
+			srv.PutObject("mongotool", "standard", []byte("Foo"))
+			So(s3.Restore("standard", 1, ""), ShouldNotBeNil)
+			info, err := s3.Stat("standard")
+			So(err, ShouldBeNil)
+			So(info.StorageClass, ShouldEqual, "STANDARD")
+			So(info.Archived, ShouldBeFalse)
+		})
+	})
+
+	Convey("The storage class should be an option of S3 targets", t, func() {
+		defer setFakeAwsKeys()()
+		store, _, err := Open("s3://mongotool/dump?storage-class=deep_archive", nil)
+		So(err, ShouldBeNil)
+		So(store.(*S3).StorageClass, ShouldEqual, "DEEP_ARCHIVE")
+		_, _, err = Open("s3://mongotool/dump?storage-class=COLD", nil)
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,461 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// azureVersion is the version of the Blob service REST API requests are made for.
+const azureVersion = "2020-10-02"
+
+// DefaultAzureBlockSize is how much data is buffered for each block of a blob.
+const DefaultAzureBlockSize = 8 * MB
+
+// maxAzureMetadata is how many bytes of metadata Azure allows on one blob.
+const maxAzureMetadata = 8 * KB
+
+// Azure implements the SaveFetcher for a container on Azure Blob Storage. Objects are saved as block
+// blobs, staging a block for every BlockSize of data and committing them once closed, while objects
+// smaller than a block are put at once.
+//
+// Requests are authorized with the shared key of the storage account, or a SAS token.
+type Azure struct {
+	Account   string
+	Container string
+	// Endpoint is the blob service of the account, such as https://account.blob.core.windows.net or
+	// http://127.0.0.1:10000/devstoreaccount1 for Azurite.
+	Endpoint string
+	// Key is the shared key of the account, base64 encoded as shown by the portal.
+	Key string
+	// SAS is a shared access signature, used instead of the key when set.
+	SAS string
+	// BlockSize is how much data is sent with each block, at most 4000MB.
+	BlockSize ByteSize
+	// Retry is the policy for requests failing with transient errors.
+	Retry  RetryPolicy
+	client *http.Client
+}
+
+func NewAzure(account, container string) *Azure {
+	return &Azure{
+		Account:   account,
+		Container: container,
+		Endpoint:  "https://" + account + ".blob.core.windows.net",
+		BlockSize: DefaultAzureBlockSize,
+		Retry:     DefaultRetryPolicy,
+		client:    &http.Client{},
+	}
+}
+
+func (a *Azure) limitTransport(upload, download, requests *Limiter) {
+	a.client = limitClient(a.client, upload, download, requests)
+}
+
+func init() {
+	Register("az", openAzure)
+}
+
+// openAzure opens targets like az://container/root, taking the options:
+//
+//	account         storage account, defaults to AZURE_STORAGE_ACCOUNT
+//	azure-endpoint  blob service endpoint, defaults to https://<account>.blob.core.windows.net
+//	retries         times a request is attempted before giving up
+//	retry-delay     base delay between attempts, such as 200ms
+//
+// The endpoint option is left to S3, as the -endpoint flag gives it to every target.
+// The shared key is read from AZURE_STORAGE_KEY, or a SAS token from AZURE_STORAGE_SAS_TOKEN.
+func openAzure(u *url.URL) (SaveFetcher, string, error) {
+	q := u.Query()
+	if u.Host == "" {
+		return nil, "", errors.New("Expected a target like az://container/root, got: " + u.String())
+	}
+	account := q.Get("account")
+	if account == "" {
+		account = os.Getenv("AZURE_STORAGE_ACCOUNT")
+	}
+	if account == "" {
+		return nil, "", errors.New("No Azure storage account, set AZURE_STORAGE_ACCOUNT or the account option")
+	}
+	a := NewAzure(account, u.Host)
+	if v := q.Get("azure-endpoint"); v != "" {
+		a.Endpoint = v
+	}
+	var err error
+	if v := q.Get("retries"); v != "" {
+		if a.Retry.Attempts, err = strconv.Atoi(v); err != nil {
+			return nil, "", fmt.Errorf("Invalid retries %q", v)
+		}
+	}
+	if v := q.Get("retry-delay"); v != "" {
+		if a.Retry.Delay, err = time.ParseDuration(v); err != nil {
+			return nil, "", fmt.Errorf("Invalid retry-delay %q", v)
+		}
+	}
+	a.Key = os.Getenv("AZURE_STORAGE_KEY")
+	a.SAS = strings.TrimPrefix(os.Getenv("AZURE_STORAGE_SAS_TOKEN"), "?")
+	if a.Key == "" && a.SAS == "" {
+		return nil, "", errors.New("No Azure credentials found, set AZURE_STORAGE_KEY or AZURE_STORAGE_SAS_TOKEN")
+	}
+	return a, strings.Trim(u.Path, "/"), nil
+}
+
+// blobURL returns the url of the blob on path, or of the container when path is empty.
+func (a *Azure) blobURL(path string, query url.Values) string {
+	u := strings.TrimRight(a.Endpoint, "/") + "/" + url.PathEscape(a.Container)
+	if path = strings.TrimLeft(path, "/"); path != "" {
+		// Slashes are kept, as they make up the virtual directories of blobs.
+		u += "/" + strings.Replace(url.PathEscape(path), "%2F", "/", -1)
+	}
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+// do sends an authorized request with body, retrying according to the policy.
+func (a *Azure) do(method, u string, body []byte, header http.Header) (*http.Response, error) {
+	if a.SAS != "" {
+		if strings.Contains(u, "?") {
+			u += "&" + a.SAS
+		} else {
+			u += "?" + a.SAS
+		}
+	}
+	return a.Retry.Do(a.client, func() (*http.Request, error) {
+		req, err := http.NewRequest(method, u, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		req.Header.Set("X-Ms-Date", time.Now().UTC().Format(http.TimeFormat))
+		req.Header.Set("X-Ms-Version", azureVersion)
+		if a.SAS != "" {
+			return req, nil
+		}
+		return req, signSharedKey(req, a.Account, a.Key)
+	})
+}
+
+// signSharedKey authorizes req with the shared key of account, as described by
+// https://learn.microsoft.com/rest/api/storageservices/authorize-with-shared-key
+func signSharedKey(req *http.Request, account, key string) error {
+	secret, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return errors.New("Invalid Azure storage key, expected base64")
+	}
+	length := ""
+	if req.ContentLength > 0 {
+		length = strconv.FormatInt(req.ContentLength, 10)
+	}
+	h := req.Header
+	toSign := strings.Join([]string{
+		req.Method,
+		h.Get("Content-Encoding"),
+		h.Get("Content-Language"),
+		length,
+		h.Get("Content-Md5"),
+		h.Get("Content-Type"),
+		"", // Date, x-ms-date is used instead
+		h.Get("If-Modified-Since"),
+		h.Get("If-Match"),
+		h.Get("If-None-Match"),
+		h.Get("If-Unmodified-Since"),
+		h.Get("Range"),
+	}, "\n") + "\n" + azureCanonicalHeaders(h) + azureCanonicalResource(account, req.URL)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(toSign))
+	req.Header.Set("Authorization", "SharedKey "+account+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	return nil
+}
+
+// azureCanonicalHeaders returns the x-ms-* headers as signed, one per line.
+func azureCanonicalHeaders(h http.Header) string {
+	var names []string
+	for name := range h {
+		if strings.HasPrefix(strings.ToLower(name), "x-ms-") {
+			names = append(names, strings.ToLower(name))
+		}
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, name := range names {
+		buf.WriteString(name + ":" + strings.TrimSpace(h.Get(name)) + "\n")
+	}
+	return buf.String()
+}
+
+// azureCanonicalResource returns the account, path and query parameters of u as signed.
+func azureCanonicalResource(account string, u *url.URL) string {
+	resource := "/" + account + u.EscapedPath()
+	q := u.Query()
+	names := make([]string, 0, len(q))
+	for name := range q {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values := q[name]
+		sort.Strings(values)
+		resource += "\n" + strings.ToLower(name) + ":" + strings.Join(values, ",")
+	}
+	return resource
+}
+
+// azureError returns the error of an unexpected response, closing its body.
+func azureError(resp *http.Response, op, path string) error {
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return &os.PathError{Op: op, Path: path, Err: os.ErrNotExist}
+	}
+	var e struct {
+		Code    string
+		Message string
+	}
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, int64(64*KB)))
+	if xml.Unmarshal(b, &e) == nil && e.Code != "" {
+		return fmt.Errorf("Could not %s %s: (%d) %s: %s", op, path, resp.StatusCode, e.Code, strings.TrimSpace(e.Message))
+	}
+	return fmt.Errorf("Could not %s %s: (%d)", op, path, resp.StatusCode)
+}
+
+// azureMetadata returns the x-ms-meta-* headers of tags, leaving out the tags beyond the limit of
+// metadata. Metadata names have to be C# identifiers, so dashes are saved as underscores.
+func azureMetadata(tags map[string]string) http.Header {
+	h := make(http.Header)
+	for name, value := range limitTags(encodeTags(tags), int(maxAzureMetadata)) {
+		h.Set("X-Ms-Meta-"+strings.Replace(name, "-", "_", -1), value)
+	}
+	return h
+}
+
+func (a *Azure) Save(path string) (io.WriteCloser, error) {
+	return a.SaveTags(path, nil)
+}
+
+// SaveTags saves the tags as metadata of the blob.
+func (a *Azure) SaveTags(path string, tags Tagger) (io.WriteCloser, error) {
+	w := &azureWriter{a: a, path: strings.TrimLeft(path, "/"), hash: md5.New(), blockSize: int(DefaultAzureBlockSize)}
+	if a.BlockSize > 0 {
+		w.blockSize = int(a.BlockSize)
+	}
+	if tags != nil {
+		w.tags = tags.Tags()
+	}
+	return w, nil
+}
+
+// azureWriter buffers a blob, staging a block whenever a whole one is buffered.
+type azureWriter struct {
+	a         *Azure
+	path      string
+	tags      map[string]string
+	blockSize int
+	blocks    []string
+	hash      hash.Hash
+	buf       bytes.Buffer
+	err       error
+}
+
+func (w *azureWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buf.Write(p)
+	w.hash.Write(p)
+	for w.buf.Len() >= w.blockSize {
+		if w.err = w.stage(w.buf.Next(w.blockSize)); w.err != nil {
+			return 0, w.err
+		}
+	}
+	return len(p), nil
+}
+
+// stage uploads a block, to be committed by Close.
+func (w *azureWriter) stage(block []byte) error {
+	// Every block id of a blob has to be of the same length.
+	id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("block-%06d", len(w.blocks))))
+	query := url.Values{"comp": {"block"}, "blockid": {id}}
+	resp, err := w.a.do("PUT", w.a.blobURL(w.path, query), block, http.Header{"Content-Md5": {md5Base64(block)}})
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return azureError(resp, "stage block of", w.path)
+	}
+	resp.Body.Close()
+	w.blocks = append(w.blocks, id)
+	return nil
+}
+
+// Close puts the blob at once if no block was staged, otherwise stages what is left and commits the
+// blocks. Either way the MD5 of the whole blob is saved with it.
+func (w *azureWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	w.err = w.commit()
+	if w.err == nil {
+		w.err = errors.New("Write on closed Azure blob")
+		return nil
+	}
+	return w.err
+}
+
+// Abort gives up the blob. Its staged blocks are never committed, so Azure discards them after a week.
+func (w *azureWriter) Abort() error {
+	w.err = errors.New("Write on aborted Azure blob")
+	return nil
+}
+
+func (w *azureWriter) commit() error {
+	header := azureMetadata(w.tags)
+	var resp *http.Response
+	var err error
+	if len(w.blocks) == 0 {
+		header.Set("X-Ms-Blob-Type", "BlockBlob")
+		header.Set("Content-Md5", md5Base64(w.buf.Bytes()))
+		resp, err = w.a.do("PUT", w.a.blobURL(w.path, nil), w.buf.Bytes(), header)
+	} else {
+		if w.buf.Len() > 0 {
+			if err := w.stage(w.buf.Bytes()); err != nil {
+				return err
+			}
+		}
+		var list bytes.Buffer
+		list.WriteString(xml.Header + "<BlockList>")
+		for _, id := range w.blocks {
+			list.WriteString("<Latest>" + id + "</Latest>")
+		}
+		list.WriteString("</BlockList>")
+		header.Set("X-Ms-Blob-Content-Md5", base64.StdEncoding.EncodeToString(w.hash.Sum(nil)))
+		resp, err = w.a.do("PUT", w.a.blobURL(w.path, url.Values{"comp": {"blocklist"}}), list.Bytes(), header)
+	}
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return azureError(resp, "save", w.path)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func md5Base64(b []byte) string {
+	sum := md5.Sum(b)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Fetch returns the blob, failing at the end if it doesn't match the MD5 saved with it.
+func (a *Azure) Fetch(path string) (io.ReadCloser, error) {
+	resp, err := a.do("GET", a.blobURL(path, nil), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, azureError(resp, "fetch", path)
+	}
+	if sum, err := base64.StdEncoding.DecodeString(resp.Header.Get("Content-Md5")); err == nil && len(sum) == md5.Size {
+		return &verifyingReader{resp.Body, md5.New(), sum, path, "MD5"}, nil
+	}
+	return resp.Body, nil
+}
+
+// azureListResult is the part of a List Blobs response we care about.
+type azureListResult struct {
+	Blobs []struct {
+		Name string
+	} `xml:"Blobs>Blob"`
+	NextMarker string
+}
+
+func (a *Azure) Walk(p string, walkfn WalkFunc) error {
+	p = strings.TrimLeft(p, "/")
+	if p != "" && !strings.HasSuffix(p, "/") {
+		p += "/"
+	}
+	query := url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {p}}
+	for {
+		resp, err := a.do("GET", a.blobURL("", query), nil, nil)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return azureError(resp, "list", p)
+		}
+		var list azureListResult
+		err = xml.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		for _, blob := range list.Blobs {
+			if err := walkfn(blob.Name, nil); err != nil {
+				return err
+			}
+		}
+		if list.NextMarker == "" {
+			return nil
+		}
+		query.Set("marker", list.NextMarker)
+	}
+}
+
+// Stat returns the info of the blob, having its metadata as tags and its access tier as storage class.
+func (a *Azure) Stat(path string) (ObjectInfo, error) {
+	resp, err := a.do("HEAD", a.blobURL(path, nil), nil, nil)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return ObjectInfo{}, azureError(resp, "stat", path)
+	}
+	resp.Body.Close()
+	info := ObjectInfo{
+		Path:         strings.TrimLeft(path, "/"),
+		Size:         resp.ContentLength,
+		ETag:         strings.Trim(resp.Header.Get("ETag"), `"`),
+		StorageClass: resp.Header.Get("X-Ms-Access-Tier"),
+	}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = t
+	}
+	for name, values := range resp.Header {
+		if strings.HasPrefix(name, "X-Ms-Meta-") {
+			if info.Tags == nil {
+				info.Tags = make(map[string]string)
+			}
+			info.Tags[strings.Replace(strings.ToLower(strings.TrimPrefix(name, "X-Ms-Meta-")), "_", "-", -1)] = decodeTag(values[0])
+		}
+	}
+	return info, nil
+}
+
+func (a *Azure) Delete(path string) error {
+	resp, err := a.do("DELETE", a.blobURL(path, nil), nil, nil)
+	if err != nil {
+		return err
+	}
+	if code := resp.StatusCode; code != http.StatusAccepted && code != http.StatusOK {
+		return azureError(resp, "delete", path)
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"bytes"
+	"github.com/duego/mongotool/storage/azuretest"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestAzure(t *testing.T) {
+	Convey("Given an Azure container", t, func() {
+		srv := azuretest.NewServer()
+		defer srv.Close()
+		srv.CreateContainer("dumps")
+		defer setenv(map[string]string{"AZURE_STORAGE_KEY": srv.Key})()
+
+		u, _ := url.Parse("az://dumps/dump?account=" + srv.Account + "&azure-endpoint=" + url.QueryEscape(srv.Endpoint()))
+		s, root, err := openAzure(u)
+		So(err, ShouldBeNil)
+		So(root, ShouldEqual, "dump")
+		store := s.(*Azure)
+		store.BlockSize = 64 * KB
+		store.Retry = RetryPolicy{Attempts: 3, Delay: time.Millisecond}
+
+		save := func(path string, data []byte) error {
+			w, err := SaveTagged(store, path, Tags{"database": "test", "dump-id": "1"})
+			if err != nil {
+				return err
+			}
+			w.Write(data)
+			return w.Close()
+		}
+		fetch := func(path string) ([]byte, error) {
+			r, err := store.Fetch(path)
+			if err != nil {
+				return nil, err
+			}
+			defer r.Close()
+			return ioutil.ReadAll(r)
+		}
+
+		Convey("Large objects should be staged in blocks", func() {
+			large := bytes.Repeat([]byte("mongotool"), 20000)
+			So(save("dump/large", large), ShouldBeNil)
+			So(srv.Blocks("dumps"), ShouldEqual, 0)
+			// 3 blocks and committing them.
+			So(srv.Requests(), ShouldEqual, 4)
+			b, err := fetch("dump/large")
+			So(err, ShouldBeNil)
+			So(bytes.Equal(b, large), ShouldBeTrue)
+			o, _ := srv.Object("dumps", "dump/large")
+			So(o.MD5, ShouldNotBeEmpty)
+		})
+
+		Convey("Small objects should be put at once", func() {
+			So(save("dump/small", []byte("foo")), ShouldBeNil)
+			So(srv.Requests(), ShouldEqual, 1)
+			info, err := store.Stat("dump/small")
+			So(err, ShouldBeNil)
+			So(info.Size, ShouldEqual, 3)
+			So(info.Tags, ShouldResemble, map[string]string{"database": "test", "dump-id": "1"})
+		})
+
+		Convey("Blobs not matching their MD5 should fail to be read", func() {
+			So(save("dump/small", []byte("foo")), ShouldBeNil)
+			o, _ := srv.Object("dumps", "dump/small")
+			o.MD5 = md5Base64([]byte("bar"))
+			_, err := fetch("dump/small")
+			So(err, ShouldHaveSameTypeAs, &ChecksumError{})
+		})
+
+		Convey("Listing should go through every page", func() {
+			srv.PageSize = 2
+			for _, name := range []string{"dump/a", "dump/b", "dump/c", "dumpster/d"} {
+				So(save(name, []byte(name)), ShouldBeNil)
+			}
+			var found []string
+			So(store.Walk("dump", func(p string, err error) error {
+				found = append(found, p)
+				return err
+			}), ShouldBeNil)
+			So(found, ShouldResemble, []string{"dump/a", "dump/b", "dump/c"})
+		})
+
+		Convey("Transient errors should be retried", func() {
+			srv.FailNext(2, http.StatusServiceUnavailable)
+			So(save("dump/small", []byte("foo")), ShouldBeNil)
+		})
+
+		Convey("A SAS token should be used instead of the key", func() {
+			srv.SAS = "sv=2020-10-02&sp=rwdl&sig=secret"
+			store.SAS = srv.SAS
+			store.Key = ""
+			So(save("dump/small", []byte("foo")), ShouldBeNil)
+			b, err := fetch("dump/small")
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "foo")
+		})
+
+		Convey("Requests signed with another key should be refused", func() {
+			store.Key = "b3RoZXIga2V5"
+			So(save("dump/small", []byte("foo")), ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,348 @@
+// Package azuretest implements an in-process stand-in for the Blob service REST API of Azure Storage,
+// addressing accounts in the path the way the Azurite emulator does.
+//
+// It supports Put Blob, Put Block, Put Block List, Get Blob, Get Blob Properties, Delete Blob and
+// List Blobs with pagination. Requests have to be signed with the shared key of the account, or carry
+// the SAS token of the server. Errors can be injected to test retries.
+package azuretest
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Object is a blob saved on the server.
+type Object struct {
+	Data     []byte
+	MD5      string
+	Metadata http.Header
+	ModTime  time.Time
+}
+
+// Server is an Azure storage account listening on a local address, see httptest.Server.
+type Server struct {
+	*httptest.Server
+
+	// Account is the name of the storage account and Key its base64 encoded shared key.
+	Account string
+	Key     string
+	// SAS is a SAS token accepted instead of a shared key signature, unless empty.
+	SAS string
+	// PageSize is how many blobs List Blobs returns at most, 5000 unless set.
+	PageSize int
+
+	mu         sync.Mutex
+	containers map[string]map[string]*Object
+	// blocks holds the uncommitted blocks of every blob by "container/name\x00blockid".
+	blocks   map[string][]byte
+	requests int
+	failures int
+	failCode int
+}
+
+// NewServer starts a server for the account devstoreaccount1 without any containers.
+// Close it when done.
+func NewServer() *Server {
+	s := &Server{
+		Account:    "devstoreaccount1",
+		Key:        base64.StdEncoding.EncodeToString([]byte("azuretest shared key of the account")),
+		PageSize:   5000,
+		containers: make(map[string]map[string]*Object),
+		blocks:     make(map[string][]byte),
+	}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// Endpoint returns the blob service endpoint of the account.
+func (s *Server) Endpoint() string {
+	return s.URL + "/" + s.Account
+}
+
+// CreateContainer creates an empty container unless it already exists.
+func (s *Server) CreateContainer(container string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.containers[container] == nil {
+		s.containers[container] = make(map[string]*Object)
+	}
+}
+
+// PutObject saves a blob, creating the container if needed.
+func (s *Server) PutObject(container, name string, data []byte) {
+	s.CreateContainer(container)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.containers[container][name] = &Object{Data: data, Metadata: make(http.Header), ModTime: time.Now().UTC()}
+}
+
+// Object returns the blob saved under name in container.
+func (s *Server) Object(container, name string) (*Object, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.containers[container][name]
+	return o, ok
+}
+
+// Blocks returns how many blocks are staged for blobs of container, without being committed.
+func (s *Server) Blocks(container string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for key := range s.blocks {
+		if strings.HasPrefix(key, container+"/") {
+			n++
+		}
+	}
+	return n
+}
+
+// Requests returns how many requests the server received.
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// FailNext makes the next n requests fail with the HTTP status code.
+func (s *Server) FailNext(n, code int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures, s.failCode = n, code
+}
+
+// writeError writes an error response the way the Blob service does.
+func writeError(w http.ResponseWriter, code int, azCode, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("X-Ms-Error-Code", azCode)
+	w.WriteHeader(code)
+	fmt.Fprintf(w, "%s<Error><Code>%s</Code><Message>%s</Message></Error>", xml.Header, azCode, message)
+}
+
+// authorized tells if r is signed with the shared key or carries the SAS token.
+func (s *Server) authorized(r *http.Request) bool {
+	if s.SAS != "" && r.URL.Query().Get("sig") != "" {
+		sas, _ := url.ParseQuery(s.SAS)
+		q := r.URL.Query()
+		for name := range sas {
+			if q.Get(name) != sas.Get(name) {
+				return false
+			}
+		}
+		return true
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "SharedKey "+s.Account+":") || r.Header.Get("X-Ms-Date") == "" {
+		return false
+	}
+	length := ""
+	if r.ContentLength > 0 {
+		length = strconv.FormatInt(r.ContentLength, 10)
+	}
+	h := r.Header
+	toSign := strings.Join([]string{
+		r.Method, h.Get("Content-Encoding"), h.Get("Content-Language"), length, h.Get("Content-Md5"),
+		h.Get("Content-Type"), h.Get("Date"), h.Get("If-Modified-Since"), h.Get("If-Match"),
+		h.Get("If-None-Match"), h.Get("If-Unmodified-Since"), h.Get("Range"),
+	}, "\n") + "\n"
+	var names []string
+	for name := range h {
+		if name = strings.ToLower(name); strings.HasPrefix(name, "x-ms-") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		toSign += name + ":" + strings.TrimSpace(h.Get(name)) + "\n"
+	}
+	toSign += "/" + s.Account + r.URL.EscapedPath()
+	q := r.URL.Query()
+	var params []string
+	for name := range q {
+		params = append(params, name)
+	}
+	sort.Strings(params)
+	for _, name := range params {
+		values := q[name]
+		sort.Strings(values)
+		toSign += "\n" + strings.ToLower(name) + ":" + strings.Join(values, ",")
+	}
+	key, _ := base64.StdEncoding.DecodeString(s.Key)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(toSign))
+	return auth == "SharedKey "+s.Account+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	if s.failures > 0 {
+		s.failures--
+		writeError(w, s.failCode, "InjectedError", "Injected by azuretest")
+		return
+	}
+	if !s.authorized(r) {
+		writeError(w, http.StatusForbidden, "AuthenticationFailed", "Server failed to authenticate the request.")
+		return
+	}
+	if md5sum := r.Header.Get("Content-Md5"); md5sum != "" {
+		sum := md5.Sum(body)
+		if md5sum != base64.StdEncoding.EncodeToString(sum[:]) {
+			writeError(w, http.StatusBadRequest, "Md5Mismatch", "The MD5 value specified in the request did not match the MD5 value calculated by the server.")
+			return
+		}
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 3)
+	if len(parts) < 2 || parts[0] != s.Account {
+		writeError(w, http.StatusBadRequest, "InvalidUri", "The requested URI does not represent any resource on the server.")
+		return
+	}
+	container, name := parts[1], ""
+	if len(parts) == 3 {
+		name = parts[2]
+	}
+	blobs, ok := s.containers[container]
+	if !ok {
+		writeError(w, http.StatusNotFound, "ContainerNotFound", "The specified container does not exist.")
+		return
+	}
+	q := r.URL.Query()
+	key := container + "/" + name
+	switch {
+	case name == "" && r.Method == "GET" && q.Get("restype") == "container" && q.Get("comp") == "list":
+		s.list(w, blobs, q)
+	case name == "":
+		writeError(w, http.StatusBadRequest, "UnsupportedHttpVerb", "The resource doesn't support the specified HTTP verb.")
+	case r.Method == "PUT" && q.Get("comp") == "block":
+		id, err := base64.StdEncoding.DecodeString(q.Get("blockid"))
+		if err != nil || len(id) == 0 || len(id) > 64 {
+			writeError(w, http.StatusBadRequest, "InvalidQueryParameterValue", "Value for one of the query parameters specified in the request URI is invalid.")
+			return
+		}
+		for staged := range s.blocks {
+			if strings.HasPrefix(staged, key+"\x00") && len(staged) != len(key)+1+len(q.Get("blockid")) {
+				writeError(w, http.StatusBadRequest, "InvalidBlobOrBlock", "The specified blob or block content is invalid.")
+				return
+			}
+		}
+		s.blocks[key+"\x00"+q.Get("blockid")] = body
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "PUT" && q.Get("comp") == "blocklist":
+		var list struct {
+			Latest []string
+		}
+		if err := xml.Unmarshal(body, &list); err != nil {
+			writeError(w, http.StatusBadRequest, "InvalidXmlDocument", "XML specified is not syntactically valid.")
+			return
+		}
+		var data bytes.Buffer
+		for _, id := range list.Latest {
+			block, ok := s.blocks[key+"\x00"+id]
+			if !ok {
+				writeError(w, http.StatusBadRequest, "InvalidBlockList", "The specified block list is invalid.")
+				return
+			}
+			data.Write(block)
+		}
+		for staged := range s.blocks {
+			if strings.HasPrefix(staged, key+"\x00") {
+				delete(s.blocks, staged)
+			}
+		}
+		s.put(w, r, blobs, name, data.Bytes(), r.Header.Get("X-Ms-Blob-Content-Md5"))
+	case r.Method == "PUT":
+		if r.Header.Get("X-Ms-Blob-Type") != "BlockBlob" {
+			writeError(w, http.StatusBadRequest, "MissingRequiredHeader", "An HTTP header that's mandatory for this request is not specified.")
+			return
+		}
+		s.put(w, r, blobs, name, body, r.Header.Get("Content-Md5"))
+	case r.Method == "GET" || r.Method == "HEAD":
+		o, ok := blobs[name]
+		if !ok {
+			writeError(w, http.StatusNotFound, "BlobNotFound", "The specified blob does not exist.")
+			return
+		}
+		for name, values := range o.Metadata {
+			w.Header()[name] = values
+		}
+		if o.MD5 != "" {
+			w.Header().Set("Content-Md5", o.MD5)
+		}
+		sum := md5.Sum(o.Data)
+		w.Header().Set("ETag", fmt.Sprintf(`"0x%X"`, sum[:8]))
+		w.Header().Set("Last-Modified", o.ModTime.Format(http.TimeFormat))
+		w.Header().Set("X-Ms-Blob-Type", "BlockBlob")
+		w.Header().Set("X-Ms-Access-Tier", "Hot")
+		w.Header().Set("Content-Length", strconv.Itoa(len(o.Data)))
+		if r.Method == "GET" {
+			w.Write(o.Data)
+		}
+	case r.Method == "DELETE":
+		if _, ok := blobs[name]; !ok {
+			writeError(w, http.StatusNotFound, "BlobNotFound", "The specified blob does not exist.")
+			return
+		}
+		delete(blobs, name)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		writeError(w, http.StatusBadRequest, "UnsupportedHttpVerb", "The resource doesn't support the specified HTTP verb.")
+	}
+}
+
+// put saves a blob with the metadata of r.
+func (s *Server) put(w http.ResponseWriter, r *http.Request, blobs map[string]*Object, name string, data []byte, md5sum string) {
+	o := &Object{Data: data, MD5: md5sum, Metadata: make(http.Header), ModTime: time.Now().UTC()}
+	for header, values := range r.Header {
+		if strings.HasPrefix(header, "X-Ms-Meta-") {
+			o.Metadata[header] = values
+		}
+	}
+	blobs[name] = o
+	w.WriteHeader(http.StatusCreated)
+}
+
+// list writes one page of List Blobs for the blobs whose names start with the prefix.
+func (s *Server) list(w http.ResponseWriter, blobs map[string]*Object, q url.Values) {
+	var names []string
+	for name := range blobs {
+		if strings.HasPrefix(name, q.Get("prefix")) && name > q.Get("marker") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	size := s.PageSize
+	if v, err := strconv.Atoi(q.Get("maxresults")); err == nil && v > 0 && v < size {
+		size = v
+	}
+	next := ""
+	if len(names) > size {
+		names = names[:size]
+		next = names[size-1]
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprintf(w, "%s<EnumerationResults><Blobs>", xml.Header)
+	for _, name := range names {
+		var escaped bytes.Buffer
+		xml.EscapeText(&escaped, []byte(name))
+		fmt.Fprintf(w, "<Blob><Name>%s</Name><Properties><Content-Length>%d</Content-Length></Properties></Blob>",
+			escaped.String(), len(blobs[name].Data))
+	}
+	fmt.Fprintf(w, "</Blobs><NextMarker>%s</NextMarker></EnumerationResults>", next)
+}
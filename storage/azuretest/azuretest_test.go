@@ -0,0 +1,54 @@
+package azuretest
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	Convey("Given a server with a blob", t, func() {
+		srv := NewServer()
+		defer srv.Close()
+		srv.PutObject("dumps", "dump/a", []byte("foo"))
+
+		get := func(path string) (*http.Response, string) {
+			resp, err := http.Get(srv.Endpoint() + path)
+			So(err, ShouldBeNil)
+			defer resp.Body.Close()
+			b, _ := ioutil.ReadAll(resp.Body)
+			return resp, string(b)
+		}
+
+		Convey("Unsigned requests should be refused", func() {
+			resp, body := get("/dumps/dump/a")
+			So(resp.StatusCode, ShouldEqual, http.StatusForbidden)
+			So(body, ShouldContainSubstring, "AuthenticationFailed")
+		})
+
+		Convey("Given a SAS token", func() {
+			srv.SAS = "sv=2020-10-02&sp=rl&sig=secret"
+
+			Convey("Requests with the token should be served", func() {
+				resp, body := get("/dumps/dump/a?" + srv.SAS)
+				So(resp.StatusCode, ShouldEqual, http.StatusOK)
+				So(body, ShouldEqual, "foo")
+			})
+			Convey("Requests with another signature should be refused", func() {
+				resp, _ := get("/dumps/dump/a?sv=2020-10-02&sp=rl&sig=guess")
+				So(resp.StatusCode, ShouldEqual, http.StatusForbidden)
+			})
+			Convey("Missing blobs should give Azure errors", func() {
+				resp, body := get("/dumps/dump/b?" + srv.SAS)
+				So(resp.StatusCode, ShouldEqual, http.StatusNotFound)
+				So(body, ShouldContainSubstring, "BlobNotFound")
+			})
+			Convey("Injected errors should be returned", func() {
+				srv.FailNext(1, http.StatusServiceUnavailable)
+				resp, _ := get("/dumps/dump/a?" + srv.SAS)
+				So(resp.StatusCode, ShouldEqual, http.StatusServiceUnavailable)
+			})
+		})
+	})
+}
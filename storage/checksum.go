@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// checksumSuffix is added to the path of an object to get the path of its SHA-256 checksum.
+const checksumSuffix = ".sha256"
+
+// ChecksumError is returned reading an object which doesn't match its checksum, such as a corrupted
+// or truncated object.
+type ChecksumError struct {
+	Path      string
+	Expected  string
+	Got       string
+	Algorithm string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("%s checksum mismatch of %s, expected %s, got %s", e.Algorithm, e.Path, e.Expected, e.Got)
+}
+
+// verifyingReader compares the hash of everything read with the expected sum once the end is reached.
+// Readers stopping before the end, such as the tar reader, have to read the rest for it to be verified.
+type verifyingReader struct {
+	io.ReadCloser
+	hash      hash.Hash
+	sum       []byte
+	path      string
+	algorithm string
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.ReadCloser.Read(p)
+	v.hash.Write(p[:n])
+	if err == io.EOF {
+		if got := v.hash.Sum(nil); !bytes.Equal(got, v.sum) {
+			return n, &ChecksumError{v.path, hex.EncodeToString(v.sum), hex.EncodeToString(got), v.algorithm}
+		}
+	}
+	return n, err
+}
+
+// checksumWriter hashes everything written, saving the sum next to the object once closed.
+type checksumWriter struct {
+	io.WriteCloser
+	hash hash.Hash
+	s    Saver
+	path string
+}
+
+func (c *checksumWriter) Write(p []byte) (int, error) {
+	n, err := c.WriteCloser.Write(p)
+	c.hash.Write(p[:n])
+	return n, err
+}
+
+func (c *checksumWriter) Close() error {
+	if err := c.WriteCloser.Close(); err != nil {
+		return err
+	}
+	w, err := c.s.Save(c.path + checksumSuffix)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, hex.EncodeToString(c.hash.Sum(nil))+"\n"); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// ChecksumSaveFetcher wraps another SaveFetcher to save the SHA-256 checksum of every object next to it,
+// as "<path>.sha256", which is verified when the object is read to the end.
+// Objects saved without a checksum are fetched as is, and checksums are left out when walking.
+type ChecksumSaveFetcher struct {
+	s SaveFetcher
+}
+
+func NewChecksumSaveFetcher(s SaveFetcher) SaveFetcher {
+	return &ChecksumSaveFetcher{s}
+}
+
+func (c *ChecksumSaveFetcher) Save(path string) (io.WriteCloser, error) {
+	return c.SaveTags(path, nil)
+}
+
+// SaveTags saves tags with the object if the wrapped storage can, the checksum is saved without them.
+func (c *ChecksumSaveFetcher) SaveTags(path string, tags Tagger) (io.WriteCloser, error) {
+	w, err := SaveTagged(c.s, path, tags)
+	if err != nil {
+		return nil, err
+	}
+	return &checksumWriter{w, sha256.New(), c.s, path}, nil
+}
+
+// Fetch returns an object failing with a ChecksumError at the end, if it doesn't match its checksum.
+func (c *ChecksumSaveFetcher) Fetch(path string) (io.ReadCloser, error) {
+	sum, err := c.checksum(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	r, err := c.s.Fetch(path)
+	if err != nil || sum == nil {
+		return r, err
+	}
+	return &verifyingReader{r, sha256.New(), sum, path, "SHA-256"}, nil
+}
+
+// checksum reads the checksum saved for the object on path.
+func (c *ChecksumSaveFetcher) checksum(path string) ([]byte, error) {
+	r, err := c.s.Fetch(path + checksumSuffix)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(r, 1024))
+	if err != nil {
+		return nil, err
+	}
+	sum, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(sum) != sha256.Size {
+		return nil, fmt.Errorf("Invalid checksum of %s", path)
+	}
+	return sum, nil
+}
+
+func (c *ChecksumSaveFetcher) Walk(path string, walkfn WalkFunc) error {
+	return Walk(c.s, path, func(fpath string, err error) error {
+		if err == nil && strings.HasSuffix(fpath, checksumSuffix) {
+			return nil
+		}
+		return walkfn(fpath, err)
+	})
+}
+
+// Stat tells an object is archived when its checksum is, as both have to be restored to fetch it.
+func (c *ChecksumSaveFetcher) Stat(path string) (ObjectInfo, error) {
+	info, err := Stat(c.s, path)
+	if err != nil || info.Archived {
+		return info, err
+	}
+	sum, err := Stat(c.s, path+checksumSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		return info, err
+	}
+	info.Archived = sum.Archived
+	return info, nil
+}
+
+func (c *ChecksumSaveFetcher) Delete(path string) error {
+	if err := Delete(c.s, path); err != nil {
+		return err
+	}
+	if err := Delete(c.s, path+checksumSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Restore restores both the object and its checksum.
+func (c *ChecksumSaveFetcher) Restore(path string, days int, tier string) error {
+	if err := Restore(c.s, path, days, tier); err != nil {
+		return err
+	}
+	info, err := Stat(c.s, path+checksumSuffix)
+	if os.IsNotExist(err) || err == nil && !info.Archived {
+		return nil
+	}
+	return Restore(c.s, path+checksumSuffix, days, tier)
+}
+
+func (c *ChecksumSaveFetcher) Close() error {
+	return Close(c.s)
+}
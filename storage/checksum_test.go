@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"github.com/duego/mongotool/storage/s3test"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestChecksum(t *testing.T) {
+	Convey("Given objects saved with checksums", t, func() {
+		mem := NewMemory()
+		store := NewChecksumSaveFetcher(mem)
+		save := func(s Saver, path, data string) {
+			w, err := s.Save(path)
+			So(err, ShouldBeNil)
+			io.WriteString(w, data)
+			So(w.Close(), ShouldBeNil)
+		}
+		fetch := func(path string) (string, error) {
+			r, err := store.Fetch(path)
+			if err != nil {
+				return "", err
+			}
+			defer r.Close()
+			b, err := ioutil.ReadAll(r)
+			return string(b), err
+		}
+		save(store, "dump/chunk", "Foo bar")
+
+		Convey("The checksum should be saved next to the object", func() {
+			_, err := mem.Stat("dump/chunk.sha256")
+			So(err, ShouldBeNil)
+			data, err := fetch("dump/chunk")
+			So(err, ShouldBeNil)
+			So(data, ShouldEqual, "Foo bar")
+		})
+
+		Convey("Corrupted or truncated objects should fail to be read", func() {
+			for _, data := range []string{"Foo baz", "Foo"} {
+				save(mem, "dump/chunk", data)
+				_, err := fetch("dump/chunk")
+				So(err, ShouldHaveSameTypeAs, &ChecksumError{})
+				So(err.Error(), ShouldContainSubstring, "dump/chunk")
+			}
+		})
+
+		Convey("Corrupted objects should fail to be read through the tar reader once read to the end", func() {
+			store := NewChecksumSaveFetcher(NewCompressSaveFetcher(mem, Gzip, DefaultLevel))
+			w, err := store.Save("dump/chunk.tar")
+			So(err, ShouldBeNil)
+			tw := tar.NewWriter(w)
+			So(tw.WriteHeader(&tar.Header{Name: "db/col/object", Mode: 0644, Size: 3, Typeflag: tar.TypeReg}), ShouldBeNil)
+			_, err = tw.Write([]byte("foo"))
+			So(err, ShouldBeNil)
+			So(tw.Close(), ShouldBeNil)
+			So(w.Close(), ShouldBeNil)
+			save(mem, "dump/chunk.tar.sha256", strings.Repeat("0", 64)+"\n")
+
+			r, err := store.Fetch("dump/chunk.tar")
+			So(err, ShouldBeNil)
+			defer r.Close()
+			tr := tar.NewReader(r)
+			_, err = tr.Next()
+			So(err, ShouldBeNil)
+			_, err = tr.Next()
+			So(err, ShouldEqual, io.EOF)
+			_, err = io.Copy(ioutil.Discard, r)
+			So(err, ShouldHaveSameTypeAs, &ChecksumError{})
+		})
+
+		Convey("Objects without a checksum should be read as is", func() {
+			save(mem, "dump/old", "Foo")
+			data, err := fetch("dump/old")
+			So(err, ShouldBeNil)
+			So(data, ShouldEqual, "Foo")
+		})
+
+		Convey("Checksums should be left out when walking and deleted with their object", func() {
+			var found []string
+			Walk(store, "dump", func(p string, err error) error {
+				found = append(found, p)
+				return err
+			})
+			So(found, ShouldResemble, []string{"dump/chunk"})
+			So(Delete(store, "dump/chunk"), ShouldBeNil)
+			_, err := mem.Stat("dump/chunk.sha256")
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given a S3 bucket", t, func() {
+		srv := s3test.NewServer()
+		defer srv.Close()
+		defer setFakeAwsKeys()()
+		store := NewS3(srv.BucketURL("mongotool"))
+		store.PartSize = MinPartSize
+
+		Convey("Every upload should be sent with its MD5", func() {
+			for _, data := range [][]byte{[]byte("Foo"), bytes.Repeat([]byte("mongotool"), int(MinPartSize)/4)} {
+				w, err := store.Save("object")
+				So(err, ShouldBeNil)
+				w.Write(data)
+				So(w.Close(), ShouldBeNil)
+			}
+			for _, r := range srv.Requests() {
+				if r.Method == "PUT" {
+					So(r.Header.Get("Content-Md5"), ShouldNotBeEmpty)
+				}
+			}
+		})
+	})
+
+	Convey("Fetched S3 objects should be compared with their ETag", t, func() {
+		sum := md5.Sum([]byte("Foo"))
+		response := func(etag, data string) *http.Response {
+			resp := &http.Response{Header: make(http.Header), Body: ioutil.NopCloser(bytes.NewBufferString(data))}
+			resp.Header.Set("ETag", `"`+etag+`"`)
+			return resp
+		}
+		read := func(resp *http.Response) error {
+			r, err := verifyETag(resp, "object")
+			So(err, ShouldBeNil)
+			_, err = ioutil.ReadAll(r)
+			return err
+		}
+		So(read(response(hex.EncodeToString(sum[:]), "Foo")), ShouldBeNil)
+		So(read(response(hex.EncodeToString(sum[:]), "Fo")), ShouldHaveSameTypeAs, &ChecksumError{})
+		So(read(response(hex.EncodeToString(sum[:])+"-2", "Bar")), ShouldBeNil)
+
+		resp := response(hex.EncodeToString(sum[:]), "Bar")
+		resp.Header.Set("X-Amz-Server-Side-Encryption", SSEKMS)
+		So(read(resp), ShouldBeNil)
+	})
+}
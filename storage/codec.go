@@ -0,0 +1,247 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultLevel lets a codec pick its own default compression level.
+const DefaultLevel = -1
+
+// Codec is a compression format that saved objects can be compressed with.
+type Codec interface {
+	// Name is what the codec is selected by, such as "gzip".
+	Name() string
+	// Ext is the file extension of compressed objects, such as ".gz".
+	Ext() string
+	// Magic is the bytes every compressed stream begins with, used to detect the codec on fetch.
+	Magic() []byte
+	// NewWriter compresses everything written to w with the given level, or DefaultLevel.
+	NewWriter(w io.Writer, level int) (io.WriteCloser, error)
+	// NewReader decompresses r, including streams of several compressed objects concatenated.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// ParallelCodec is a Codec that can compress using several goroutines.
+type ParallelCodec interface {
+	Codec
+	// Parallel returns the same codec compressing on procs goroutines.
+	Parallel(procs int) Codec
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = make(map[string]Codec)
+)
+
+// RegisterCodec makes the codec available by its name. Registering the same name twice panics.
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	if _, dup := codecs[c.Name()]; dup {
+		panic("storage: RegisterCodec called twice for " + c.Name())
+	}
+	codecs[c.Name()] = c
+}
+
+// LookupCodec returns the codec registered with name.
+func LookupCodec(name string) (Codec, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[name]
+	return c, ok
+}
+
+// Codecs returns the names of all registered codecs, sorted.
+func Codecs() []string {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseCodec parses a codec in the form "name" or "name:level", such as "zstd:19".
+// "none" or "false" gives no codec at all, and "true" gives gzip, to stay compatible with the
+// -compression flag once being a boolean.
+func ParseCodec(s string) (c Codec, level int, err error) {
+	level = DefaultLevel
+	name := s
+	if i := strings.Index(s, ":"); i >= 0 {
+		name = s[:i]
+		if level, err = strconv.Atoi(s[i+1:]); err != nil || level < 0 {
+			return nil, DefaultLevel, fmt.Errorf("Invalid compression level in %q", s)
+		}
+	}
+	switch name {
+	case "", "none", "false":
+		return nil, DefaultLevel, nil
+	case "true":
+		name = "gzip"
+	}
+	c, ok := LookupCodec(name)
+	if !ok {
+		return nil, DefaultLevel, fmt.Errorf("Unknown compression %q, expected one of: %s", name, strings.Join(Codecs(), ", "))
+	}
+	return c, level, nil
+}
+
+// detectCodec returns the registered codec whose magic bytes b begins with, or nil if there is none.
+func detectCodec(b []byte) Codec {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	for _, c := range codecs {
+		if bytes.HasPrefix(b, c.Magic()) {
+			return c
+		}
+	}
+	return nil
+}
+
+// maxMagicLen is how many bytes are needed to detect any of the codecs.
+const maxMagicLen = 6
+
+func init() {
+	RegisterCodec(Gzip)
+	RegisterCodec(Zstd)
+	RegisterCodec(LZ4)
+	RegisterCodec(XZ)
+}
+
+var (
+	Gzip Codec = gzipCodec{}
+	Zstd Codec = zstdCodec{}
+	LZ4  Codec = lz4Codec{}
+	XZ   Codec = xzCodec{}
+)
+
+// gzipCodec compresses blocks of data as separate gzip members in parallel when procs is above one.
+type gzipCodec struct {
+	procs int
+}
+
+func (gzipCodec) Name() string  { return "gzip" }
+func (gzipCodec) Ext() string   { return ".gz" }
+func (gzipCodec) Magic() []byte { return []byte{0x1f, 0x8b} }
+
+func (g gzipCodec) Parallel(procs int) Codec {
+	g.procs = procs
+	return g
+}
+
+func (g gzipCodec) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	if g.procs > 1 {
+		return newParallelGzipWriter(w, level, g.procs)
+	}
+	return gzip.NewWriterLevel(w, level)
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// zstdCodec lets the encoder use as many goroutines as GOMAXPROCS unless procs is set.
+type zstdCodec struct {
+	procs int
+}
+
+func (zstdCodec) Name() string  { return "zstd" }
+func (zstdCodec) Ext() string   { return ".zst" }
+func (zstdCodec) Magic() []byte { return []byte{0x28, 0xb5, 0x2f, 0xfd} }
+
+func (z zstdCodec) Parallel(procs int) Codec {
+	z.procs = procs
+	return z
+}
+
+// NewWriter takes the levels of the zstd command line tool, 1 to 22, which are mapped to the closest
+// level the encoder supports.
+func (z zstdCodec) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	var opts []zstd.EOption
+	if level != DefaultLevel {
+		opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	}
+	if z.procs > 0 {
+		opts = append(opts, zstd.WithEncoderConcurrency(z.procs))
+	}
+	return zstd.NewWriter(w, opts...)
+}
+
+func (zstdCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	d, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return d.IOReadCloser(), nil
+}
+
+type lz4Codec struct{}
+
+func (lz4Codec) Name() string  { return "lz4" }
+func (lz4Codec) Ext() string   { return ".lz4" }
+func (lz4Codec) Magic() []byte { return []byte{0x04, 0x22, 0x4d, 0x18} }
+
+var lz4Levels = []lz4.CompressionLevel{
+	lz4.Fast, lz4.Level1, lz4.Level2, lz4.Level3, lz4.Level4,
+	lz4.Level5, lz4.Level6, lz4.Level7, lz4.Level8, lz4.Level9,
+}
+
+// NewWriter takes levels from 0 (fast) to 9.
+func (lz4Codec) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	zw := lz4.NewWriter(w)
+	if level == DefaultLevel {
+		return zw, nil
+	}
+	if level >= len(lz4Levels) {
+		return nil, fmt.Errorf("lz4 compression level must be 0 to %d", len(lz4Levels)-1)
+	}
+	if err := zw.Apply(lz4.CompressionLevelOption(lz4Levels[level])); err != nil {
+		return nil, err
+	}
+	return zw, nil
+}
+
+func (lz4Codec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(lz4.NewReader(r)), nil
+}
+
+type xzCodec struct{}
+
+func (xzCodec) Name() string  { return "xz" }
+func (xzCodec) Ext() string   { return ".xz" }
+func (xzCodec) Magic() []byte { return []byte{0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00} }
+
+// xzDictCaps are the dictionary sizes of the presets 0 to 9 of the xz command line tool.
+var xzDictCaps = []int{256 << 10, 1 << 20, 2 << 20, 4 << 20, 4 << 20, 8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20}
+
+// NewWriter takes the presets 0 to 9 of the xz command line tool, picking the dictionary size.
+func (xzCodec) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	if level == DefaultLevel {
+		return xz.NewWriter(w)
+	}
+	if level >= len(xzDictCaps) {
+		return nil, fmt.Errorf("xz compression level must be 0 to %d", len(xzDictCaps)-1)
+	}
+	return xz.WriterConfig{DictCap: xzDictCaps[level]}.NewWriter(w)
+}
+
+func (xzCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	xr, err := xz.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(xr), nil
+}
@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"bytes"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// memObjects is a SaveFetcher keeping objects in a map.
+type memObjects map[string]*bytes.Buffer
+
+func (m memObjects) Save(path string) (io.WriteCloser, error) {
+	b := new(bytes.Buffer)
+	m[path] = b
+	return fooStorage{b}, nil
+}
+
+func (m memObjects) Fetch(path string) (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(m[path].Bytes())), nil
+}
+
+func TestCodecs(t *testing.T) {
+	data := strings.Repeat("mongotool compresses bson ", 1000)
+
+	Convey("Every codec should round trip data saved with it", t, func() {
+		objects := make(memObjects)
+		for _, name := range Codecs() {
+			for _, level := range []int{DefaultLevel, 1} {
+				codec, _ := LookupCodec(name)
+				store := NewCompressSaveFetcher(objects, codec, level)
+				w, err := store.Save(name)
+				So(err, ShouldBeNil)
+				_, err = io.WriteString(w, data)
+				So(err, ShouldBeNil)
+				So(w.Close(), ShouldBeNil)
+				So(objects[name].Len(), ShouldBeLessThan, len(data))
+				So(objects[name].String(), ShouldStartWith, string(codec.Magic()))
+
+				// The codec should be detected when fetched without knowing it.
+				r, err := NewCompressSaveFetcher(objects, nil, DefaultLevel).Fetch(name)
+				So(err, ShouldBeNil)
+				b, err := ioutil.ReadAll(r)
+				So(err, ShouldBeNil)
+				So(string(b), ShouldEqual, data)
+				So(r.Close(), ShouldBeNil)
+			}
+		}
+	})
+
+	Convey("Concatenated objects should be read as one stream", t, func() {
+		for _, name := range Codecs() {
+			codec, _ := LookupCodec(name)
+			var stream bytes.Buffer
+			for _, part := range []string{"foo", "bar"} {
+				w, err := codec.NewWriter(&stream, DefaultLevel)
+				So(err, ShouldBeNil)
+				io.WriteString(w, part)
+				So(w.Close(), ShouldBeNil)
+			}
+			r, err := codec.NewReader(&stream)
+			So(err, ShouldBeNil)
+			b, err := ioutil.ReadAll(r)
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "foobar")
+		}
+	})
+
+	Convey("Uncompressed data should be fetched as is", t, func() {
+		objects := make(memObjects)
+		store := NewCompressSaveFetcher(objects, nil, DefaultLevel)
+		for _, content := range []string{"Foo", "", strings.Repeat("a", 100)} {
+			w, err := store.Save("raw")
+			So(err, ShouldBeNil)
+			io.WriteString(w, content)
+			So(w.Close(), ShouldBeNil)
+			So(objects["raw"].String(), ShouldEqual, content)
+
+			r, err := NewGzipSaveFetcher(objects).Fetch("raw")
+			So(err, ShouldBeNil)
+			b, err := ioutil.ReadAll(r)
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, content)
+		}
+	})
+
+	Convey("Parsing codecs", t, func() {
+		c, level, err := ParseCodec("zstd:19")
+		So(err, ShouldBeNil)
+		So(c, ShouldEqual, Zstd)
+		So(level, ShouldEqual, 19)
+
+		c, level, err = ParseCodec("xz")
+		So(err, ShouldBeNil)
+		So(c, ShouldEqual, XZ)
+		So(level, ShouldEqual, DefaultLevel)
+
+		c, _, err = ParseCodec("true")
+		So(err, ShouldBeNil)
+		So(c, ShouldEqual, Gzip)
+
+		c, _, err = ParseCodec("none")
+		So(err, ShouldBeNil)
+		So(c, ShouldBeNil)
+
+		c, _, err = ParseCodec("false")
+		So(err, ShouldBeNil)
+		So(c, ShouldBeNil)
+
+		_, _, err = ParseCodec("zstd:fast")
+		So(err, ShouldNotBeNil)
+		_, _, err = ParseCodec("rar")
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -1,70 +1,128 @@
 package storage
 
 import (
-	"compress/gzip"
+	"bufio"
 	"io"
+	"io/ioutil"
 )
 
-// gzipReadCloser pairs an original ReadCloser with a gzip Reader.
-type gzipReadCloser struct {
-	*gzip.Reader
+// compressReadCloser pairs an original ReadCloser with a decompressing ReadCloser.
+type compressReadCloser struct {
+	io.ReadCloser
 	original io.ReadCloser
 }
 
-// Close will make sure the original ReadCloser gets closed when gzip reader is, passing any errors.
-func (g *gzipReadCloser) Close() error {
-	if err := g.Reader.Close(); err != nil {
-		g.original.Close()
+// Close will make sure the original ReadCloser gets closed when the decompressor is, passing any errors.
+func (c *compressReadCloser) Close() error {
+	if err := c.ReadCloser.Close(); err != nil {
+		c.original.Close()
 		return err
 	}
-	return g.original.Close()
+	return c.original.Close()
 }
 
-// gzipWriteCloser pairs an original WriteCloser with a gzip Writer.
-type gzipWriteCloser struct {
-	*gzip.Writer
+// compressWriteCloser pairs an original WriteCloser with a compressing WriteCloser.
+type compressWriteCloser struct {
+	io.WriteCloser
 	original io.WriteCloser
 }
 
-// Close will make sure the original WriteCloser gets closed when gzip writer is, passing any errors.
-func (g *gzipWriteCloser) Close() error {
-	if err := g.Writer.Close(); err != nil {
-		g.original.Close()
+// Close will make sure the original WriteCloser gets closed when the compressor is, passing any errors.
+func (c *compressWriteCloser) Close() error {
+	if err := c.WriteCloser.Close(); err != nil {
+		c.original.Close()
 		return err
 	}
-	return g.original.Close()
+	return c.original.Close()
 }
 
-// GzipSaveFetcher wraps another SaveFetcher to compress/decompress data saved/fetched on it.
-type GzipSaveFetcher struct {
-	s SaveFetcher
+// Abort stops the compressor, if it can be, and gives up saving to the original WriteCloser.
+func (c *compressWriteCloser) Abort() error {
+	Abort(c.WriteCloser)
+	return Abort(c.original)
+}
+
+// CompressSaveFetcher wraps another SaveFetcher to compress/decompress data saved/fetched on it.
+// Data is saved using the codec it was created with, while fetched data is decompressed with
+// whatever codec is detected from its magic bytes. Data not recognized is fetched as is.
+type CompressSaveFetcher struct {
+	s     SaveFetcher
+	codec Codec
+	level int
+}
+
+// NewCompressSaveFetcher saves with codec at level. A nil codec saves data uncompressed, while still
+// detecting compressed data on fetch.
+func NewCompressSaveFetcher(s SaveFetcher, codec Codec, level int) SaveFetcher {
+	return &CompressSaveFetcher{s, codec, level}
 }
 
 func NewGzipSaveFetcher(s SaveFetcher) SaveFetcher {
-	return &GzipSaveFetcher{s}
+	return NewCompressSaveFetcher(s, Gzip, DefaultLevel)
+}
+
+func (c *CompressSaveFetcher) Save(path string) (io.WriteCloser, error) {
+	return c.SaveTags(path, nil)
 }
 
-func (c *GzipSaveFetcher) Save(path string) (io.WriteCloser, error) {
-	w, err := c.s.Save(path)
+// SaveTags saves tags with the object if the wrapped storage can.
+func (c *CompressSaveFetcher) SaveTags(path string, tags Tagger) (io.WriteCloser, error) {
+	w, err := SaveTagged(c.s, path, tags)
 	if err != nil {
 		return nil, err
 	}
-	return &gzipWriteCloser{gzip.NewWriter(w), w}, nil
+	if c.codec == nil {
+		return w, nil
+	}
+	cw, err := c.codec.NewWriter(w, c.level)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	return &compressWriteCloser{cw, w}, nil
 }
 
-func (c *GzipSaveFetcher) Fetch(path string) (io.ReadCloser, error) {
+func (c *CompressSaveFetcher) Fetch(path string) (io.ReadCloser, error) {
 	r, err := c.s.Fetch(path)
 	if err != nil {
 		return nil, err
 	}
-	gr, err := gzip.NewReader(r)
+	br := bufio.NewReader(r)
+	// A short object can't be compressed, so only real errors matter here.
+	magic, err := br.Peek(maxMagicLen)
+	if err != nil && err != io.EOF {
+		r.Close()
+		return nil, err
+	}
+	codec := detectCodec(magic)
+	if codec == nil {
+		return &compressReadCloser{ioutil.NopCloser(br), r}, nil
+	}
+	cr, err := codec.NewReader(br)
 	if err != nil {
+		r.Close()
 		return nil, err
 	}
-	return &gzipReadCloser{gr, r}, nil
+	return &compressReadCloser{cr, r}, nil
+}
+
+func (c *CompressSaveFetcher) Walk(path string, walkfn WalkFunc) error {
+	return Walk(c.s, path, walkfn)
+}
+
+// Stat returns the info of the object as stored, the size being the compressed one.
+func (c *CompressSaveFetcher) Stat(path string) (ObjectInfo, error) {
+	return Stat(c.s, path)
+}
+
+func (c *CompressSaveFetcher) Delete(path string) error {
+	return Delete(c.s, path)
+}
+
+func (c *CompressSaveFetcher) Restore(path string, days int, tier string) error {
+	return Restore(c.s, path, days, tier)
 }
 
-func (c *GzipSaveFetcher) Walk(path string, walkfn WalkFunc) error {
-	w := c.s.(Walker)
-	return w.Walk(path, walkfn)
+func (c *CompressSaveFetcher) Close() error {
+	return Close(c.s)
 }
@@ -1,5 +1,12 @@
 package storage
 
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
 type ByteSize int64
 
 const (
@@ -8,3 +15,49 @@ const (
 	MB
 	GB
 )
+
+const (
+	// MinPartSize is the smallest part S3 accepts in a multipart upload, except for the last part.
+	MinPartSize = 5 * MB
+	// DefaultPartSize is how much data is buffered for each part before it is uploaded.
+	DefaultPartSize = 16 * MB
+	// DefaultPartConcurrency is how many parts of one object are uploaded at the same time.
+	DefaultPartConcurrency = 4
+)
+
+// byteUnits are the units of sizes, the longest suffixes first.
+var byteUnits = []struct {
+	suffix string
+	size   ByteSize
+}{{"GB", GB}, {"MB", MB}, {"KB", KB}, {"G", GB}, {"M", MB}, {"K", KB}, {"B", 1}}
+
+// ParseByteSize parses sizes such as "50MB", "1.5G" or "512k", a number without unit being bytes.
+func ParseByteSize(s string) (ByteSize, error) {
+	number, unit := strings.ToUpper(strings.TrimSpace(s)), ByteSize(1)
+	for _, u := range byteUnits {
+		if strings.HasSuffix(number, u.suffix) {
+			number, unit = strings.TrimSpace(strings.TrimSuffix(number, u.suffix)), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("Invalid size: " + s)
+	}
+	return ByteSize(n * float64(unit)), nil
+}
+
+func (b ByteSize) String() string {
+	for _, u := range byteUnits[:3] {
+		if b != 0 && b%u.size == 0 {
+			return fmt.Sprintf("%d%s", b/u.size, u.suffix)
+		}
+	}
+	return strconv.FormatInt(int64(b), 10)
+}
+
+// Set parses the size given to a flag.
+func (b *ByteSize) Set(s string) (err error) {
+	*b, err = ParseByteSize(s)
+	return
+}
@@ -0,0 +1,265 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoCredentials is returned by a CredentialsProvider whose source is not configured at all,
+// letting a chain move on to the next source.
+var ErrNoCredentials = errors.New("No AWS credentials found")
+
+// Credentials are the keys used to sign requests towards AWS.
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	// SessionToken is set for temporary credentials from STS.
+	SessionToken string
+	// Expiration is when temporary credentials stop working, zero for long term keys.
+	Expiration time.Time
+}
+
+// expired reports whether the credentials are about to stop working.
+func (c Credentials) expired() bool {
+	return !c.Expiration.IsZero() && time.Now().Add(time.Minute).After(c.Expiration)
+}
+
+// CredentialsProvider is something that can look up credentials.
+type CredentialsProvider interface {
+	Credentials() (Credentials, error)
+}
+
+// EnvCredentials reads credentials from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN environment variables.
+type EnvCredentials struct{}
+
+func (EnvCredentials) Credentials() (Credentials, error) {
+	c := Credentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if c.AccessKeyID == "" && c.SecretAccessKey == "" {
+		return c, ErrNoCredentials
+	}
+	if c.AccessKeyID == "" {
+		return c, errors.New("Missing AWS_ACCESS_KEY_ID environment variable")
+	}
+	if c.SecretAccessKey == "" {
+		return c, errors.New("Missing AWS_SECRET_ACCESS_KEY environment variable")
+	}
+	return c, nil
+}
+
+// SharedCredentials reads a profile from the shared credentials file used by the AWS command line tools.
+type SharedCredentials struct {
+	// Filename defaults to AWS_SHARED_CREDENTIALS_FILE or ~/.aws/credentials.
+	Filename string
+	// Profile defaults to AWS_PROFILE or "default".
+	Profile string
+}
+
+func (s SharedCredentials) Credentials() (Credentials, error) {
+	filename := s.Filename
+	if filename == "" {
+		filename = os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	}
+	if filename == "" {
+		home := os.Getenv("HOME")
+		if home == "" {
+			return Credentials{}, ErrNoCredentials
+		}
+		filename = filepath.Join(home, ".aws", "credentials")
+	}
+	profile := s.Profile
+	if profile == "" {
+		profile = os.Getenv("AWS_PROFILE")
+	}
+	if profile == "" {
+		profile = "default"
+	}
+
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) && s.Profile == "" {
+		return Credentials{}, ErrNoCredentials
+	}
+	if err != nil {
+		return Credentials{}, err
+	}
+	defer f.Close()
+
+	// The file is in ini format, only keep the keys of the section we are looking for.
+	keys := make(map[string]string)
+	found := false
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' && line[len(line)-1] == ']' {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			found = found || section == profile
+			continue
+		}
+		if section != profile {
+			continue
+		}
+		if i := strings.Index(line, "="); i > 0 {
+			keys[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return Credentials{}, err
+	}
+	if !found {
+		return Credentials{}, fmt.Errorf("Profile %q not found in %s", profile, filename)
+	}
+
+	c := Credentials{
+		AccessKeyID:     keys["aws_access_key_id"],
+		SecretAccessKey: keys["aws_secret_access_key"],
+		SessionToken:    keys["aws_session_token"],
+	}
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return c, fmt.Errorf("Profile %q in %s is missing aws_access_key_id or aws_secret_access_key", profile, filename)
+	}
+	return c, nil
+}
+
+// WebIdentityCredentials exchanges a web identity token, as handed out to Kubernetes service accounts
+// or CI jobs, for temporary credentials of a role using STS AssumeRoleWithWebIdentity.
+type WebIdentityCredentials struct {
+	// TokenFile defaults to AWS_WEB_IDENTITY_TOKEN_FILE.
+	TokenFile string
+	// RoleARN defaults to AWS_ROLE_ARN.
+	RoleARN string
+	// SessionName defaults to AWS_ROLE_SESSION_NAME or "mongotool".
+	SessionName string
+	// Endpoint is the STS endpoint, which defaults to the regional one when AWS_REGION is set.
+	Endpoint string
+}
+
+func (w WebIdentityCredentials) Credentials() (Credentials, error) {
+	tokenFile, role, session := w.TokenFile, w.RoleARN, w.SessionName
+	if tokenFile == "" {
+		tokenFile = os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	}
+	if role == "" {
+		role = os.Getenv("AWS_ROLE_ARN")
+	}
+	if tokenFile == "" || role == "" {
+		return Credentials{}, ErrNoCredentials
+	}
+	if session == "" {
+		session = os.Getenv("AWS_ROLE_SESSION_NAME")
+	}
+	if session == "" {
+		session = "mongotool"
+	}
+	endpoint := w.Endpoint
+	if endpoint == "" {
+		endpoint = "https://sts.amazonaws.com"
+		if region := os.Getenv("AWS_REGION"); region != "" {
+			endpoint = "https://sts." + region + ".amazonaws.com"
+		}
+	}
+
+	token, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return Credentials{}, err
+	}
+	// AssumeRoleWithWebIdentity is authenticated by the token itself, the request is not signed.
+	resp, err := http.PostForm(endpoint, url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {role},
+		"RoleSessionName":  {session},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	})
+	if err != nil {
+		return Credentials{}, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return Credentials{}, err
+	}
+	if code := resp.StatusCode; code != http.StatusOK {
+		return Credentials{}, fmt.Errorf("Could not assume role %s with web identity: (%d)\n%s", role, code, string(body))
+	}
+
+	result := struct {
+		AccessKeyId     string    `xml:"AssumeRoleWithWebIdentityResult>Credentials>AccessKeyId"`
+		SecretAccessKey string    `xml:"AssumeRoleWithWebIdentityResult>Credentials>SecretAccessKey"`
+		SessionToken    string    `xml:"AssumeRoleWithWebIdentityResult>Credentials>SessionToken"`
+		Expiration      time.Time `xml:"AssumeRoleWithWebIdentityResult>Credentials>Expiration"`
+	}{}
+	if err := xml.Unmarshal(body, &result); err != nil {
+		return Credentials{}, err
+	}
+	return Credentials{
+		AccessKeyID:     result.AccessKeyId,
+		SecretAccessKey: result.SecretAccessKey,
+		SessionToken:    result.SessionToken,
+		Expiration:      result.Expiration,
+	}, nil
+}
+
+// ChainCredentials tries each provider in order and uses the first one that is configured.
+// The credentials found are cached until they are about to expire.
+type ChainCredentials struct {
+	Providers []CredentialsProvider
+
+	mu     sync.Mutex
+	cached *Credentials
+}
+
+// NewChainCredentials resolves credentials the same way as the AWS command line tools: environment
+// variables, a web identity token and finally the shared credentials file.
+// An explicitly selected profile is always read from the shared credentials file.
+func NewChainCredentials(profile string) *ChainCredentials {
+	if profile != "" {
+		return &ChainCredentials{Providers: []CredentialsProvider{SharedCredentials{Profile: profile}}}
+	}
+	return &ChainCredentials{
+		Providers: []CredentialsProvider{
+			EnvCredentials{},
+			WebIdentityCredentials{},
+			SharedCredentials{},
+		},
+	}
+}
+
+func (c *ChainCredentials) Credentials() (Credentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cached != nil && !c.cached.expired() {
+		return *c.cached, nil
+	}
+	for _, p := range c.Providers {
+		creds, err := p.Credentials()
+		if err == ErrNoCredentials {
+			continue
+		}
+		if err != nil {
+			return creds, err
+		}
+		c.cached = &creds
+		return creds, nil
+	}
+	return Credentials{}, errors.New(
+		"No AWS credentials found in the environment, a web identity token or the shared credentials file",
+	)
+}
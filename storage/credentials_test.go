@@ -0,0 +1,199 @@
+package storage
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// setenv sets the environment variables, returning the function putting them back as they were, so
+// that they don't leak into the tests run next.
+func setenv(env map[string]string) (restore func()) {
+	saved := make(map[string]*string)
+	for k, v := range env {
+		if old, ok := os.LookupEnv(k); ok {
+			saved[k] = &old
+		} else {
+			saved[k] = nil
+		}
+		os.Setenv(k, v)
+	}
+	return func() {
+		for k, old := range saved {
+			if old != nil {
+				os.Setenv(k, *old)
+			} else {
+				os.Unsetenv(k)
+			}
+		}
+	}
+}
+
+// withEnv sets the environment variables for the duration of f, restoring them afterwards.
+func withEnv(env map[string]string, f func()) {
+	defer setenv(env)()
+	f()
+}
+
+const credentialsFile = `
+[default]
+aws_access_key_id = AKIDDEFAULT
+aws_secret_access_key = defaultsecret
+
+# Temporary keys
+[ci]
+aws_access_key_id=AKIDCI
+aws_secret_access_key=cisecret
+aws_session_token=citoken
+`
+
+func TestCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongotool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "credentials")
+	if err := ioutil.WriteFile(filename, []byte(credentialsFile), 0600); err != nil {
+		t.Fatal(err)
+	}
+	noEnv := map[string]string{
+		"AWS_ACCESS_KEY_ID":           "",
+		"AWS_SECRET_ACCESS_KEY":       "",
+		"AWS_SESSION_TOKEN":           "",
+		"AWS_PROFILE":                 "",
+		"AWS_WEB_IDENTITY_TOKEN_FILE": "",
+		"AWS_ROLE_ARN":                "",
+		"AWS_SHARED_CREDENTIALS_FILE": filename,
+	}
+
+	Convey("Given credentials in the environment", t, func() {
+		env := map[string]string{
+			"AWS_ACCESS_KEY_ID":     "AKIDENV",
+			"AWS_SECRET_ACCESS_KEY": "envsecret",
+			"AWS_SESSION_TOKEN":     "envtoken",
+		}
+		withEnv(noEnv, func() {
+			withEnv(env, func() {
+				Convey("The chain should use them before the shared credentials file", func() {
+					c, err := NewChainCredentials("").Credentials()
+					So(err, ShouldBeNil)
+					So(c.AccessKeyID, ShouldEqual, "AKIDENV")
+					So(c.SessionToken, ShouldEqual, "envtoken")
+				})
+				Convey("Unless a profile is explicitly selected", func() {
+					c, err := NewChainCredentials("ci").Credentials()
+					So(err, ShouldBeNil)
+					So(c.AccessKeyID, ShouldEqual, "AKIDCI")
+				})
+			})
+		})
+	})
+
+	Convey("Given only a shared credentials file", t, func() {
+		withEnv(noEnv, func() {
+			Convey("The default profile should be used", func() {
+				c, err := NewChainCredentials("").Credentials()
+				So(err, ShouldBeNil)
+				So(c.AccessKeyID, ShouldEqual, "AKIDDEFAULT")
+				So(c.SecretAccessKey, ShouldEqual, "defaultsecret")
+			})
+			Convey("AWS_PROFILE should select the profile", func() {
+				withEnv(map[string]string{"AWS_PROFILE": "ci"}, func() {
+					c, err := NewChainCredentials("").Credentials()
+					So(err, ShouldBeNil)
+					So(c, ShouldResemble, Credentials{
+						AccessKeyID:     "AKIDCI",
+						SecretAccessKey: "cisecret",
+						SessionToken:    "citoken",
+					})
+				})
+			})
+			Convey("A missing profile should be an error", func() {
+				_, err := NewChainCredentials("missing").Credentials()
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+
+	Convey("Given no credentials at all", t, func() {
+		withEnv(noEnv, func() {
+			withEnv(map[string]string{"AWS_SHARED_CREDENTIALS_FILE": filepath.Join(dir, "missing")}, func() {
+				_, err := NewChainCredentials("").Credentials()
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+
+	Convey("Given a web identity token and a STS endpoint", t, func() {
+		tokenFile := filepath.Join(dir, "token")
+		So(ioutil.WriteFile(tokenFile, []byte("jwt\n"), 0600), ShouldBeNil)
+		requests := 0
+		sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if r.FormValue("WebIdentityToken") != "jwt" || r.FormValue("RoleArn") != "arn:aws:iam::123:role/dump" {
+				http.Error(w, "AccessDenied", http.StatusForbidden)
+				return
+			}
+			w.Write([]byte(`<AssumeRoleWithWebIdentityResponse><AssumeRoleWithWebIdentityResult><Credentials>
+				<AccessKeyId>ASIAWEB</AccessKeyId><SecretAccessKey>websecret</SecretAccessKey>
+				<SessionToken>webtoken</SessionToken><Expiration>` + time.Now().Add(time.Hour).UTC().Format(time.RFC3339) + `</Expiration>
+				</Credentials></AssumeRoleWithWebIdentityResult></AssumeRoleWithWebIdentityResponse>`))
+		}))
+		defer sts.Close()
+
+		chain := &ChainCredentials{Providers: []CredentialsProvider{
+			EnvCredentials{},
+			WebIdentityCredentials{TokenFile: tokenFile, RoleARN: "arn:aws:iam::123:role/dump", Endpoint: sts.URL},
+			SharedCredentials{},
+		}}
+		withEnv(noEnv, func() {
+			Convey("The token should be exchanged for temporary credentials", func() {
+				c, err := chain.Credentials()
+				So(err, ShouldBeNil)
+				So(c.AccessKeyID, ShouldEqual, "ASIAWEB")
+				So(c.SessionToken, ShouldEqual, "webtoken")
+				So(c.Expiration.IsZero(), ShouldBeFalse)
+
+				Convey("Which are cached until they are about to expire", func() {
+					_, err := chain.Credentials()
+					So(err, ShouldBeNil)
+					So(requests, ShouldEqual, 1)
+				})
+			})
+		})
+	})
+}
+
+func TestS3SessionToken(t *testing.T) {
+	Convey("Given S3 with temporary credentials", t, func() {
+		var token string
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token = r.Header.Get("X-Amz-Security-Token")
+		}))
+		defer ts.Close()
+
+		store := NewS3(ts.URL)
+		store.Credentials = &ChainCredentials{Providers: []CredentialsProvider{
+			staticCredentials{AccessKeyID: "ASIA", SecretAccessKey: "secret", SessionToken: "session"},
+		}}
+
+		Convey("Requests should carry the session token", func() {
+			w, err := store.Save("object")
+			So(err, ShouldBeNil)
+			So(w.Close(), ShouldBeNil)
+			So(token, ShouldEqual, "session")
+		})
+	})
+}
+
+type staticCredentials Credentials
+
+func (s staticCredentials) Credentials() (Credentials, error) {
+	return Credentials(s), nil
+}
@@ -0,0 +1,359 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Encrypted objects begin with a header of the magic bytes, the length of the key id, the key id
+// and a random salt. The rest is the data split into chunks sealed with AES-256-GCM, using a key
+// derived from the salt so that every object has its own key. Every chunk but the last one is full,
+// and each is preceded by its sealed length so that the end of an object is known without reading
+// past it. Each nonce holds the chunk number and whether it is the last chunk, so that chunks can't
+// be reordered, dropped or truncated unnoticed.
+const (
+	encryptMagic     = "MTENC\x01"
+	encryptSaltSize  = 16
+	encryptChunkSize = 64 * KB
+	// passphraseKeyID is the ID of passphrase keys, which is not derived from the passphrase as the
+	// ID is stored in the clear.
+	passphraseKeyID = "passphrase"
+)
+
+// Key is a named secret to encrypt objects with.
+// The ID is stored in the header of every object, to know which key is needed when fetching it.
+type Key struct {
+	ID     string
+	secret []byte
+	// passphrase tells that secret is a passphrase, which the key of every object is derived from.
+	passphrase bool
+}
+
+// NewKey returns a key for a secret of 32 bytes. Its ID is derived from the secret unless given, which
+// gives nothing away as the secret is random, unlike passphrases.
+func NewKey(id string, secret []byte) (Key, error) {
+	if len(secret) != 32 {
+		return Key{}, fmt.Errorf("Expected a key of 32 bytes, got %d", len(secret))
+	}
+	if id == "" {
+		sum := sha256.Sum256(secret)
+		id = hex.EncodeToString(sum[:8])
+	}
+	if len(id) > 255 {
+		return Key{}, errors.New("Key id is longer than 255 bytes")
+	}
+	return Key{ID: id, secret: secret}, nil
+}
+
+// ReadKeyFile reads a key file holding 32 raw bytes or 64 hex characters.
+func ReadKeyFile(filename string) (Key, error) {
+	secret, err := ReadSecretFile(filename)
+	if err != nil {
+		return Key{}, err
+	}
+	return NewKey("", secret)
+}
+
+// ReadSecretFile reads a file holding a secret of 32 bytes, either raw or as 64 hex characters.
+func ReadSecretFile(filename string) ([]byte, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if trimmed := strings.TrimSpace(string(b)); len(trimmed) == 64 {
+		if secret, err := hex.DecodeString(trimmed); err == nil {
+			return secret, nil
+		}
+	}
+	return b, nil
+}
+
+// PassphraseKey returns a key for a passphrase. The key of every object is derived from the passphrase
+// using scrypt with the random salt of the object, so that guesses can't be computed in advance and
+// have to be checked against each object on its own.
+func PassphraseKey(passphrase string) (Key, error) {
+	if passphrase == "" {
+		return Key{}, errors.New("Empty passphrase")
+	}
+	return Key{ID: passphraseKeyID, secret: []byte(passphrase), passphrase: true}, nil
+}
+
+// aead returns the cipher for one object, using a key derived from the salt.
+func (k Key) aead(salt []byte) (cipher.AEAD, error) {
+	secret := k.secret
+	if k.passphrase {
+		var err error
+		if secret, err = scrypt.Key(k.secret, salt, 1<<15, 8, 1, 32); err != nil {
+			return nil, err
+		}
+	}
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte("mongotool object")), key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce of chunk n.
+func chunkNonce(n uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, n)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// EncryptedSaveFetcher wraps another SaveFetcher to encrypt/decrypt data saved/fetched on it.
+// Objects are saved using the first key, while any of the keys can be used when fetching.
+// Fetching anything that is not encrypted, tampered with or encrypted with another key fails.
+type EncryptedSaveFetcher struct {
+	s    SaveFetcher
+	key  Key
+	keys map[string]Key
+}
+
+func NewEncryptedSaveFetcher(s SaveFetcher, key Key, others ...Key) SaveFetcher {
+	keys := map[string]Key{key.ID: key}
+	for _, k := range others {
+		keys[k.ID] = k
+	}
+	return &EncryptedSaveFetcher{s, key, keys}
+}
+
+// encryptWriter seals every full chunk written, and the remaining one as the last chunk once closed.
+type encryptWriter struct {
+	w       io.WriteCloser
+	aead    cipher.AEAD
+	header  []byte
+	buf     []byte
+	counter uint64
+	closed  bool
+}
+
+func (e *EncryptedSaveFetcher) Save(path string) (io.WriteCloser, error) {
+	return e.SaveTags(path, nil)
+}
+
+// SaveTags saves tags with the object if the wrapped storage can. Tags are not encrypted.
+func (e *EncryptedSaveFetcher) SaveTags(path string, tags Tagger) (io.WriteCloser, error) {
+	salt := make([]byte, encryptSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := e.key.aead(salt)
+	if err != nil {
+		return nil, err
+	}
+	header := append([]byte(encryptMagic), byte(len(e.key.ID)))
+	header = append(header, e.key.ID...)
+	header = append(header, salt...)
+
+	w, err := SaveTagged(e.s, path, tags)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return &encryptWriter{
+		w:      w,
+		aead:   aead,
+		header: header,
+		buf:    make([]byte, 0, encryptChunkSize),
+	}, nil
+}
+
+func (ew *encryptWriter) Write(p []byte) (int, error) {
+	if ew.closed {
+		return 0, errors.New("Write on closed encrypted object")
+	}
+	n := len(p)
+	for len(p) > 0 {
+		free := cap(ew.buf) - len(ew.buf)
+		if free > len(p) {
+			free = len(p)
+		}
+		ew.buf = append(ew.buf, p[:free]...)
+		p = p[free:]
+		if len(ew.buf) == cap(ew.buf) {
+			if err := ew.seal(false); err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+	return n, nil
+}
+
+// seal encrypts and writes the buffered chunk.
+func (ew *encryptWriter) seal(last bool) error {
+	sealed := make([]byte, 4, 4+len(ew.buf)+ew.aead.Overhead())
+	sealed = ew.aead.Seal(sealed, chunkNonce(ew.counter, last), ew.buf, ew.header)
+	binary.BigEndian.PutUint32(sealed, uint32(len(sealed)-4))
+	ew.counter++
+	ew.buf = ew.buf[:0]
+	_, err := ew.w.Write(sealed)
+	return err
+}
+
+// Close writes the last chunk, which is empty if the data ended on a chunk boundary.
+func (ew *encryptWriter) Close() error {
+	if ew.closed {
+		return nil
+	}
+	ew.closed = true
+	if err := ew.seal(true); err != nil {
+		ew.w.Close()
+		return err
+	}
+	return ew.w.Close()
+}
+
+// decryptReader opens one chunk at a time, failing on anything not authenticated.
+// Several encrypted objects concatenated, as written to a Stream, are read one after the other.
+type decryptReader struct {
+	e       *EncryptedSaveFetcher
+	r       *bufio.Reader
+	closer  io.Closer
+	path    string
+	aead    cipher.AEAD
+	header  []byte
+	sealed  []byte
+	plain   []byte
+	counter uint64
+	done    bool
+}
+
+func (e *EncryptedSaveFetcher) Fetch(path string) (io.ReadCloser, error) {
+	r, err := e.s.Fetch(path)
+	if err != nil {
+		return nil, err
+	}
+	dr := &decryptReader{
+		e:      e,
+		r:      bufio.NewReader(r),
+		closer: r,
+		path:   path,
+	}
+	if err := dr.readHeader(); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return dr, nil
+}
+
+// readHeader reads the header of the object and sets up the cipher for the rest of it.
+func (dr *decryptReader) readHeader() error {
+	header := make([]byte, len(encryptMagic)+1)
+	if _, err := io.ReadFull(dr.r, header); err != nil || !bytes.HasPrefix(header, []byte(encryptMagic)) {
+		return fmt.Errorf("%s is not encrypted", dr.path)
+	}
+	rest := make([]byte, int(header[len(header)-1])+encryptSaltSize)
+	if _, err := io.ReadFull(dr.r, rest); err != nil {
+		return fmt.Errorf("%s has a truncated encryption header", dr.path)
+	}
+	id, salt := string(rest[:len(rest)-encryptSaltSize]), rest[len(rest)-encryptSaltSize:]
+
+	key, ok := dr.e.keys[id]
+	if !ok {
+		return fmt.Errorf("%s is encrypted with key %s, which was not given", dr.path, id)
+	}
+	aead, err := key.aead(salt)
+	if err != nil {
+		return err
+	}
+	dr.aead = aead
+	dr.header = append(header, rest...)
+	dr.sealed = make([]byte, encryptChunkSize+ByteSize(aead.Overhead()))
+	dr.counter = 0
+	dr.done = false
+	return nil
+}
+
+func (dr *decryptReader) Read(p []byte) (int, error) {
+	for len(dr.plain) == 0 {
+		if dr.done {
+			// Anything following the last chunk has to be another encrypted object.
+			if _, err := dr.r.Peek(1); err == io.EOF {
+				return 0, io.EOF
+			}
+			if err := dr.readHeader(); err != nil {
+				return 0, err
+			}
+		}
+		if err := dr.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, dr.plain)
+	dr.plain = dr.plain[n:]
+	return n, nil
+}
+
+// open reads and decrypts the next chunk. Only the last chunk is shorter than a full chunk, so a
+// missing or truncated last chunk won't authenticate.
+func (dr *decryptReader) open() error {
+	var length [4]byte
+	if _, err := io.ReadFull(dr.r, length[:]); err != nil {
+		return fmt.Errorf("Could not decrypt %s, it is truncated", dr.path)
+	}
+	n := int(binary.BigEndian.Uint32(length[:]))
+	if n > len(dr.sealed) {
+		return fmt.Errorf("Could not decrypt %s, it has been tampered with", dr.path)
+	}
+	if _, err := io.ReadFull(dr.r, dr.sealed[:n]); err != nil {
+		return fmt.Errorf("Could not decrypt %s, it is truncated", dr.path)
+	}
+	last := n < len(dr.sealed)
+	plain, err := dr.aead.Open(dr.sealed[:0], chunkNonce(dr.counter, last), dr.sealed[:n], dr.header)
+	if err != nil {
+		return fmt.Errorf("Could not decrypt %s, it is truncated or has been tampered with: %v", dr.path, err)
+	}
+	dr.counter++
+	dr.plain = plain
+	dr.done = last
+	return nil
+}
+
+func (dr *decryptReader) Close() error {
+	return dr.closer.Close()
+}
+
+func (e *EncryptedSaveFetcher) Walk(path string, walkfn WalkFunc) error {
+	return Walk(e.s, path, walkfn)
+}
+
+// Stat returns the info of the object as stored, the size including the encryption overhead.
+func (e *EncryptedSaveFetcher) Stat(path string) (ObjectInfo, error) {
+	return Stat(e.s, path)
+}
+
+func (e *EncryptedSaveFetcher) Delete(path string) error {
+	return Delete(e.s, path)
+}
+
+func (e *EncryptedSaveFetcher) Restore(path string, days int, tier string) error {
+	return Restore(e.s, path, days, tier)
+}
+
+func (e *EncryptedSaveFetcher) Close() error {
+	return Close(e.s)
+}
@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"bytes"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncryptedSaveFetcher(t *testing.T) {
+	key, err := NewKey("", bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewKey("other", bytes.Repeat([]byte{2}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("0123456789abcdef"), int(encryptChunkSize))
+
+	fetch := func(s SaveFetcher, path string) ([]byte, error) {
+		r, err := s.Fetch(path)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	}
+
+	Convey("Given an EncryptedSaveFetcher", t, func() {
+		objects := make(memObjects)
+		store := NewEncryptedSaveFetcher(objects, key)
+
+		Convey("Objects of any size should round trip", func() {
+			for _, size := range []int{0, 1, int(encryptChunkSize), int(encryptChunkSize) + 1, len(data)} {
+				w, err := store.Save("object")
+				So(err, ShouldBeNil)
+				_, err = w.Write(data[:size])
+				So(err, ShouldBeNil)
+				So(w.Close(), ShouldBeNil)
+				So(bytes.Contains(objects["object"].Bytes(), []byte("0123456789abcdef")), ShouldBeFalse)
+
+				b, err := fetch(store, "object")
+				So(err, ShouldBeNil)
+				So(bytes.Equal(b, data[:size]), ShouldBeTrue)
+			}
+		})
+
+		Convey("Given a saved object", func() {
+			w, err := store.Save("object")
+			So(err, ShouldBeNil)
+			w.Write(data)
+			So(w.Close(), ShouldBeNil)
+			saved := objects["object"].Bytes()
+
+			Convey("Flipping any bit should fail the fetch", func() {
+				saved[len(saved)/2] ^= 1
+				_, err := fetch(store, "object")
+				So(err, ShouldNotBeNil)
+			})
+			Convey("Tampering with the header should fail the fetch", func() {
+				saved[len(encryptMagic)+2] ^= 1
+				_, err := fetch(store, "object")
+				So(err, ShouldNotBeNil)
+			})
+			Convey("Truncating it on a chunk boundary should fail the fetch", func() {
+				// The data ends on a chunk boundary, so the last chunk is empty: its length and its tag.
+				objects["object"].Truncate(len(saved) - 4 - 16)
+				_, err := fetch(store, "object")
+				So(err, ShouldNotBeNil)
+			})
+			Convey("Fetching with another key should fail", func() {
+				_, err := fetch(NewEncryptedSaveFetcher(objects, other), "object")
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, key.ID)
+			})
+			Convey("Fetching with the key among others should succeed", func() {
+				b, err := fetch(NewEncryptedSaveFetcher(objects, other, key), "object")
+				So(err, ShouldBeNil)
+				So(bytes.Equal(b, data), ShouldBeTrue)
+			})
+		})
+
+		Convey("Fetching an object that is not encrypted should fail", func() {
+			w, _ := objects.Save("plain")
+			io.WriteString(w, "Foo")
+			_, err := fetch(store, "plain")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Objects saved to a stream should be read back one after the other", func() {
+			var out bytes.Buffer
+			stream := NewEncryptedSaveFetcher(NewStream(&out, &out), key)
+			for _, content := range []string{"foo", "bar"} {
+				w, err := stream.Save("object")
+				So(err, ShouldBeNil)
+				io.WriteString(w, content)
+				So(w.Close(), ShouldBeNil)
+			}
+			b, err := fetch(stream, "-")
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "foobar")
+		})
+	})
+
+	Convey("Given key files", t, func() {
+		dir, err := ioutil.TempDir("", "mongotool")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		hexFile := filepath.Join(dir, "hex")
+		So(ioutil.WriteFile(hexFile, []byte("0101010101010101010101010101010101010101010101010101010101010101\n"), 0600), ShouldBeNil)
+		rawFile := filepath.Join(dir, "raw")
+		So(ioutil.WriteFile(rawFile, bytes.Repeat([]byte{1}, 32), 0600), ShouldBeNil)
+		shortFile := filepath.Join(dir, "short")
+		So(ioutil.WriteFile(shortFile, []byte("secret"), 0600), ShouldBeNil)
+
+		Convey("Hex and raw keys should give the same key", func() {
+			k1, err := ReadKeyFile(hexFile)
+			So(err, ShouldBeNil)
+			k2, err := ReadKeyFile(rawFile)
+			So(err, ShouldBeNil)
+			So(k1, ShouldResemble, key)
+			So(k2, ShouldResemble, key)
+		})
+		Convey("A key of the wrong size should be refused", func() {
+			_, err := ReadKeyFile(shortFile)
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given objects encrypted with a passphrase", t, func() {
+		k1, err := PassphraseKey("correct horse")
+		So(err, ShouldBeNil)
+		objects := make(memObjects)
+		for _, path := range []string{"a", "b"} {
+			w, err := NewEncryptedSaveFetcher(objects, k1).Save(path)
+			So(err, ShouldBeNil)
+			w.Write([]byte("foo"))
+			So(w.Close(), ShouldBeNil)
+		}
+
+		Convey("The same passphrase should read them", func() {
+			k2, err := PassphraseKey("correct horse")
+			So(err, ShouldBeNil)
+			b, err := fetch(NewEncryptedSaveFetcher(objects, k2), "a")
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "foo")
+		})
+		Convey("Another passphrase should fail to read them", func() {
+			k3, err := PassphraseKey("battery staple")
+			So(err, ShouldBeNil)
+			_, err = fetch(NewEncryptedSaveFetcher(objects, k3), "a")
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Nothing derived from the passphrase should be stored in the clear", func() {
+			k3, err := PassphraseKey("battery staple")
+			So(err, ShouldBeNil)
+			So(k3.ID, ShouldEqual, k1.ID)
+			// Every object has a salt of its own, so the same data is never encrypted the same way.
+			a, b := objects["a"].Bytes(), objects["b"].Bytes()
+			header := len(encryptMagic) + 1 + len(k1.ID)
+			So(bytes.Equal(a[header:header+encryptSaltSize], b[header:header+encryptSaltSize]), ShouldBeFalse)
+			So(bytes.Equal(a[header+encryptSaltSize:], b[header+encryptSaltSize:]), ShouldBeFalse)
+		})
+	})
+}
@@ -1,41 +1,212 @@
 package storage
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"io"
+	"io/ioutil"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
 )
 
+// tempMarker is part of the name of every file being saved, until it is renamed into place.
+const tempMarker = ".tmp-"
+
+// tagsSuffix is the suffix of the sidecar file holding the tags of an object as json.
+const tagsSuffix = ".tags.json"
+
 // Filesystem implements the SaveFetcher for the traditional disk storage.
 type Filesystem struct {
 	Root string
 }
 
+// Save writes to a temporary file next to fpath, which is only renamed into place once closed.
+// This way a crash never leaves a truncated object behind, only a temporary file that Walk ignores.
 func (f Filesystem) Save(fpath string) (io.WriteCloser, error) {
+	return f.SaveTags(fpath, nil)
+}
+
+// SaveTags saves the tags in a sidecar file next to the object, named after it with a ".tags.json" suffix.
+func (f Filesystem) SaveTags(fpath string, tags Tagger) (io.WriteCloser, error) {
 	fullpath := path.Join(f.Root, fpath)
-	if err := os.MkdirAll(path.Dir(fullpath), 0700); err != nil {
+	dir, name := path.Split(fullpath)
+	if err := os.MkdirAll(dir, 0700); err != nil {
 		return nil, err
 	}
-	fd, err := os.Create(fullpath)
+	fd, err := createTemp(dir, name)
 	if err != nil {
 		return nil, err
 	}
-	return fd, err
+	a := &atomicFile{File: fd, path: fullpath}
+	if tags != nil {
+		a.tags = tags.Tags()
+	}
+	return a, nil
+}
+
+// createTemp creates a temporary file for name in dir. Unlike ioutil.TempFile, which creates files
+// readable by their owner only, it is given the mode os.Create would give to the file.
+func createTemp(dir, name string) (*os.File, error) {
+	for {
+		temp, err := tempName(name)
+		if err != nil {
+			return nil, err
+		}
+		fd, err := os.OpenFile(path.Join(dir, temp), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if !os.IsExist(err) {
+			return fd, err
+		}
+	}
+}
+
+// tempName returns a random name of a temporary file of name, which isTempFile tells apart.
+func tempName(name string) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "." + name + tempMarker + hex.EncodeToString(b), nil
+}
+
+// isTempFile tells if name is a file still being saved, or left behind by a crash.
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.Contains(name, tempMarker)
+}
+
+// atomicFile is a temporary file that is synced and renamed to its path once closed.
+type atomicFile struct {
+	*os.File
+	path string
+	tags map[string]string
+}
+
+func (a *atomicFile) Close() error {
+	err := a.File.Sync()
+	if cerr := a.File.Close(); err == nil {
+		err = cerr
+	}
+	// The tags go first, so that an object never shows up without them.
+	if err == nil {
+		err = a.saveTags()
+	}
+	if err == nil {
+		err = os.Rename(a.File.Name(), a.path)
+	}
+	if err != nil {
+		os.Remove(a.File.Name())
+		return err
+	}
+	// Sync the directory too, or the rename itself could be lost in a crash.
+	dir, err := os.Open(path.Dir(a.path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// Abort removes the temporary file instead of renaming it into place.
+func (a *atomicFile) Abort() error {
+	a.File.Close()
+	return os.Remove(a.File.Name())
+}
+
+// saveTags replaces the sidecar file of the object with its tags, or removes it if there are none.
+func (a *atomicFile) saveTags() error {
+	if a.tags == nil {
+		if err := os.Remove(a.path + tagsSuffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	b, err := json.Marshal(a.tags)
+	if err != nil {
+		return err
+	}
+	fd, err := createTemp(path.Dir(a.path), path.Base(a.path)+tagsSuffix)
+	if err != nil {
+		return err
+	}
+	_, err = fd.Write(b)
+	if err == nil {
+		err = fd.Sync()
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(fd.Name(), a.path+tagsSuffix)
+	}
+	if err != nil {
+		os.Remove(fd.Name())
+	}
+	return err
 }
 
 func (f Filesystem) Walk(p string, wfunc WalkFunc) error {
 	fullpath := path.Join(f.Root, p)
 	return filepath.Walk(fullpath, func(fpath string, info os.FileInfo, err error) error {
-		if info.IsDir() {
+		relative := strings.TrimLeft(strings.TrimPrefix(fpath, f.Root), "/")
+		// info is nil when fpath could not be read at all.
+		if err != nil {
+			return wfunc(relative, err)
+		}
+		if info.IsDir() || isTempFile(info.Name()) || strings.HasSuffix(info.Name(), tagsSuffix) {
 			return nil
 		}
-		relative := strings.TrimPrefix(fpath, f.Root)
-		return wfunc(strings.TrimLeft(relative, "/"), err)
+		return wfunc(relative, nil)
 	})
 }
 
 func (f Filesystem) Fetch(fpath string) (io.ReadCloser, error) {
 	return os.Open(path.Join(f.Root, fpath))
 }
+
+func (f Filesystem) Stat(fpath string) (ObjectInfo, error) {
+	info, err := os.Stat(path.Join(f.Root, fpath))
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if info.IsDir() {
+		return ObjectInfo{}, &os.PathError{Op: "stat", Path: fpath, Err: errors.New("Is a directory")}
+	}
+	oi := ObjectInfo{Path: fpath, Size: info.Size(), ModTime: info.ModTime()}
+	b, err := ioutil.ReadFile(path.Join(f.Root, fpath) + tagsSuffix)
+	if err == nil {
+		err = json.Unmarshal(b, &oi.Tags)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return ObjectInfo{}, err
+	}
+	return oi, nil
+}
+
+// Delete deletes the object together with its tags.
+func (f Filesystem) Delete(fpath string) error {
+	fullpath := path.Join(f.Root, fpath)
+	if err := os.Remove(fullpath); err != nil {
+		return err
+	}
+	if err := os.Remove(fullpath + tagsSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func init() {
+	Register("file", openFilesystem)
+}
+
+// openFilesystem opens file:///absolute/path or file://relative/path targets, or an Archive for paths
+// ending with ArchiveSuffix.
+func openFilesystem(u *url.URL) (SaveFetcher, string, error) {
+	if p := u.Host + u.Path; strings.HasSuffix(p, ArchiveSuffix) {
+		return NewArchive(p), "", nil
+	}
+	return Filesystem{Root: u.Host + u.Path}, "", nil
+}
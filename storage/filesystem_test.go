@@ -80,3 +80,85 @@ func shouldExistInFilesystem(filename interface{}, _ ...interface{}) string {
 	}
 	return ""
 }
+
+func TestFilesystemAtomicSave(t *testing.T) {
+	Convey("Given a filesystem in a temporary directory", t, func() {
+		dir, err := ioutil.TempDir("", "mongotool")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		store := Filesystem{dir}
+
+		Convey("An object being saved should not show up until closed", func() {
+			w, err := store.Save("dump/object")
+			So(err, ShouldBeNil)
+			_, err = io.WriteString(w, "foo")
+			So(err, ShouldBeNil)
+
+			_, err = os.Stat(path.Join(dir, "dump/object"))
+			So(os.IsNotExist(err), ShouldBeTrue)
+			var found []string
+			err = store.Walk("dump", func(p string, err error) error {
+				found = append(found, p)
+				return err
+			})
+			So(err, ShouldBeNil)
+			So(found, ShouldBeEmpty)
+
+			So(w.Close(), ShouldBeNil)
+			So(path.Join(dir, "dump/object"), shouldExistInFilesystem)
+			err = store.Walk("dump", func(p string, err error) error {
+				found = append(found, p)
+				return err
+			})
+			So(err, ShouldBeNil)
+			So(found, ShouldResemble, []string{"dump/object"})
+
+			entries, err := ioutil.ReadDir(path.Join(dir, "dump"))
+			So(err, ShouldBeNil)
+			So(len(entries), ShouldEqual, 1)
+		})
+
+		Convey("A saved object should get the same mode as a file made by os.Create", func() {
+			w, err := store.SaveTags("dump/object", Tags{"dump-id": "1"})
+			So(err, ShouldBeNil)
+			So(w.Close(), ShouldBeNil)
+			fd, err := os.Create(path.Join(dir, "created"))
+			So(err, ShouldBeNil)
+			fd.Close()
+			created, err := os.Stat(path.Join(dir, "created"))
+			So(err, ShouldBeNil)
+			for _, name := range []string{"dump/object", "dump/object" + tagsSuffix} {
+				info, err := os.Stat(path.Join(dir, name))
+				So(err, ShouldBeNil)
+				So(info.Mode(), ShouldEqual, created.Mode())
+			}
+		})
+
+		Convey("A saved object should be stated and deleted", func() {
+			w, err := store.Save("dump/object")
+			So(err, ShouldBeNil)
+			io.WriteString(w, "foo")
+			So(w.Close(), ShouldBeNil)
+
+			info, err := Stat(NewGzipSaveFetcher(store), "dump/object")
+			So(err, ShouldBeNil)
+			So(info.Path, ShouldEqual, "dump/object")
+			So(info.Size, ShouldEqual, 3)
+			So(info.ModTime.IsZero(), ShouldBeFalse)
+
+			So(store.Delete("dump/object"), ShouldBeNil)
+			_, err = store.Stat("dump/object")
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("Walking a missing path should report the error instead of panicking", func() {
+			var walkErr error
+			err := store.Walk("missing", func(p string, err error) error {
+				walkErr = err
+				return err
+			})
+			So(err, ShouldNotBeNil)
+			So(os.IsNotExist(walkErr), ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,410 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GCSEndpoint is the endpoint of the JSON API of Google Cloud Storage.
+const GCSEndpoint = "https://storage.googleapis.com"
+
+// gcsChunkAlign is what every chunk of a resumable upload but the last one has to be a multiple of.
+const gcsChunkAlign = 256 * KB
+
+// DefaultGCSChunkSize is how much data is buffered for each request of a resumable upload.
+const DefaultGCSChunkSize = 8 * MB
+
+// maxGCSMetadata is how many bytes of custom metadata GCS allows on one object.
+const maxGCSMetadata = 8 * KB
+
+// GCS implements the SaveFetcher for a bucket on Google Cloud Storage, using its JSON API.
+// Objects are saved with resumable uploads, so large objects are sent in chunks.
+type GCS struct {
+	Bucket string
+	// Endpoint is GCSEndpoint unless talking to an emulator.
+	Endpoint string
+	// ChunkSize is how much data is sent with each request of an upload, a multiple of 256KB.
+	ChunkSize ByteSize
+	// Retry is the policy for requests failing with transient errors.
+	Retry RetryPolicy
+	// Tokens authorizes the requests, which are sent unauthorized when nil, as some emulators want.
+	Tokens TokenSource
+	client *http.Client
+}
+
+func NewGCS(bucket string) *GCS {
+	return &GCS{
+		Bucket:    bucket,
+		Endpoint:  GCSEndpoint,
+		ChunkSize: DefaultGCSChunkSize,
+		Retry:     DefaultRetryPolicy,
+		client:    &http.Client{},
+	}
+}
+
+func (g *GCS) limitTransport(upload, download, requests *Limiter) {
+	g.client = limitClient(g.client, upload, download, requests)
+}
+
+func init() {
+	Register("gs", openGCS)
+}
+
+// openGCS opens targets like gs://bucket/root, taking the options:
+//
+//	gcs-endpoint  endpoint of the JSON API, defaults to STORAGE_EMULATOR_HOST or GCSEndpoint
+//	credentials   JSON key file of a service account, defaults to GOOGLE_APPLICATION_CREDENTIALS
+//	retries       times a request is attempted before giving up
+//	retry-delay   base delay between attempts, such as 200ms
+//
+// The endpoint option is left to S3, as the -endpoint flag gives it to every target.
+// Requests towards an emulator set by STORAGE_EMULATOR_HOST are not authorized unless credentials
+// are given.
+func openGCS(u *url.URL) (SaveFetcher, string, error) {
+	q := u.Query()
+	if u.Host == "" {
+		return nil, "", errors.New("Expected a target like gs://bucket/root, got: " + u.String())
+	}
+	g := NewGCS(u.Host)
+	emulator := os.Getenv("STORAGE_EMULATOR_HOST")
+	if emulator != "" {
+		if !strings.Contains(emulator, "://") {
+			emulator = "http://" + emulator
+		}
+		g.Endpoint = emulator
+	}
+	if v := q.Get("gcs-endpoint"); v != "" {
+		g.Endpoint = v
+	}
+	var err error
+	if v := q.Get("retries"); v != "" {
+		if g.Retry.Attempts, err = strconv.Atoi(v); err != nil {
+			return nil, "", fmt.Errorf("Invalid retries %q", v)
+		}
+	}
+	if v := q.Get("retry-delay"); v != "" {
+		if g.Retry.Delay, err = time.ParseDuration(v); err != nil {
+			return nil, "", fmt.Errorf("Invalid retry-delay %q", v)
+		}
+	}
+	filename := q.Get("credentials")
+	if filename == "" {
+		filename = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	switch {
+	case filename != "":
+		key, err := ReadServiceAccountKey(filename)
+		if err != nil {
+			return nil, "", err
+		}
+		g.Tokens = NewServiceAccountTokens(key)
+	case emulator == "":
+		return nil, "", errors.New("No Google credentials found, set GOOGLE_APPLICATION_CREDENTIALS to the key file of a service account")
+	}
+	return g, strings.Trim(u.Path, "/"), nil
+}
+
+// objectURL returns the url of the object on path, with the query given.
+func (g *GCS) objectURL(path string, query url.Values) string {
+	u := strings.TrimRight(g.Endpoint, "/") + "/storage/v1/b/" + url.PathEscape(g.Bucket) + "/o"
+	if path != "" {
+		u += "/" + url.PathEscape(strings.TrimLeft(path, "/"))
+	}
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+// do sends an authorized request with body, retrying according to the policy.
+func (g *GCS) do(method, u string, body []byte, header http.Header) (*http.Response, error) {
+	return g.Retry.Do(g.client, func() (*http.Request, error) {
+		req, err := http.NewRequest(method, u, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		return req, bearer(req, g.Tokens)
+	})
+}
+
+// gcsError returns the error of an unexpected response, closing its body.
+func gcsError(resp *http.Response, op, path string) error {
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return &os.PathError{Op: op, Path: path, Err: os.ErrNotExist}
+	}
+	var e struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, int64(64*KB)))
+	if json.Unmarshal(b, &e) == nil && e.Error.Message != "" {
+		return fmt.Errorf("Could not %s %s: (%d) %s", op, path, resp.StatusCode, e.Error.Message)
+	}
+	return fmt.Errorf("Could not %s %s: (%d)\n%s", op, path, resp.StatusCode, string(b))
+}
+
+func (g *GCS) Save(path string) (io.WriteCloser, error) {
+	return g.SaveTags(path, nil)
+}
+
+// SaveTags saves the tags as custom metadata of the object.
+func (g *GCS) SaveTags(path string, tags Tagger) (io.WriteCloser, error) {
+	w := &gcsWriter{g: g, path: strings.TrimLeft(path, "/"), chunkSize: int(DefaultGCSChunkSize)}
+	if g.ChunkSize >= gcsChunkAlign {
+		w.chunkSize = int(g.ChunkSize / gcsChunkAlign * gcsChunkAlign)
+	}
+	if tags != nil {
+		w.tags = tags.Tags()
+	}
+	return w, nil
+}
+
+// gcsWriter buffers an object, sending it in chunks of a resumable upload. The upload is started
+// once the first chunk is sent and the object is created when the last one is.
+type gcsWriter struct {
+	g         *GCS
+	path      string
+	tags      map[string]string
+	chunkSize int
+	session   string
+	buf       bytes.Buffer
+	sent      int64
+	done      bool
+	err       error
+}
+
+func (w *gcsWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buf.Write(p)
+	// Keep some data buffered, as the last chunk has to tell the size of the object.
+	for w.buf.Len() > w.chunkSize {
+		n, err := w.send(w.buf.Bytes()[:w.chunkSize], false)
+		if err != nil {
+			w.err = err
+			return 0, err
+		}
+		// What GCS didn't keep is sent again with the next chunk.
+		w.buf.Next(n)
+	}
+	return len(p), nil
+}
+
+func (w *gcsWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	for !w.done {
+		n, err := w.send(w.buf.Bytes(), true)
+		if err != nil {
+			w.err = err
+			return err
+		}
+		w.buf.Next(n)
+	}
+	w.err = errors.New("Write on closed GCS object")
+	return nil
+}
+
+// Abort cancels the upload session, discarding the chunks sent so far.
+func (w *gcsWriter) Abort() error {
+	w.err = errors.New("Write on aborted GCS object")
+	if w.session == "" || w.done {
+		return nil
+	}
+	resp, err := w.g.do("DELETE", w.session, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// start starts the resumable upload, the session is the url chunks are sent to.
+func (w *gcsWriter) start() error {
+	metadata, _ := json.Marshal(map[string]interface{}{"name": w.path, "metadata": limitTags(w.tags, int(maxGCSMetadata))})
+	u := strings.TrimRight(w.g.Endpoint, "/") + "/upload/storage/v1/b/" + url.PathEscape(w.g.Bucket) + "/o?" +
+		url.Values{"uploadType": {"resumable"}, "name": {w.path}}.Encode()
+	resp, err := w.g.do("POST", u, metadata, http.Header{"Content-Type": {"application/json; charset=UTF-8"}})
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return gcsError(resp, "upload", w.path)
+	}
+	resp.Body.Close()
+	if w.session = resp.Header.Get("Location"); w.session == "" {
+		return fmt.Errorf("No upload session for %s in the response", w.path)
+	}
+	return nil
+}
+
+// send sends a chunk of the upload, the last one completing it. It returns how much of the chunk GCS
+// kept, as told by the Range header of a 308 response, the rest having to be sent again.
+func (w *gcsWriter) send(chunk []byte, last bool) (int, error) {
+	if w.session == "" {
+		if err := w.start(); err != nil {
+			return 0, err
+		}
+	}
+	size := "*"
+	if last {
+		size = strconv.FormatInt(w.sent+int64(len(chunk)), 10)
+	}
+	rng := "bytes */" + size
+	if len(chunk) > 0 {
+		rng = fmt.Sprintf("bytes %d-%d/%s", w.sent, w.sent+int64(len(chunk))-1, size)
+	}
+	resp, err := w.g.do("PUT", w.session, chunk, http.Header{"Content-Range": {rng}})
+	if err != nil {
+		return 0, err
+	}
+	switch code := resp.StatusCode; {
+	case code == http.StatusPermanentRedirect:
+		// 308 Resume Incomplete, the Range header tells what was kept of the upload, nothing without it.
+		resp.Body.Close()
+		kept := int64(0)
+		if v := resp.Header.Get("Range"); v != "" {
+			end, err := strconv.ParseInt(strings.TrimPrefix(v, "bytes=0-"), 10, 64)
+			if err != nil || !strings.HasPrefix(v, "bytes=0-") {
+				return 0, fmt.Errorf("Invalid range %q uploading %s", v, w.path)
+			}
+			kept = end + 1
+		}
+		// Going on without anything more kept would never end.
+		n := kept - w.sent
+		if n <= 0 || n > int64(len(chunk)) {
+			return 0, fmt.Errorf("GCS kept %d bytes of %s, after %d were sent", kept, w.path, w.sent+int64(len(chunk)))
+		}
+		w.sent = kept
+		return int(n), nil
+	case last && (code == http.StatusOK || code == http.StatusCreated):
+		resp.Body.Close()
+		w.sent += int64(len(chunk))
+		w.done = true
+		return len(chunk), nil
+	default:
+		return 0, gcsError(resp, "upload", w.path)
+	}
+}
+
+// Fetch returns the object, failing at the end if it doesn't match the MD5 hash GCS has of it.
+func (g *GCS) Fetch(path string) (io.ReadCloser, error) {
+	resp, err := g.do("GET", g.objectURL(path, url.Values{"alt": {"media"}}), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, gcsError(resp, "fetch", path)
+	}
+	// X-Goog-Hash holds crc32c and md5 hashes, composite objects have no md5 though.
+	for _, h := range strings.Split(strings.Join(resp.Header["X-Goog-Hash"], ","), ",") {
+		if v := strings.TrimSpace(h); strings.HasPrefix(v, "md5=") {
+			if sum, err := base64.StdEncoding.DecodeString(v[len("md5="):]); err == nil && len(sum) == md5.Size {
+				return &verifyingReader{resp.Body, md5.New(), sum, path, "MD5"}, nil
+			}
+		}
+	}
+	return resp.Body, nil
+}
+
+// gcsObject is the metadata of an object, as listed and stated.
+type gcsObject struct {
+	Name         string            `json:"name"`
+	Size         string            `json:"size"`
+	Updated      time.Time         `json:"updated"`
+	ETag         string            `json:"etag"`
+	StorageClass string            `json:"storageClass"`
+	Metadata     map[string]string `json:"metadata"`
+}
+
+func (g *GCS) Walk(p string, walkfn WalkFunc) error {
+	p = strings.TrimLeft(p, "/")
+	if p != "" && !strings.HasSuffix(p, "/") {
+		p += "/"
+	}
+	query := url.Values{"prefix": {p}, "fields": {"items(name),nextPageToken"}}
+	for {
+		resp, err := g.do("GET", g.objectURL("", query), nil, nil)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return gcsError(resp, "list", p)
+		}
+		var list struct {
+			Items         []gcsObject `json:"items"`
+			NextPageToken string      `json:"nextPageToken"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		for _, o := range list.Items {
+			if err := walkfn(o.Name, nil); err != nil {
+				return err
+			}
+		}
+		if list.NextPageToken == "" {
+			return nil
+		}
+		query.Set("pageToken", list.NextPageToken)
+	}
+}
+
+// Stat returns the info of the object, having the custom metadata as tags.
+func (g *GCS) Stat(path string) (ObjectInfo, error) {
+	resp, err := g.do("GET", g.objectURL(path, nil), nil, nil)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return ObjectInfo{}, gcsError(resp, "stat", path)
+	}
+	var o gcsObject
+	err = json.NewDecoder(resp.Body).Decode(&o)
+	resp.Body.Close()
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	size, _ := strconv.ParseInt(o.Size, 10, 64)
+	return ObjectInfo{
+		Path:         o.Name,
+		Size:         size,
+		ModTime:      o.Updated,
+		ETag:         o.ETag,
+		Tags:         o.Metadata,
+		StorageClass: o.StorageClass,
+	}, nil
+}
+
+func (g *GCS) Delete(path string) error {
+	resp, err := g.do("DELETE", g.objectURL(path, nil), nil, nil)
+	if err != nil {
+		return err
+	}
+	if code := resp.StatusCode; code != http.StatusNoContent && code != http.StatusOK {
+		return gcsError(resp, "delete", path)
+	}
+	resp.Body.Close()
+	return nil
+}
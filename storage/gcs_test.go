@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"bytes"
+	"github.com/duego/mongotool/storage/gcstest"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGCS(t *testing.T) {
+	Convey("Given a GCS bucket and the key of a service account", t, func() {
+		srv := gcstest.NewServer()
+		defer srv.Close()
+		srv.CreateBucket("mongotool")
+		dir, err := ioutil.TempDir("", "mongotool")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		keyFile := filepath.Join(dir, "key.json")
+		So(ioutil.WriteFile(keyFile, srv.ServiceAccountKey("dump@project.iam.gserviceaccount.com"), 0600), ShouldBeNil)
+
+		u, _ := url.Parse("gs://mongotool/dump?gcs-endpoint=" + url.QueryEscape(srv.URL) + "&credentials=" + url.QueryEscape(keyFile))
+		s, root, err := openGCS(u)
+		So(err, ShouldBeNil)
+		So(root, ShouldEqual, "dump")
+		store := s.(*GCS)
+		store.ChunkSize = 256 * KB
+		store.Retry = RetryPolicy{Attempts: 3, Delay: time.Millisecond}
+
+		save := func(path string, data []byte) error {
+			w, err := SaveTagged(store, path, Tags{"database": "test"})
+			if err != nil {
+				return err
+			}
+			w.Write(data)
+			return w.Close()
+		}
+		fetch := func(path string) ([]byte, error) {
+			r, err := store.Fetch(path)
+			if err != nil {
+				return nil, err
+			}
+			defer r.Close()
+			return ioutil.ReadAll(r)
+		}
+
+		Convey("Objects should be uploaded in chunks with authorized requests", func() {
+			large := bytes.Repeat([]byte("mongotool"), 100000)
+			So(save("dump/large", large), ShouldBeNil)
+			b, err := fetch("dump/large")
+			So(err, ShouldBeNil)
+			So(bytes.Equal(b, large), ShouldBeTrue)
+			So(srv.Uploads(), ShouldEqual, 0)
+			// A token, starting the upload and 4 chunks, the last one holding what is left.
+			So(srv.Requests(), ShouldEqual, 1+1+4+1)
+
+			info, err := store.Stat("dump/large")
+			So(err, ShouldBeNil)
+			So(info.Size, ShouldEqual, len(large))
+			So(info.Tags, ShouldResemble, map[string]string{"database": "test"})
+		})
+
+		Convey("Parts of chunks GCS didn't keep should be sent again", func() {
+			large := bytes.Repeat([]byte("mongotool"), 100000)
+			store.ChunkSize = 512 * KB
+			srv.KeepPartial(2)
+			So(save("dump/large", large), ShouldBeNil)
+			b, err := fetch("dump/large")
+			So(err, ShouldBeNil)
+			So(bytes.Equal(b, large), ShouldBeTrue)
+			So(srv.Uploads(), ShouldEqual, 0)
+		})
+
+		Convey("Transient errors should be retried", func() {
+			So(save("dump/a", []byte("foo")), ShouldBeNil)
+			srv.FailNext(2, http.StatusServiceUnavailable)
+			b, err := fetch("dump/a")
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "foo")
+		})
+
+		Convey("Listing should go through every page", func() {
+			srv.PageSize = 2
+			for _, name := range []string{"dump/a", "dump/b", "dump/c", "dumpster/d"} {
+				So(save(name, []byte(name)), ShouldBeNil)
+			}
+			var found []string
+			So(store.Walk("dump", func(p string, err error) error {
+				found = append(found, p)
+				return err
+			}), ShouldBeNil)
+			So(found, ShouldResemble, []string{"dump/a", "dump/b", "dump/c"})
+		})
+
+		Convey("An unknown service account should not get a token", func() {
+			other := gcstest.NewServer()
+			defer other.Close()
+			So(ioutil.WriteFile(keyFile, other.ServiceAccountKey("dump@project.iam.gserviceaccount.com"), 0600), ShouldBeNil)
+			key, err := ReadServiceAccountKey(keyFile)
+			So(err, ShouldBeNil)
+			key.TokenURI = srv.URL + "/token"
+			store.Tokens = NewServiceAccountTokens(key)
+			_, err = fetch("dump/a")
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Opening GCS without credentials should fail", t, func() {
+		defer setenv(map[string]string{"GOOGLE_APPLICATION_CREDENTIALS": "", "STORAGE_EMULATOR_HOST": ""})()
+		u, _ := url.Parse("gs://mongotool/dump")
+		_, _, err := openGCS(u)
+		So(err, ShouldNotBeNil)
+	})
+}
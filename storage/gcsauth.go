@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GCSScope is the OAuth 2.0 scope of access tokens for reading and writing objects of Google Cloud Storage.
+const GCSScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// defaultTokenURI is where access tokens are requested unless the service account key tells otherwise.
+const defaultTokenURI = "https://oauth2.googleapis.com/token"
+
+// TokenSource provides the OAuth 2.0 access tokens requests towards Google Cloud are authorized with.
+type TokenSource interface {
+	Token() (string, error)
+}
+
+// ServiceAccountKey is the JSON key file of a Google Cloud service account, as created by:
+// gcloud iam service-accounts keys create
+type ServiceAccountKey struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// ReadServiceAccountKey reads the JSON key file of a service account.
+func ReadServiceAccountKey(filename string) (ServiceAccountKey, error) {
+	var key ServiceAccountKey
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return key, err
+	}
+	if err := json.Unmarshal(b, &key); err != nil {
+		return key, fmt.Errorf("Invalid service account key %s: %v", filename, err)
+	}
+	if key.Type != "service_account" || key.ClientEmail == "" || key.PrivateKey == "" {
+		return key, fmt.Errorf("%s is not the key of a service account", filename)
+	}
+	return key, nil
+}
+
+// ServiceAccountTokens exchanges JWTs signed with the key of a service account for access tokens,
+// caching them until they are about to expire.
+type ServiceAccountTokens struct {
+	Key   ServiceAccountKey
+	Scope string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// NewServiceAccountTokens returns the tokens of a service account for the GCSScope.
+func NewServiceAccountTokens(key ServiceAccountKey) *ServiceAccountTokens {
+	return &ServiceAccountTokens{Key: key, Scope: GCSScope}
+}
+
+func (s *ServiceAccountTokens) Token() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && time.Now().Add(time.Minute).Before(s.expires) {
+		return s.token, nil
+	}
+	tokenURI := s.Key.TokenURI
+	if tokenURI == "" {
+		tokenURI = defaultTokenURI
+	}
+	assertion, err := s.assertion(tokenURI, time.Now())
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.PostForm(tokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	})
+	if err != nil {
+		return "", err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return "", err
+	}
+	if code := resp.StatusCode; code != http.StatusOK {
+		return "", fmt.Errorf("Could not get an access token for %s: (%d)\n%s", s.Key.ClientEmail, code, string(body))
+	}
+	result := struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}{}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", err
+	}
+	if result.AccessToken == "" {
+		return "", fmt.Errorf("No access token for %s in the response", s.Key.ClientEmail)
+	}
+	s.token = result.AccessToken
+	s.expires = time.Now().Add(time.Duration(result.ExpiresIn) * time.Second)
+	return s.token, nil
+}
+
+// assertion returns the JWT asking tokenURI for an access token, signed with RS256 by the private key.
+func (s *ServiceAccountTokens) assertion(tokenURI string, now time.Time) (string, error) {
+	key, err := parsePrivateKey(s.Key.PrivateKey)
+	if err != nil {
+		return "", err
+	}
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": s.Key.PrivateKeyID})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   s.Key.ClientEmail,
+		"scope": s.Scope,
+		"aud":   tokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
+
+// parsePrivateKey parses the PEM encoded RSA key of a service account, PKCS #8 or PKCS #1.
+func parsePrivateKey(s string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, errors.New("Invalid private key of service account, expected PEM")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid private key of service account: %v", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("Invalid private key of service account, expected RSA")
+	}
+	return key, nil
+}
+
+// bearer authorizes req with a token of tokens, unless tokens is nil.
+func bearer(req *http.Request, tokens TokenSource) error {
+	if tokens == nil {
+		return nil
+	}
+	token, err := tokens.Token()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(token))
+	return nil
+}
@@ -0,0 +1,420 @@
+// Package gcstest implements an in-process Google Cloud Storage server for testing, serving the parts
+// of the JSON API used by the storage package.
+//
+// It supports resumable uploads, media and metadata GET, paginated listing and DELETE of objects.
+// Access tokens are handed out for JWTs signed by the keys of service accounts made by
+// ServiceAccountKey, and every other request has to be authorized with one of them.
+// Errors can be injected to test retries.
+package gcstest
+
+import (
+	"crypto"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Object is an object saved on the server.
+type Object struct {
+	Data     []byte
+	Metadata map[string]string
+	ModTime  time.Time
+}
+
+type upload struct {
+	bucket, name string
+	metadata     map[string]string
+	data         []byte
+}
+
+// Server is a Google Cloud Storage server listening on a local address, see httptest.Server.
+type Server struct {
+	*httptest.Server
+
+	// PageSize is how many objects a listing returns at most, 1000 unless set.
+	PageSize int
+	// AllowUnauthenticated accepts requests without an access token.
+	AllowUnauthenticated bool
+
+	mu       sync.Mutex
+	buckets  map[string]map[string]*Object
+	uploads  map[string]*upload
+	keys     map[string]*rsa.PublicKey
+	tokens   map[string]bool
+	nextID   int
+	requests int
+	failures int
+	failCode int
+	partial  int
+}
+
+// NewServer starts a server without any buckets. Close it when done.
+func NewServer() *Server {
+	s := &Server{
+		PageSize: 1000,
+		buckets:  make(map[string]map[string]*Object),
+		uploads:  make(map[string]*upload),
+		keys:     make(map[string]*rsa.PublicKey),
+		tokens:   make(map[string]bool),
+	}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// CreateBucket creates an empty bucket unless it already exists.
+func (s *Server) CreateBucket(bucket string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.buckets[bucket] == nil {
+		s.buckets[bucket] = make(map[string]*Object)
+	}
+}
+
+// ServiceAccountKey returns the JSON key file of a new service account, getting access tokens from
+// the server.
+func (s *Server) ServiceAccountKey(email string) []byte {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	s.mu.Lock()
+	s.keys[email] = &key.PublicKey
+	s.mu.Unlock()
+	b, _ := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"client_email":   email,
+		"private_key_id": "gcstest",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":      s.URL + "/token",
+	})
+	return b
+}
+
+// PutObject saves an object, creating the bucket if needed.
+func (s *Server) PutObject(bucket, name string, data []byte) {
+	s.CreateBucket(bucket)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buckets[bucket][name] = &Object{Data: data, ModTime: time.Now().UTC()}
+}
+
+// Object returns the object saved under name in bucket.
+func (s *Server) Object(bucket, name string) (*Object, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.buckets[bucket][name]
+	return o, ok
+}
+
+// Uploads returns how many resumable uploads were started but not completed.
+func (s *Server) Uploads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.uploads)
+}
+
+// Requests returns how many requests the server received, token requests included.
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// FailNext makes the next n requests fail with the HTTP status code.
+func (s *Server) FailNext(n, code int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures, s.failCode = n, code
+}
+
+// KeepPartial makes the next n chunks of uploads only keep their first 256KB, as GCS may do.
+func (s *Server) KeepPartial(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.partial = n
+}
+
+// writeError writes an error response the way the JSON API does.
+func writeError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{"code": code, "message": message},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(v)
+}
+
+var (
+	objectPath = regexp.MustCompile(`^/storage/v1/b/([^/]+)/o(?:/(.+))?$`)
+	uploadPath = regexp.MustCompile(`^/upload/storage/v1/b/([^/]+)/o$`)
+	rangeRegex = regexp.MustCompile(`^bytes (?:(\d+)-(\d+)|\*)/(\d+|\*)$`)
+)
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	if s.failures > 0 {
+		s.failures--
+		writeError(w, s.failCode, "Injected by gcstest")
+		return
+	}
+	if r.URL.Path == "/token" {
+		form, _ := url.ParseQuery(string(body))
+		s.token(w, form)
+		return
+	}
+	if !s.AllowUnauthenticated && !s.tokens[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")] {
+		writeError(w, http.StatusUnauthorized, "Invalid Credentials")
+		return
+	}
+
+	path := r.URL.EscapedPath()
+	q := r.URL.Query()
+	if m := uploadPath.FindStringSubmatch(path); m != nil {
+		s.upload(w, r, q, m[1], body)
+		return
+	}
+	m := objectPath.FindStringSubmatch(path)
+	if m == nil {
+		writeError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	bucket, _ := url.PathUnescape(m[1])
+	name, _ := url.PathUnescape(m[2])
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		writeError(w, http.StatusNotFound, "The specified bucket does not exist.")
+		return
+	}
+	switch {
+	case name == "" && r.Method == "GET":
+		s.list(w, objects, q)
+	case r.Method == "GET":
+		o, ok := objects[name]
+		if !ok {
+			writeError(w, http.StatusNotFound, "No such object: "+bucket+"/"+name)
+			return
+		}
+		if q.Get("alt") != "media" {
+			writeJSON(w, metadata(bucket, name, o))
+			return
+		}
+		md5sum := md5.Sum(o.Data)
+		crc := crc32.Checksum(o.Data, crc32.MakeTable(crc32.Castagnoli))
+		w.Header().Set("X-Goog-Hash", fmt.Sprintf("crc32c=%s,md5=%s",
+			base64.StdEncoding.EncodeToString([]byte{byte(crc >> 24), byte(crc >> 16), byte(crc >> 8), byte(crc)}),
+			base64.StdEncoding.EncodeToString(md5sum[:])))
+		w.Header().Set("Content-Length", strconv.Itoa(len(o.Data)))
+		w.Write(o.Data)
+	case r.Method == "DELETE" && name != "":
+		if _, ok := objects[name]; !ok {
+			writeError(w, http.StatusNotFound, "No such object: "+bucket+"/"+name)
+			return
+		}
+		delete(objects, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Unsupported request")
+	}
+}
+
+// token hands out an access token for a JWT signed by the key of a service account.
+func (s *Server) token(w http.ResponseWriter, form url.Values) {
+	if form.Get("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+		writeError(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+	parts := strings.Split(form.Get("assertion"), ".")
+	if len(parts) != 3 {
+		writeError(w, http.StatusBadRequest, "invalid_grant: malformed JWT")
+		return
+	}
+	var header struct{ Alg string }
+	var claims struct {
+		Iss, Scope, Aud string
+		Exp             int64
+	}
+	hb, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	cb, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	if json.Unmarshal(hb, &header) != nil || json.Unmarshal(cb, &claims) != nil || header.Alg != "RS256" {
+		writeError(w, http.StatusBadRequest, "invalid_grant: malformed JWT")
+		return
+	}
+	key := s.keys[claims.Iss]
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if key == nil || rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig) != nil {
+		writeError(w, http.StatusBadRequest, "invalid_grant: Invalid JWT Signature.")
+		return
+	}
+	if claims.Aud != s.URL+"/token" || claims.Scope == "" || time.Unix(claims.Exp, 0).Before(time.Now()) {
+		writeError(w, http.StatusBadRequest, "invalid_grant: Invalid JWT claims.")
+		return
+	}
+	s.nextID++
+	token := fmt.Sprintf("gcstest-token-%d", s.nextID)
+	s.tokens[token] = true
+	writeJSON(w, map[string]interface{}{"access_token": token, "expires_in": 3600, "token_type": "Bearer"})
+}
+
+// upload starts resumable uploads and receives their chunks. Every chunk but the last one has to be
+// a multiple of 256KB, and chunks must follow each other, although resending received data is fine.
+func (s *Server) upload(w http.ResponseWriter, r *http.Request, q url.Values, bucket string, body []byte) {
+	bucket, _ = url.PathUnescape(bucket)
+	if _, ok := s.buckets[bucket]; !ok {
+		writeError(w, http.StatusNotFound, "The specified bucket does not exist.")
+		return
+	}
+	if q.Get("uploadType") != "resumable" {
+		writeError(w, http.StatusBadRequest, "Only resumable uploads are supported")
+		return
+	}
+	if r.Method == "POST" {
+		var meta struct {
+			Name     string            `json:"name"`
+			Metadata map[string]string `json:"metadata"`
+		}
+		if err := json.Unmarshal(body, &meta); err != nil && len(body) > 0 {
+			writeError(w, http.StatusBadRequest, "Invalid metadata")
+			return
+		}
+		name := q.Get("name")
+		if name == "" {
+			name = meta.Name
+		}
+		if name == "" {
+			writeError(w, http.StatusBadRequest, "Required object name")
+			return
+		}
+		s.nextID++
+		id := strconv.Itoa(s.nextID)
+		s.uploads[id] = &upload{bucket, name, meta.Metadata, nil}
+		w.Header().Set("Location", s.URL+"/upload/storage/v1/b/"+url.PathEscape(bucket)+"/o?uploadType=resumable&upload_id="+id)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	u, ok := s.uploads[q.Get("upload_id")]
+	if r.Method == "DELETE" && ok {
+		// A cancelled upload is answered with the non standard 499.
+		delete(s.uploads, q.Get("upload_id"))
+		w.WriteHeader(499)
+		return
+	}
+	if r.Method != "PUT" || !ok {
+		writeError(w, http.StatusNotFound, "No such upload")
+		return
+	}
+	m := rangeRegex.FindStringSubmatch(r.Header.Get("Content-Range"))
+	if m == nil {
+		writeError(w, http.StatusBadRequest, "Invalid Content-Range")
+		return
+	}
+	if m[1] != "" {
+		start, _ := strconv.Atoi(m[1])
+		end, _ := strconv.Atoi(m[2])
+		if end-start+1 != len(body) || start > len(u.data) {
+			writeError(w, http.StatusBadRequest, "Content-Range does not match the data received")
+			return
+		}
+		if m[3] == "*" && len(body)%(256<<10) != 0 {
+			writeError(w, http.StatusBadRequest, "Chunks must be a multiple of 256KB")
+			return
+		}
+		if s.partial > 0 && len(body) > 256<<10 {
+			s.partial--
+			u.data = append(u.data[:start], body[:256<<10]...)
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(u.data)-1))
+			w.WriteHeader(http.StatusPermanentRedirect)
+			return
+		}
+		u.data = append(u.data[:start], body...)
+	}
+	if m[3] == "*" {
+		if len(u.data) > 0 {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(u.data)-1))
+		}
+		w.WriteHeader(http.StatusPermanentRedirect)
+		return
+	}
+	if size, _ := strconv.Atoi(m[3]); size != len(u.data) {
+		writeError(w, http.StatusBadRequest, "Size does not match the data received")
+		return
+	}
+	o := &Object{Data: u.data, Metadata: u.metadata, ModTime: time.Now().UTC()}
+	s.buckets[u.bucket][u.name] = o
+	delete(s.uploads, q.Get("upload_id"))
+	writeJSON(w, metadata(u.bucket, u.name, o))
+}
+
+// list writes one page of the objects whose names start with the prefix.
+func (s *Server) list(w http.ResponseWriter, objects map[string]*Object, q url.Values) {
+	prefix := q.Get("prefix")
+	var names []string
+	for name := range objects {
+		if strings.HasPrefix(name, prefix) && name > q.Get("pageToken") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	size := s.PageSize
+	if v, err := strconv.Atoi(q.Get("maxResults")); err == nil && v > 0 && v < size {
+		size = v
+	}
+	result := map[string]interface{}{"kind": "storage#objects"}
+	if len(names) > size {
+		names = names[:size]
+		result["nextPageToken"] = names[size-1]
+	}
+	items := make([]map[string]interface{}, len(names))
+	for i, name := range names {
+		items[i] = metadata("", name, objects[name])
+	}
+	result["items"] = items
+	writeJSON(w, result)
+}
+
+// metadata returns the resource of an object as served by the JSON API.
+func metadata(bucket, name string, o *Object) map[string]interface{} {
+	sum := md5.Sum(o.Data)
+	m := map[string]interface{}{
+		"kind":         "storage#object",
+		"name":         name,
+		"size":         strconv.Itoa(len(o.Data)),
+		"updated":      o.ModTime.Format(time.RFC3339Nano),
+		"md5Hash":      base64.StdEncoding.EncodeToString(sum[:]),
+		"etag":         base64.StdEncoding.EncodeToString(sum[:8]),
+		"storageClass": "STANDARD",
+	}
+	if bucket != "" {
+		m["bucket"] = bucket
+	}
+	if len(o.Metadata) > 0 {
+		m["metadata"] = o.Metadata
+	}
+	return m
+}
@@ -0,0 +1,72 @@
+package gcstest
+
+import (
+	"bytes"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	Convey("Given a server with objects", t, func() {
+		srv := NewServer()
+		defer srv.Close()
+		srv.PutObject("bucket", "dump/a", []byte("foo"))
+		srv.PutObject("bucket", "dump/b", []byte("bar"))
+
+		get := func(path string) (*http.Response, string) {
+			resp, err := http.Get(srv.URL + path)
+			So(err, ShouldBeNil)
+			defer resp.Body.Close()
+			b, _ := ioutil.ReadAll(resp.Body)
+			return resp, string(b)
+		}
+
+		Convey("Requests without an access token should be refused", func() {
+			resp, _ := get("/storage/v1/b/bucket/o/dump%2Fa?alt=media")
+			So(resp.StatusCode, ShouldEqual, http.StatusUnauthorized)
+		})
+
+		Convey("Given unauthenticated requests are allowed", func() {
+			srv.AllowUnauthenticated = true
+
+			Convey("Objects should be served with their hashes", func() {
+				resp, body := get("/storage/v1/b/bucket/o/dump%2Fa?alt=media")
+				So(resp.StatusCode, ShouldEqual, http.StatusOK)
+				So(body, ShouldEqual, "foo")
+				So(resp.Header.Get("X-Goog-Hash"), ShouldContainSubstring, "md5=rL0Y20zC+Fzt72VPzMSk2A==")
+			})
+
+			Convey("Listings should be paginated", func() {
+				srv.PageSize = 1
+				_, body := get("/storage/v1/b/bucket/o?prefix=dump/")
+				So(body, ShouldContainSubstring, `"nextPageToken":"dump/a"`)
+				_, body = get("/storage/v1/b/bucket/o?prefix=dump/&pageToken=dump/a")
+				So(body, ShouldContainSubstring, `"name":"dump/b"`)
+				So(body, ShouldNotContainSubstring, "nextPageToken")
+			})
+
+			Convey("Chunks of resumable uploads should be aligned", func() {
+				resp, err := http.Post(srv.URL+"/upload/storage/v1/b/bucket/o?uploadType=resumable&name=c", "application/json", nil)
+				So(err, ShouldBeNil)
+				session := resp.Header.Get("Location")
+				So(session, ShouldNotBeEmpty)
+				req, _ := http.NewRequest("PUT", session, bytes.NewReader([]byte("foo")))
+				req.Header.Set("Content-Range", "bytes 0-2/*")
+				resp, err = http.DefaultClient.Do(req)
+				So(err, ShouldBeNil)
+				So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+				So(srv.Uploads(), ShouldEqual, 1)
+			})
+
+			Convey("Injected errors should be returned", func() {
+				srv.FailNext(1, http.StatusServiceUnavailable)
+				resp, _ := get("/storage/v1/b/bucket/o/dump%2Fa")
+				So(resp.StatusCode, ShouldEqual, http.StatusServiceUnavailable)
+				resp, _ = get("/storage/v1/b/bucket/o/dump%2Fa")
+				So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			})
+		})
+	})
+}
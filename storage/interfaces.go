@@ -31,8 +31,36 @@ type Tagger interface {
 	Tags() map[string]string
 }
 
+// TagSaver is a storage that can save tags along with objects, such as S3 object tags and metadata.
+type TagSaver interface {
+	SaveTags(path string, tags Tagger) (io.WriteCloser, error)
+}
+
+// Aborter is a writer that can give up saving an object, discarding what was written instead of saving
+// it like Close would, such as the parts of a S3 multipart upload or a temporary file.
+type Aborter interface {
+	Abort() error
+}
+
 type Walker interface {
 	Walk(path string, walkfn WalkFunc) error
 }
 
 type WalkFunc func(fpath string, err error) error
+
+// Stater is a storage that can tell the size and modification time of an object.
+// Missing objects give an error satisfying os.IsNotExist.
+type Stater interface {
+	Stat(path string) (ObjectInfo, error)
+}
+
+// Restorer is a storage archiving objects, which have to be restored before they are fetched.
+// Stat tells when an object is archived.
+type Restorer interface {
+	Restore(path string, days int, tier string) error
+}
+
+// Deleter is a storage that objects can be deleted from.
+type Deleter interface {
+	Delete(path string) error
+}
@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"bytes"
+	"github.com/duego/mongotool/storage/s3test"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestObjectLock(t *testing.T) {
+	Convey("Parsing object lock", t, func() {
+		lock, err := NewObjectLock("governance", "2160h", false)
+		So(err, ShouldBeNil)
+		So(lock.Mode, ShouldEqual, LockGovernance)
+		So(lock.RetainUntil, ShouldHappenWithin, time.Minute, time.Now().Add(2160*time.Hour))
+
+		lock, err = NewObjectLock("COMPLIANCE", "2099-01-01T00:00:00Z", true)
+		So(err, ShouldBeNil)
+		So(lock.RetainUntil, ShouldResemble, time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC))
+		So(lock.LegalHold, ShouldBeTrue)
+
+		lock, err = NewObjectLock("", "", true)
+		So(err, ShouldBeNil)
+		So(lock.enabled(), ShouldBeTrue)
+
+		_, err = NewObjectLock("governance", "", false)
+		So(err, ShouldNotBeNil)
+		_, err = NewObjectLock("", "24h", false)
+		So(err, ShouldNotBeNil)
+		_, err = NewObjectLock("compliance", "2001-01-01T00:00:00Z", false)
+		So(err, ShouldNotBeNil)
+		_, err = NewObjectLock("compliance", "90 days", false)
+		So(err, ShouldNotBeNil)
+		_, err = NewObjectLock("forever", "24h", false)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Object lock options should be taken from the target", t, func() {
+		u, _ := url.Parse("s3://mongotool/dump?lock-mode=compliance&lock-retain-until=24h&lock-legal-hold=true")
+		store, _, err := openS3(u)
+		So(err, ShouldBeNil)
+		So(store.(*S3).Lock.Mode, ShouldEqual, LockCompliance)
+		So(store.(*S3).Lock.LegalHold, ShouldBeTrue)
+
+		u, _ = url.Parse("s3://mongotool/dump?lock-mode=compliance")
+		_, _, err = openS3(u)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given a S3 bucket with Object Lock", t, func() {
+		srv := s3test.NewServer()
+		defer srv.Close()
+		defer setFakeAwsKeys()()
+		store := NewS3(srv.BucketURL("mongotool"))
+		store.PartSize = MinPartSize
+		store.Lock, _ = NewObjectLock("governance", "24h", true)
+		large := bytes.Repeat([]byte("mongotool"), int(MinPartSize)/4)
+
+		save := func(path string, data []byte) error {
+			w, err := store.Save(path)
+			if err != nil {
+				return err
+			}
+			w.Write(data)
+			return w.Close()
+		}
+
+		Convey("Objects should be retained, also when uploaded in parts", func() {
+			So(save("small", []byte("Foo")), ShouldBeNil)
+			So(save("large", large), ShouldBeNil)
+			for _, key := range []string{"small", "large"} {
+				o, _ := srv.Object("mongotool", key)
+				So(o.Header.Get("X-Amz-Object-Lock-Mode"), ShouldEqual, LockGovernance)
+				So(o.Header.Get("X-Amz-Object-Lock-Retain-Until-Date"), ShouldEqual, store.Lock.RetainUntil.UTC().Format(time.RFC3339))
+				So(o.Header.Get("X-Amz-Object-Lock-Legal-Hold"), ShouldEqual, "ON")
+			}
+			for _, r := range srv.Requests() {
+				if r.Method == "PUT" {
+					So(r.Header.Get("Content-Md5"), ShouldNotBeEmpty)
+					So(r.Header.Get("Authorization"), ShouldContainSubstring, "content-md5")
+				}
+			}
+		})
+
+		Convey("Locked objects should not be deleted or overwritten", func() {
+			So(save("small", []byte("Foo")), ShouldBeNil)
+			So(store.Delete("small"), ShouldNotBeNil)
+			So(save("small", []byte("Bar")), ShouldNotBeNil)
+			So(save("small", large), ShouldNotBeNil)
+			o, _ := srv.Object("mongotool", "small")
+			So(string(o.Data), ShouldEqual, "Foo")
+		})
+	})
+}
@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory implements the SaveFetcher for objects kept in memory, mostly useful for testing.
+// Objects show up once the writer saving them is closed.
+type Memory struct {
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+}
+
+type memoryObject struct {
+	data    []byte
+	modTime time.Time
+	tags    map[string]string
+}
+
+func NewMemory() *Memory {
+	return &Memory{objects: make(map[string]memoryObject)}
+}
+
+// memoryPath cleans up p so that "/a/b" and "a/b" are the same object.
+func memoryPath(p string) string {
+	return strings.TrimLeft(p, "/")
+}
+
+// memoryWriter buffers an object until closed.
+type memoryWriter struct {
+	bytes.Buffer
+	m      *Memory
+	path   string
+	tags   map[string]string
+	closed bool
+}
+
+func (w *memoryWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("Write on closed object")
+	}
+	return w.Buffer.Write(p)
+}
+
+func (w *memoryWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	w.m.mu.Lock()
+	defer w.m.mu.Unlock()
+	w.m.objects[w.path] = memoryObject{w.Bytes(), time.Now(), w.tags}
+	return nil
+}
+
+// Abort drops the object instead of saving it.
+func (w *memoryWriter) Abort() error {
+	w.closed = true
+	return nil
+}
+
+func (m *Memory) Save(path string) (io.WriteCloser, error) {
+	return m.SaveTags(path, nil)
+}
+
+func (m *Memory) SaveTags(path string, tags Tagger) (io.WriteCloser, error) {
+	w := &memoryWriter{m: m, path: memoryPath(path)}
+	if tags != nil {
+		w.tags = make(map[string]string)
+		for k, v := range tags.Tags() {
+			w.tags[k] = v
+		}
+	}
+	return w, nil
+}
+
+func (m *Memory) Fetch(path string) (io.ReadCloser, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	o, ok := m.objects[memoryPath(path)]
+	if !ok {
+		return nil, &os.PathError{Op: "fetch", Path: path, Err: os.ErrNotExist}
+	}
+	return ioutil.NopCloser(bytes.NewReader(o.data)), nil
+}
+
+// Walk calls walkfn for every object under path, sorted by path.
+func (m *Memory) Walk(path string, walkfn WalkFunc) error {
+	prefix := memoryPath(path)
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	m.mu.RLock()
+	var paths []string
+	for p := range m.objects {
+		if strings.HasPrefix(p, prefix) {
+			paths = append(paths, p)
+		}
+	}
+	m.mu.RUnlock()
+
+	sort.Strings(paths)
+	for _, p := range paths {
+		if err := walkfn(p, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Memory) Stat(path string) (ObjectInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	o, ok := m.objects[memoryPath(path)]
+	if !ok {
+		return ObjectInfo{}, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+	}
+	return ObjectInfo{Path: memoryPath(path), Size: int64(len(o.data)), ModTime: o.modTime, Tags: o.tags}, nil
+}
+
+func (m *Memory) Delete(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, memoryPath(path))
+	return nil
+}
+
+var (
+	memoriesMu sync.Mutex
+	memories   = make(map[string]*Memory)
+)
+
+func init() {
+	Register("mem", openMemory)
+}
+
+// openMemory opens mem://name/root targets, the same name giving the same Memory within a process.
+func openMemory(u *url.URL) (SaveFetcher, string, error) {
+	memoriesMu.Lock()
+	defer memoriesMu.Unlock()
+	m, ok := memories[u.Host]
+	if !ok {
+		m = NewMemory()
+		memories[u.Host] = m
+	}
+	return m, u.Path, nil
+}
@@ -0,0 +1,237 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Mirror implements the SaveFetcher for objects saved to several storages at once, each under a root
+// of its own. Saving succeeds once Quorum of the storages have saved an object, or all of them when
+// Quorum is 0. Objects are fetched from the first storage having them, in the order they were added.
+type Mirror struct {
+	Quorum int
+	stores []SaveFetcher
+	roots  []string
+}
+
+func NewMirror(quorum int) *Mirror {
+	return &Mirror{Quorum: quorum}
+}
+
+// Add adds a storage to mirror objects to, under root.
+func (m *Mirror) Add(store SaveFetcher, root string) {
+	m.stores = append(m.stores, store)
+	m.roots = append(m.roots, root)
+}
+
+// quorum returns how many storages have to save an object.
+func (m *Mirror) quorum() int {
+	if m.Quorum <= 0 || m.Quorum > len(m.stores) {
+		return len(m.stores)
+	}
+	return m.Quorum
+}
+
+func (m *Mirror) Save(fpath string) (io.WriteCloser, error) {
+	return m.SaveTags(fpath, nil)
+}
+
+func (m *Mirror) SaveTags(fpath string, tags Tagger) (io.WriteCloser, error) {
+	w := &mirrorWriter{quorum: m.quorum()}
+	for i, store := range m.stores {
+		sw, err := SaveTagged(store, path.Join(m.roots[i], fpath), tags)
+		w.add(sw, err)
+	}
+	if len(w.ws) < w.quorum {
+		w.Abort()
+		return nil, w.err
+	}
+	return w, nil
+}
+
+// mirrorWriter writes to the writers of every storage at once, going on without the ones failing as
+// long as the quorum can still be met.
+// A failed writer is aborted rather than closed, as closing it could save the partial object written
+// to it. Once the quorum can't be met, every writer is aborted.
+type mirrorWriter struct {
+	ws     []io.WriteCloser
+	quorum int
+	// err is the first error of a writer.
+	err error
+}
+
+// add adds a writer, or only its error if it failed.
+func (w *mirrorWriter) add(wc io.WriteCloser, err error) {
+	if err != nil {
+		if w.err == nil {
+			w.err = err
+		}
+		return
+	}
+	w.ws = append(w.ws, wc)
+}
+
+// each calls fn with every writer at the same time, keeping the writers it succeeded with.
+// The failed ones are aborted, unless fn closed them as writers failing to close clean up themselves.
+func (w *mirrorWriter) each(fn func(io.WriteCloser) error, closed bool) error {
+	errs := make([]error, len(w.ws))
+	var wg sync.WaitGroup
+	for i, wc := range w.ws {
+		wg.Add(1)
+		go func(i int, wc io.WriteCloser) {
+			defer wg.Done()
+			errs[i] = fn(wc)
+		}(i, wc)
+	}
+	wg.Wait()
+
+	ws := w.ws
+	w.ws = nil
+	for i, wc := range ws {
+		if errs[i] != nil && !closed {
+			Abort(wc)
+		}
+		w.add(wc, errs[i])
+	}
+	if len(w.ws) < w.quorum {
+		return w.err
+	}
+	return nil
+}
+
+func (w *mirrorWriter) Write(p []byte) (int, error) {
+	err := w.each(func(wc io.WriteCloser) error {
+		n, err := wc.Write(p)
+		if err == nil && n < len(p) {
+			err = io.ErrShortWrite
+		}
+		return err
+	}, false)
+	if err != nil {
+		w.Abort()
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *mirrorWriter) Close() error {
+	if len(w.ws) < w.quorum {
+		return w.err
+	}
+	err := w.each(io.WriteCloser.Close, true)
+	w.ws = nil
+	return err
+}
+
+// Abort aborts the writers of every storage.
+func (w *mirrorWriter) Abort() error {
+	for _, wc := range w.ws {
+		Abort(wc)
+	}
+	w.ws = nil
+	return nil
+}
+
+// first calls fn with every storage and the path of the object on it, until one of them doesn't fail
+// with a missing object.
+func (m *Mirror) first(fpath string, fn func(store SaveFetcher, fpath string) error) error {
+	err := error(&os.PathError{Op: "fetch", Path: fpath, Err: os.ErrNotExist})
+	for i, store := range m.stores {
+		if err = fn(store, path.Join(m.roots[i], fpath)); !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func (m *Mirror) Fetch(fpath string) (r io.ReadCloser, err error) {
+	err = m.first(fpath, func(store SaveFetcher, fpath string) (err error) {
+		r, err = store.Fetch(fpath)
+		return
+	})
+	return
+}
+
+// Stat returns the info of the object on the first storage having it.
+func (m *Mirror) Stat(fpath string) (info ObjectInfo, err error) {
+	err = m.first(fpath, func(store SaveFetcher, fpath string) (err error) {
+		info, err = Stat(store, fpath)
+		return
+	})
+	// The path of the object is the same on the mirror whichever storage has it.
+	info.Path = fpath
+	return
+}
+
+// Restore restores the object on the first storage having it, as that is the one fetched.
+func (m *Mirror) Restore(fpath string, days int, tier string) error {
+	return m.first(fpath, func(store SaveFetcher, fpath string) error {
+		info, err := Stat(store, fpath)
+		if err != nil || !info.Archived {
+			return err
+		}
+		return Restore(store, fpath, days, tier)
+	})
+}
+
+// Delete deletes the object from every storage having it.
+func (m *Mirror) Delete(fpath string) error {
+	for i, store := range m.stores {
+		if err := Delete(store, path.Join(m.roots[i], fpath)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Walk walks the objects of every storage, giving each path once even if several storages have it.
+func (m *Mirror) Walk(p string, walkfn WalkFunc) error {
+	found := make(map[string]bool)
+	for i, store := range m.stores {
+		// Storages such as S3 give paths without the leading slash of a root like /dump.
+		root := strings.Trim(m.roots[i], "/")
+		err := Walk(store, path.Join(m.roots[i], p), func(fpath string, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			fpath = strings.TrimLeft(fpath, "/")
+			if root != "" {
+				fpath = strings.TrimPrefix(fpath, root+"/")
+			}
+			found[fpath] = true
+			return nil
+		})
+		if err != nil {
+			return walkfn(p, err)
+		}
+	}
+	paths := make([]string, 0, len(found))
+	for fpath := range found {
+		paths = append(paths, fpath)
+	}
+	sort.Strings(paths)
+	for _, fpath := range paths {
+		if err := walkfn(fpath, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes every storage.
+func (m *Mirror) Close() error {
+	var err error
+	for _, store := range m.stores {
+		if cerr := Close(store); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
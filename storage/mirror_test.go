@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// fullStorage fails saving any object.
+type fullStorage struct {
+	*Memory
+}
+
+func (f fullStorage) Save(path string) (io.WriteCloser, error) {
+	return nil, errors.New("disk full")
+}
+
+func (f fullStorage) SaveTags(path string, tags Tagger) (io.WriteCloser, error) {
+	return f.Save(path)
+}
+
+// brokenWriter fails every write, remembering if it was aborted.
+type brokenWriter struct {
+	aborted bool
+}
+
+func (b *brokenWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func (b *brokenWriter) Close() error {
+	return errors.New("broken pipe")
+}
+
+func (b *brokenWriter) Abort() error {
+	b.aborted = true
+	return nil
+}
+
+// brokenStorage saves objects with a brokenWriter.
+type brokenStorage struct {
+	*Memory
+	w *brokenWriter
+}
+
+func (b brokenStorage) Save(path string) (io.WriteCloser, error) {
+	return b.w, nil
+}
+
+func (b brokenStorage) SaveTags(path string, tags Tagger) (io.WriteCloser, error) {
+	return b.w, nil
+}
+
+func TestMirror(t *testing.T) {
+	Convey("Given a mirror of two storages", t, func() {
+		primary, secondary := NewMemory(), NewMemory()
+		mirror := NewMirror(0)
+		mirror.Add(primary, "")
+		mirror.Add(secondary, "copy")
+
+		save := func(fpath, data string) error {
+			w, err := mirror.SaveTags(fpath, Tags{"dump-id": "1"})
+			if err != nil {
+				return err
+			}
+			if _, err := io.WriteString(w, data); err != nil {
+				return err
+			}
+			return w.Close()
+		}
+
+		Convey("Objects are saved to both of them, under their roots", func() {
+			So(save("dump/a", "foo"), ShouldBeNil)
+			for store, fpath := range map[*Memory]string{primary: "dump/a", secondary: "copy/dump/a"} {
+				info, err := store.Stat(fpath)
+				So(err, ShouldBeNil)
+				So(info.Size, ShouldEqual, 3)
+				So(info.Tags, ShouldResemble, map[string]string{"dump-id": "1"})
+			}
+
+			Convey("And fetched from the next storage when missing from the first one", func() {
+				So(primary.Delete("dump/a"), ShouldBeNil)
+				r, err := mirror.Fetch("dump/a")
+				So(err, ShouldBeNil)
+				b, err := ioutil.ReadAll(r)
+				So(err, ShouldBeNil)
+				So(string(b), ShouldEqual, "foo")
+				info, err := mirror.Stat("dump/a")
+				So(err, ShouldBeNil)
+				So(info.Path, ShouldEqual, "dump/a")
+			})
+
+			Convey("Walking gives the objects of every storage once", func() {
+				So(primary.Delete("dump/a"), ShouldBeNil)
+				w, err := primary.Save("dump/b")
+				So(err, ShouldBeNil)
+				So(w.Close(), ShouldBeNil)
+				var paths []string
+				err = mirror.Walk("dump", func(fpath string, err error) error {
+					paths = append(paths, fpath)
+					return err
+				})
+				So(err, ShouldBeNil)
+				So(paths, ShouldResemble, []string{"dump/a", "dump/b"})
+			})
+
+			Convey("Deleting removes the object from every storage", func() {
+				So(mirror.Delete("dump/a"), ShouldBeNil)
+				_, err := mirror.Fetch("dump/a")
+				So(os.IsNotExist(err), ShouldBeTrue)
+			})
+		})
+
+		Convey("With a storage giving paths without the leading slash of its root, as S3 does", func() {
+			third := NewMemory()
+			mirror.Add(third, "/backup")
+			So(save("dump/a", "foo"), ShouldBeNil)
+			_, err := third.Stat("backup/dump/a")
+			So(err, ShouldBeNil)
+
+			Convey("Walking should give each object once, under the root", func() {
+				var paths []string
+				err := mirror.Walk("dump", func(fpath string, err error) error {
+					paths = append(paths, fpath)
+					return err
+				})
+				So(err, ShouldBeNil)
+				So(paths, ShouldResemble, []string{"dump/a"})
+			})
+		})
+
+		Convey("With one of them failing", func() {
+			mirror.Add(fullStorage{NewMemory()}, "")
+
+			Convey("Saving fails when every storage has to save objects", func() {
+				So(save("dump/a", "foo"), ShouldNotBeNil)
+			})
+			Convey("Saving succeeds when a quorum of the storages saved objects", func() {
+				mirror.Quorum = 2
+				So(save("dump/a", "foo"), ShouldBeNil)
+				_, err := primary.Stat("dump/a")
+				So(err, ShouldBeNil)
+				_, err = secondary.Stat("copy/dump/a")
+				So(err, ShouldBeNil)
+			})
+		})
+
+		Convey("With one of them failing to write", func() {
+			broken := &brokenWriter{}
+			mirror.Add(brokenStorage{NewMemory(), broken}, "")
+
+			Convey("The failing writer is aborted while the others save the object", func() {
+				mirror.Quorum = 2
+				So(save("dump/a", "foo"), ShouldBeNil)
+				So(broken.aborted, ShouldBeTrue)
+				_, err := primary.Stat("dump/a")
+				So(err, ShouldBeNil)
+			})
+			Convey("Every writer is aborted when the quorum can't be met", func() {
+				So(save("dump/a", "foo"), ShouldNotBeNil)
+				So(broken.aborted, ShouldBeTrue)
+				_, err := primary.Stat("dump/a")
+				So(os.IsNotExist(err), ShouldBeTrue)
+			})
+		})
+	})
+}
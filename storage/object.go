@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"sort"
+	"time"
+)
+
+// ErrNotSupported is returned by Stat and Delete for storages that can't do it.
+var ErrNotSupported = errors.New("Not supported by this storage")
+
+// ObjectInfo describes a saved object.
+type ObjectInfo struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+	// ETag is set by storages having one, such as S3.
+	ETag string
+	// Tags are the tags the object was saved with.
+	Tags map[string]string
+	// StorageClass is set by storages having them, such as S3.
+	StorageClass string
+	// Archived objects have to be restored before they are fetched, see Restorer.
+	Archived bool
+}
+
+// Tags is a Tagger of its own.
+type Tags map[string]string
+
+func (t Tags) Tags() map[string]string {
+	return t
+}
+
+// encodeTags returns the tags with values that aren't printable ASCII encoded as RFC 2047 words,
+// for storages keeping tags in headers. decodeTag decodes them back.
+func encodeTags(tags map[string]string) map[string]string {
+	encoded := make(map[string]string, len(tags))
+	for name, value := range tags {
+		encoded[name] = mime.BEncoding.Encode("UTF-8", value)
+	}
+	return encoded
+}
+
+// decodeTag returns value decoded from RFC 2047 words, or as is if it has none.
+func decodeTag(value string) string {
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(value); err == nil {
+		return decoded
+	}
+	return value
+}
+
+// limitTags returns the tags whose names and values fit in max bytes together, leaving out the
+// largest tags, such as a long list of collections, when the storage can't take all of them.
+func limitTags(tags map[string]string, max int) map[string]string {
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := len(names[i])+len(tags[names[i]]), len(names[j])+len(tags[names[j]])
+		return a < b || a == b && names[i] < names[j]
+	})
+	limited := make(map[string]string, len(tags))
+	size := 0
+	for _, name := range names {
+		if size += len(name) + len(tags[name]); size > max {
+			break
+		}
+		limited[name] = tags[name]
+	}
+	return limited
+}
+
+// SaveTagged saves an object on path with tags if store is a TagSaver, otherwise without them.
+func SaveTagged(store Saver, path string, tags Tagger) (io.WriteCloser, error) {
+	if s, ok := store.(TagSaver); ok && tags != nil {
+		return s.SaveTags(path, tags)
+	}
+	return store.Save(path)
+}
+
+// Stat returns the info of the object on path if store is a Stater.
+func Stat(store Fetcher, path string) (ObjectInfo, error) {
+	if s, ok := store.(Stater); ok {
+		return s.Stat(path)
+	}
+	return ObjectInfo{}, ErrNotSupported
+}
+
+// Abort gives up saving the object written to w if it is an Aborter.
+func Abort(w io.Writer) error {
+	if a, ok := w.(Aborter); ok {
+		return a.Abort()
+	}
+	return ErrNotSupported
+}
+
+// Close closes store if it is an io.Closer, such as an Archive that is only complete once closed.
+func Close(store Fetcher) error {
+	if c, ok := store.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Delete deletes the object on path if store is a Deleter.
+func Delete(store Fetcher, path string) error {
+	if d, ok := store.(Deleter); ok {
+		return d.Delete(path)
+	}
+	return ErrNotSupported
+}
@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"sync"
+)
+
+// gzipBlockSize is how much data each gzip member compressed in parallel holds.
+const gzipBlockSize = 1 * MB
+
+// gzipBlock is the compressed result of one block, sent once it is done.
+type gzipBlock struct {
+	data []byte
+	err  error
+}
+
+// parallelGzipWriter splits written data into blocks, compressing each as its own gzip member on
+// separate goroutines while writing them out in order. The result is a multi-member gzip stream,
+// which gzip.Reader reads as one.
+type parallelGzipWriter struct {
+	w     io.Writer
+	level int
+	buf   []byte
+	// pending holds one channel per block being compressed, in the order they are to be written.
+	// Its capacity limits how many blocks are compressed at the same time.
+	pending chan chan gzipBlock
+	done    chan bool
+	pool    sync.Pool
+	written bool
+	closed  bool
+
+	// mu protects err, which is set by the goroutine writing out blocks.
+	mu  sync.Mutex
+	err error
+}
+
+func newParallelGzipWriter(w io.Writer, level, procs int) (*parallelGzipWriter, error) {
+	// Make sure the level is valid before going any further.
+	if _, err := gzip.NewWriterLevel(nil, level); err != nil {
+		return nil, err
+	}
+	pw := &parallelGzipWriter{
+		w:       w,
+		level:   level,
+		buf:     make([]byte, 0, gzipBlockSize),
+		pending: make(chan chan gzipBlock, procs),
+		done:    make(chan bool),
+	}
+	return pw, nil
+}
+
+// writeBlocks writes every compressed block in order, until pending is closed by Close or Abort.
+// It is started by the first flush, so that a writer never written to has nothing to stop.
+func (pw *parallelGzipWriter) writeBlocks() {
+	defer close(pw.done)
+	for c := range pw.pending {
+		block := <-c
+		// Keep draining after an error, so that no compressing goroutine is left blocking.
+		if pw.error() != nil {
+			continue
+		}
+		if block.err == nil {
+			_, block.err = pw.w.Write(block.data)
+		}
+		if block.err != nil {
+			pw.mu.Lock()
+			pw.err = block.err
+			pw.mu.Unlock()
+		}
+	}
+}
+
+func (pw *parallelGzipWriter) error() error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	return pw.err
+}
+
+func (pw *parallelGzipWriter) Write(p []byte) (int, error) {
+	if pw.closed {
+		return 0, errors.New("Write on closed gzip writer")
+	}
+	if err := pw.error(); err != nil {
+		return 0, err
+	}
+	n := len(p)
+	for len(p) > 0 {
+		free := cap(pw.buf) - len(pw.buf)
+		if free > len(p) {
+			free = len(p)
+		}
+		pw.buf = append(pw.buf, p[:free]...)
+		p = p[free:]
+		if len(pw.buf) == cap(pw.buf) {
+			pw.flush()
+		}
+	}
+	return n, nil
+}
+
+// flush starts compressing the buffered block, blocking while too many blocks are in flight.
+func (pw *parallelGzipWriter) flush() {
+	block := pw.buf
+	pw.buf = make([]byte, 0, gzipBlockSize)
+	if !pw.written {
+		go pw.writeBlocks()
+	}
+	pw.written = true
+
+	c := make(chan gzipBlock, 1)
+	pw.pending <- c
+	go func() {
+		var out bytes.Buffer
+		zw, ok := pw.pool.Get().(*gzip.Writer)
+		if ok {
+			zw.Reset(&out)
+		} else {
+			zw, _ = gzip.NewWriterLevel(&out, pw.level)
+		}
+		_, err := zw.Write(block)
+		if err == nil {
+			err = zw.Close()
+		}
+		pw.pool.Put(zw)
+		c <- gzipBlock{out.Bytes(), err}
+	}()
+}
+
+// Close compresses what is left and waits for every block to be written.
+func (pw *parallelGzipWriter) Close() error {
+	if pw.closed {
+		return pw.error()
+	}
+	pw.closed = true
+	// Always write at least one member, as an empty stream is not valid gzip.
+	if len(pw.buf) > 0 || !pw.written {
+		pw.flush()
+	}
+	close(pw.pending)
+	<-pw.done
+	return pw.error()
+}
+
+// Abort stops writing blocks out, waiting for the ones being compressed, and fails further writes.
+func (pw *parallelGzipWriter) Abort() error {
+	if pw.closed {
+		return nil
+	}
+	pw.closed = true
+	pw.mu.Lock()
+	if pw.err == nil {
+		pw.err = errors.New("Write on aborted gzip writer")
+	}
+	pw.mu.Unlock()
+	if pw.written {
+		close(pw.pending)
+		<-pw.done
+	}
+	return nil
+}
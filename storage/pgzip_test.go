@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+)
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestParallelGzip(t *testing.T) {
+	// Half random, half repeated data so that compression has something to do.
+	data := make([]byte, 3*gzipBlockSize+123)
+	rand.New(rand.NewSource(1)).Read(data[:len(data)/2])
+
+	Convey("Given a parallel gzip writer", t, func() {
+		for _, size := range []int{0, 10, int(gzipBlockSize), len(data)} {
+			var out bytes.Buffer
+			w, err := Gzip.(ParallelCodec).Parallel(4).NewWriter(&out, DefaultLevel)
+			So(err, ShouldBeNil)
+			// Write in odd sized pieces to cross the block boundaries.
+			for p := data[:size]; len(p) > 0; {
+				n := 7919
+				if n > len(p) {
+					n = len(p)
+				}
+				_, err := w.Write(p[:n])
+				So(err, ShouldBeNil)
+				p = p[n:]
+			}
+			So(w.Close(), ShouldBeNil)
+
+			// The gzip reader should see the members as one stream.
+			r, err := gzip.NewReader(&out)
+			So(err, ShouldBeNil)
+			b, err := ioutil.ReadAll(r)
+			So(err, ShouldBeNil)
+			So(bytes.Equal(b, data[:size]), ShouldBeTrue)
+		}
+	})
+
+	Convey("Errors writing to the underlying writer should be returned", t, func() {
+		w, err := newParallelGzipWriter(failingWriter{}, DefaultLevel, 2)
+		So(err, ShouldBeNil)
+		w.Write(data)
+		So(w.Close(), ShouldNotBeNil)
+		_, err = w.Write(data)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Aborting in the middle of writing should stop the writer", t, func() {
+		w, err := newParallelGzipWriter(ioutil.Discard, DefaultLevel, 2)
+		So(err, ShouldBeNil)
+		_, err = w.Write(data)
+		So(err, ShouldBeNil)
+		So(w.Abort(), ShouldBeNil)
+		select {
+		case <-w.done:
+		case <-time.After(5 * time.Second):
+			t.Error("Blocks still being written after Abort")
+		}
+		_, err = w.Write(data)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Aborting through the compressing storage should abort the saved object", t, func() {
+		mem := NewMemory()
+		store := NewCompressSaveFetcher(mem, Gzip.(ParallelCodec).Parallel(2), DefaultLevel)
+		w, err := store.Save("object")
+		So(err, ShouldBeNil)
+		_, err = w.Write(data)
+		So(err, ShouldBeNil)
+		So(Abort(w), ShouldBeNil)
+		_, err = mem.Stat("object")
+		So(os.IsNotExist(err), ShouldBeTrue)
+	})
+
+	Convey("An invalid level should be refused", t, func() {
+		_, err := newParallelGzipWriter(ioutil.Discard, 42, 2)
+		So(err, ShouldNotBeNil)
+	})
+}
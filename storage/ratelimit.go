@@ -0,0 +1,186 @@
+package storage
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket, letting through rate tokens per second on average with bursts of up to one
+// second worth of tokens. A nil Limiter lets everything through.
+type Limiter struct {
+	rate float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a Limiter of rate tokens per second, or nil if rate is not positive.
+func NewLimiter(rate float64) *Limiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &Limiter{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// Wait takes n tokens, blocking until they are available.
+// Tokens are taken before waiting, so that concurrent callers are let through in turn.
+func (l *Limiter) Wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	wait := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// limitedTransport takes a token of requests for every request sent, and limits the bytes of request
+// and response bodies by upload and download, as they go over the network.
+type limitedTransport struct {
+	http.RoundTripper
+	upload, download, requests *Limiter
+}
+
+func (t *limitedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.requests.Wait(1)
+	if r.Body != nil && t.upload != nil {
+		limited := *r
+		limited.Body = &rateReader{r.Body, t.upload}
+		r = &limited
+	}
+	resp, err := t.RoundTripper.RoundTrip(r)
+	if err == nil && t.download != nil {
+		resp.Body = &rateReader{resp.Body, t.download}
+	}
+	return resp, err
+}
+
+// limitClient returns a copy of client sending requests limited by the limiters.
+func limitClient(client *http.Client, upload, download, requests *Limiter) *http.Client {
+	c := *client
+	if c.Transport == nil {
+		c.Transport = http.DefaultTransport
+	}
+	c.Transport = &limitedTransport{c.Transport, upload, download, requests}
+	return &c
+}
+
+// transportLimiter is a storage sending HTTP requests, limiting them and their bodies itself.
+// Limiting the bytes above its buffers would otherwise only limit the average rate, while whole
+// parts of uploads are sent at once.
+type transportLimiter interface {
+	limitTransport(upload, download, requests *Limiter)
+}
+
+// RateLimited is a wrapper of a storage, limiting the bytes per second saved and fetched, and the
+// requests per second made to it. Limiters may be shared by several wrappers, to limit all of them
+// together.
+//
+// Storages sending HTTP requests, such as S3, limit every request they send, the pages of listings,
+// the parts of uploads and retries included, and the bytes of their bodies as they are sent and
+// received. For other storages every Save, Fetch, Walk, Stat, Delete and Restore counts as one
+// request, as well as every object walked.
+type RateLimited struct {
+	s SaveFetcher
+	// The limiters are only used for storages not limiting their transport themselves.
+	upload, download, requests *Limiter
+}
+
+// NewRateLimited limits the storage s by the upload and download limiters in bytes, and the requests
+// limiter in requests. Any of them may be nil, to not be limited.
+func NewRateLimited(s SaveFetcher, upload, download, requests *Limiter) *RateLimited {
+	if l, ok := s.(transportLimiter); ok {
+		l.limitTransport(upload, download, requests)
+		upload, download, requests = nil, nil, nil
+	}
+	return &RateLimited{s: s, upload: upload, download: download, requests: requests}
+}
+
+type rateWriter struct {
+	io.WriteCloser
+	l *Limiter
+}
+
+func (w *rateWriter) Write(p []byte) (int, error) {
+	w.l.Wait(len(p))
+	return w.WriteCloser.Write(p)
+}
+
+func (w *rateWriter) Abort() error {
+	return Abort(w.WriteCloser)
+}
+
+type rateReader struct {
+	io.ReadCloser
+	l *Limiter
+}
+
+func (r *rateReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.l.Wait(n)
+	return n, err
+}
+
+func (r *RateLimited) Save(path string) (io.WriteCloser, error) {
+	return r.SaveTags(path, nil)
+}
+
+func (r *RateLimited) SaveTags(path string, tags Tagger) (io.WriteCloser, error) {
+	r.requests.Wait(1)
+	w, err := SaveTagged(r.s, path, tags)
+	if err != nil {
+		return nil, err
+	}
+	return &rateWriter{w, r.upload}, nil
+}
+
+func (r *RateLimited) Fetch(path string) (io.ReadCloser, error) {
+	r.requests.Wait(1)
+	rc, err := r.s.Fetch(path)
+	if err != nil {
+		return nil, err
+	}
+	return &rateReader{rc, r.download}, nil
+}
+
+func (r *RateLimited) Walk(path string, walkfn WalkFunc) error {
+	r.requests.Wait(1)
+	if r.requests == nil {
+		return Walk(r.s, path, walkfn)
+	}
+	return Walk(r.s, path, func(fpath string, err error) error {
+		r.requests.Wait(1)
+		return walkfn(fpath, err)
+	})
+}
+
+func (r *RateLimited) Stat(path string) (ObjectInfo, error) {
+	r.requests.Wait(1)
+	return Stat(r.s, path)
+}
+
+func (r *RateLimited) Delete(path string) error {
+	r.requests.Wait(1)
+	return Delete(r.s, path)
+}
+
+func (r *RateLimited) Restore(path string, days int, tier string) error {
+	r.requests.Wait(1)
+	return Restore(r.s, path, days, tier)
+}
+
+func (r *RateLimited) Close() error {
+	return Close(r.s)
+}
@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/duego/mongotool/storage/gcstest"
+	"github.com/duego/mongotool/storage/s3test"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	Convey("Given a limiter of 1000 tokens per second", t, func() {
+		l := NewLimiter(1000)
+
+		Convey("A second worth of tokens is let through at once", func() {
+			start := time.Now()
+			l.Wait(1000)
+			So(time.Since(start), ShouldBeLessThan, 50*time.Millisecond)
+
+			Convey("While the next tokens have to be waited for", func() {
+				start := time.Now()
+				l.Wait(100)
+				So(time.Since(start), ShouldBeGreaterThanOrEqualTo, 90*time.Millisecond)
+			})
+		})
+		Convey("Concurrent callers share the rate", func() {
+			l.Wait(1000)
+			start := time.Now()
+			var wg sync.WaitGroup
+			for n := 0; n < 4; n++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					l.Wait(50)
+				}()
+			}
+			wg.Wait()
+			So(time.Since(start), ShouldBeGreaterThanOrEqualTo, 190*time.Millisecond)
+		})
+	})
+	Convey("A limiter without a rate lets everything through", t, func() {
+		l := NewLimiter(0)
+		So(l, ShouldBeNil)
+		l.Wait(1 << 30)
+	})
+}
+
+func TestRateLimited(t *testing.T) {
+	Convey("Given a storage limited to 10KB per second both ways", t, func() {
+		store := NewRateLimited(NewMemory(), NewLimiter(float64(10*KB)), NewLimiter(float64(10*KB)), nil)
+		data := bytes.Repeat([]byte("x"), int(12*KB))
+
+		Convey("Saving more than a second worth of data takes longer", func() {
+			start := time.Now()
+			w, err := store.Save("object")
+			So(err, ShouldBeNil)
+			_, err = io.Copy(w, bytes.NewReader(data))
+			So(err, ShouldBeNil)
+			So(w.Close(), ShouldBeNil)
+			So(time.Since(start), ShouldBeGreaterThanOrEqualTo, 150*time.Millisecond)
+
+			Convey("As does fetching it", func() {
+				start := time.Now()
+				r, err := store.Fetch("object")
+				So(err, ShouldBeNil)
+				b, err := ioutil.ReadAll(r)
+				So(err, ShouldBeNil)
+				So(b, ShouldResemble, data)
+				So(time.Since(start), ShouldBeGreaterThanOrEqualTo, 150*time.Millisecond)
+			})
+		})
+	})
+}
+
+// bodyTimer is a transport recording how long reading the longest request body took.
+type bodyTimer struct {
+	mu      sync.Mutex
+	longest time.Duration
+}
+
+func (b *bodyTimer) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Body != nil {
+		start := time.Now()
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		b.mu.Lock()
+		if d := time.Since(start); d > b.longest {
+			b.longest = d
+		}
+		b.mu.Unlock()
+		r = r.Clone(r.Context())
+		r.Body = ioutil.NopCloser(bytes.NewReader(data))
+	}
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestRateLimitedTransport(t *testing.T) {
+	Convey("Given a S3 bucket limited to 10KB per second of uploads", t, func() {
+		srv := s3test.NewServer()
+		defer srv.Close()
+		defer setFakeAwsKeys()()
+		s3 := NewS3(srv.BucketURL("mongotool"))
+		timer := &bodyTimer{}
+		s3.client.Transport = timer
+		store := NewRateLimited(s3, NewLimiter(float64(10*KB)), nil, nil)
+
+		Convey("The bytes should be limited as they are sent, rather than as they are buffered", func() {
+			w, err := store.Save("object")
+			So(err, ShouldBeNil)
+			_, err = w.Write(bytes.Repeat([]byte("x"), int(15*KB)))
+			So(err, ShouldBeNil)
+			So(w.Close(), ShouldBeNil)
+			So(timer.longest, ShouldBeGreaterThanOrEqualTo, 400*time.Millisecond)
+		})
+	})
+}
+
+func TestRateLimitedRequests(t *testing.T) {
+	Convey("Given a GCS bucket limited to 10 requests per second", t, func() {
+		srv := gcstest.NewServer()
+		defer srv.Close()
+		srv.CreateBucket("mongotool")
+		srv.AllowUnauthenticated = true
+		srv.PageSize = 1
+		for n := 0; n < 15; n++ {
+			srv.PutObject("mongotool", fmt.Sprintf("dump/%02d", n), []byte("foo"))
+		}
+		gcs := NewGCS("mongotool")
+		gcs.Endpoint = srv.URL
+		store := NewRateLimited(gcs, nil, nil, NewLimiter(10))
+
+		Convey("Every page of a listing counts as a request", func() {
+			start := time.Now()
+			walked := 0
+			err := store.Walk("dump", func(p string, err error) error {
+				walked++
+				return err
+			})
+			So(err, ShouldBeNil)
+			So(walked, ShouldEqual, 15)
+			So(srv.Requests(), ShouldBeGreaterThanOrEqualTo, 15)
+			So(time.Since(start), ShouldBeGreaterThanOrEqualTo, 400*time.Millisecond)
+		})
+	})
+
+	Convey("Given a storage without HTTP requests limited to 10 requests per second", t, func() {
+		mem := NewMemory()
+		for n := 0; n < 15; n++ {
+			w, _ := mem.Save(fmt.Sprintf("dump/%02d", n))
+			w.Close()
+		}
+		store := NewRateLimited(mem, nil, nil, NewLimiter(10))
+
+		Convey("Every object walked counts as a request", func() {
+			start := time.Now()
+			So(store.Walk("dump", func(p string, err error) error { return err }), ShouldBeNil)
+			So(time.Since(start), ShouldBeGreaterThanOrEqualTo, 500*time.Millisecond)
+		})
+	})
+}
+
+func TestParseByteSize(t *testing.T) {
+	Convey("Sizes are parsed with or without units", t, func() {
+		for s, size := range map[string]ByteSize{
+			"512":   512,
+			"50MB":  50 * MB,
+			"1.5G":  GB + GB/2,
+			"512k":  512 * KB,
+			" 2 gb": 2 * GB,
+			"100B":  100,
+		} {
+			parsed, err := ParseByteSize(s)
+			So(err, ShouldBeNil)
+			So(parsed, ShouldEqual, size)
+		}
+		for _, s := range []string{"", "MB", "fast", "-1MB"} {
+			_, err := ParseByteSize(s)
+			So(err, ShouldNotBeNil)
+		}
+	})
+	Convey("Sizes are formatted in the largest unit dividing them", t, func() {
+		So((50 * MB).String(), ShouldEqual, "50MB")
+		So((GB + GB/2).String(), ShouldEqual, "1536MB")
+		So(ByteSize(100).String(), ShouldEqual, "100")
+		So(ByteSize(0).String(), ShouldEqual, "0")
+	})
+}
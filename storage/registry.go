@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// OpenFunc opens the storage of a target url, returning it with the root path of the target in it.
+// Options are read from the query of the url, which holds the defaults given to Open as well.
+// Options not known to the storage are ignored, as the same defaults are given to every storage.
+type OpenFunc func(u *url.URL) (store SaveFetcher, root string, err error)
+
+var (
+	schemesMu sync.RWMutex
+	schemes   = make(map[string]OpenFunc)
+)
+
+// Register makes a storage available for targets with the url scheme. Registering the same scheme
+// twice panics.
+func Register(scheme string, open OpenFunc) {
+	schemesMu.Lock()
+	defer schemesMu.Unlock()
+	if _, dup := schemes[scheme]; dup {
+		panic("storage: Register called twice for " + scheme)
+	}
+	schemes[scheme] = open
+}
+
+// Schemes returns the registered url schemes, sorted.
+func Schemes() []string {
+	schemesMu.RLock()
+	defer schemesMu.RUnlock()
+	names := make([]string, 0, len(schemes))
+	for scheme := range schemes {
+		names = append(names, scheme)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Open returns the storage of target and the root path of the target in it. Target is one of:
+//
+//	"-" for a Stream on stdin and stdout
+//	"scheme://..." for a registered storage, such as s3://bucket/root?region=eu-west-1
+//	a path for the Filesystem, same as file://path, or an Archive when ending with ".mtar"
+//
+// Defaults are options used unless the query of the target sets them.
+func Open(target string, defaults url.Values) (store SaveFetcher, root string, err error) {
+	if target == "-" {
+		return NewStream(os.Stdin, os.Stdout), "", nil
+	}
+	u, err := url.Parse(target)
+	if err != nil || u.Scheme == "" {
+		// Paths need not be valid urls, such as /backups/100%/dump.
+		if err != nil && strings.Contains(target, "://") {
+			return nil, "", fmt.Errorf("Invalid target %q: %v", target, err)
+		}
+		return openFilesystem(&url.URL{Path: target})
+	}
+	schemesMu.RLock()
+	open, ok := schemes[u.Scheme]
+	schemesMu.RUnlock()
+	if !ok {
+		// Anything not looking like a url, such as C:\dump, is a path.
+		if strings.Contains(target, "://") {
+			return nil, "", fmt.Errorf("Unknown storage %q, expected one of: %s", target, strings.Join(Schemes(), ", "))
+		}
+		return openFilesystem(&url.URL{Path: target})
+	}
+
+	q := u.Query()
+	for name, values := range defaults {
+		if _, set := q[name]; !set {
+			q[name] = values
+		}
+	}
+	u.RawQuery = q.Encode()
+	return open(u)
+}
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestOpen(t *testing.T) {
+	Convey("Opening targets", t, func() {
+		defer setFakeAwsKeys()()
+
+		Convey("Paths and file urls should give the filesystem", func() {
+			for target, dir := range map[string]string{
+				"dump":               "dump",
+				"/var/dump":          "/var/dump",
+				"file:///var/dump":   "/var/dump",
+				"file://dump":        "dump",
+				`C:\dump`:            `C:\dump`,
+				"/backups/100%/dump": "/backups/100%/dump",
+			} {
+				store, root, err := Open(target, nil)
+				So(err, ShouldBeNil)
+				So(store, ShouldResemble, Filesystem{Root: dir})
+				So(root, ShouldEqual, "")
+			}
+		})
+
+		Convey("- should give a stream", func() {
+			store, _, err := Open("-", nil)
+			So(err, ShouldBeNil)
+			_, ok := store.(*Stream)
+			So(ok, ShouldBeTrue)
+		})
+
+		Convey("S3 urls should keep working", func() {
+			store, root, err := Open("https://mongotool.s3.amazonaws.com/test", nil)
+			So(err, ShouldBeNil)
+			So(store.(*S3).Bucket, ShouldEqual, "https://mongotool.s3.amazonaws.com")
+			So(root, ShouldEqual, "/test")
+		})
+
+		Convey("Options should be read from the query, falling back on the defaults", func() {
+			defaults := url.Values{"region": {"us-west-2"}, "retries": {"3"}, "endpoint": {"http://minio:9000"}}
+			store, root, err := Open("s3://mongotool/test?region=eu-west-1&path-style=true&retry-delay=1s", defaults)
+			So(err, ShouldBeNil)
+			s3 := store.(*S3)
+			So(s3.Bucket, ShouldEqual, "http://minio:9000/mongotool")
+			So(s3.Region, ShouldEqual, "eu-west-1")
+			So(s3.Retry.Attempts, ShouldEqual, 3)
+			So(s3.Retry.Delay, ShouldEqual, time.Second)
+			So(root, ShouldEqual, "/test")
+		})
+
+		Convey("Invalid options should fail", func() {
+			_, _, err := Open("s3://mongotool/test?retries=many", nil)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("The same memory should be opened by name", func() {
+			a, root, err := Open("mem://test/dump", nil)
+			So(err, ShouldBeNil)
+			So(root, ShouldEqual, "/dump")
+			b, _, err := Open("mem://test", nil)
+			So(err, ShouldBeNil)
+			So(a, ShouldPointTo, b)
+			c, _, err := Open("mem://other", nil)
+			So(err, ShouldBeNil)
+			So(c, ShouldNotPointTo, a)
+		})
+
+		Convey("Unknown schemes should fail", func() {
+			_, _, err := Open("ftp://host/dump", nil)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Invalid urls should fail", func() {
+			_, _, err := Open("s3://bucket/100%/dump", nil)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy decides how many times and how often a failed request is retried.
+type RetryPolicy struct {
+	// Attempts is the maximum number of times a request is sent, including the first one.
+	Attempts int
+	// Delay is the base delay before retrying, doubled after every failed attempt.
+	Delay time.Duration
+	// MaxDelay caps the delay between two attempts.
+	MaxDelay time.Duration
+}
+
+// DefaultRetryPolicy is used by S3 unless told otherwise.
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts: 5,
+	Delay:    200 * time.Millisecond,
+	MaxDelay: 30 * time.Second,
+}
+
+// Retryable reports whether a response with the given status code is worth sending again.
+// These are the codes S3 uses for internal errors, throttling (503 SlowDown) and overloaded gateways.
+func Retryable(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// requestTimeout tells if resp is the 400 RequestTimeout S3 answers when the connection of an upload
+// was idle for too long, which is worth sending again unlike other 400s. The start of the body read
+// to tell is put back, so that the caller can still read all of it.
+func requestTimeout(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusBadRequest {
+		return false
+	}
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, int64(4*KB)))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(b), resp.Body), resp.Body}
+	return bytes.Contains(b, []byte("<Code>RequestTimeout</Code>"))
+}
+
+// backoff returns a random delay between zero and the exponential delay for the attempt, also known as
+// full jitter. It spreads out the retries of concurrent workers hitting the same throttling.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.Delay << uint(attempt)
+	if d <= 0 || (p.MaxDelay > 0 && d > p.MaxDelay) {
+		d = p.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+// Do sends the request made by build until it succeeds, fails with a non retryable status or the
+// attempts are exhausted. S3's 400 RequestTimeout is retried as well. build is called for every attempt, so each retry gets a freshly signed
+// request with a rewound body. The last response is returned as is, leaving it to the caller to
+// check its status code.
+func (p RetryPolicy) Do(client *http.Client, build func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := build()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		last := attempt+1 >= p.Attempts
+		if err == nil && (last || !Retryable(resp.StatusCode) && !requestTimeout(resp)) {
+			return resp, nil
+		}
+		if last {
+			return nil, err
+		}
+		if resp != nil {
+			// Drain the body to let the connection be reused.
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		time.Sleep(p.backoff(attempt))
+	}
+}
@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"bytes"
+	"github.com/duego/mongotool/storage/s3test"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// flakyHandler fails the first requests with the given status code before succeeding.
+type flakyHandler struct {
+	failures int
+	code     int
+	requests int
+	bodies   []string
+	// message is the body of failures, SlowDown unless set.
+	message string
+}
+
+func (h *flakyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.requests++
+	b, _ := ioutil.ReadAll(r.Body)
+	h.bodies = append(h.bodies, string(b))
+	if h.requests <= h.failures {
+		message := h.message
+		if message == "" {
+			message = "SlowDown"
+		}
+		http.Error(w, message, h.code)
+		return
+	}
+	io.WriteString(w, "Foo")
+}
+
+func TestRetryPolicy(t *testing.T) {
+	policy := RetryPolicy{Attempts: 3, Delay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+
+	Convey("Given a server that fails with 503 SlowDown twice", t, func() {
+		h := &flakyHandler{failures: 2, code: http.StatusServiceUnavailable}
+		ts := httptest.NewServer(h)
+		defer ts.Close()
+
+		Convey("The request should succeed on the third attempt", func() {
+			resp, err := policy.Do(http.DefaultClient, func() (*http.Request, error) {
+				return http.NewRequest("PUT", ts.URL, bytes.NewReader([]byte("body")))
+			})
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			resp.Body.Close()
+			So(h.requests, ShouldEqual, 3)
+
+			Convey("Sending the full body every time", func() {
+				So(h.bodies, ShouldResemble, []string{"body", "body", "body"})
+			})
+		})
+
+		Convey("With only two attempts the last failure should be returned", func() {
+			policy := policy
+			policy.Attempts = 2
+			resp, err := policy.Do(http.DefaultClient, func() (*http.Request, error) {
+				return http.NewRequest("GET", ts.URL, nil)
+			})
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusServiceUnavailable)
+			resp.Body.Close()
+			So(h.requests, ShouldEqual, 2)
+		})
+	})
+
+	Convey("Given a server that fails with 403 Forbidden", t, func() {
+		h := &flakyHandler{failures: 1, code: http.StatusForbidden}
+		ts := httptest.NewServer(h)
+		defer ts.Close()
+
+		Convey("The request should not be retried", func() {
+			resp, err := policy.Do(http.DefaultClient, func() (*http.Request, error) {
+				return http.NewRequest("GET", ts.URL, nil)
+			})
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusForbidden)
+			resp.Body.Close()
+			So(h.requests, ShouldEqual, 1)
+		})
+	})
+
+	Convey("Given a S3 server timing out an upload once with 400 RequestTimeout", t, func() {
+		h := &flakyHandler{failures: 1, code: http.StatusBadRequest,
+			message: "<Error><Code>RequestTimeout</Code><Message>Your socket connection to the server was not read from or written to within the timeout period.</Message></Error>"}
+		ts := httptest.NewServer(h)
+		defer ts.Close()
+
+		Convey("The request should be retried", func() {
+			resp, err := policy.Do(http.DefaultClient, func() (*http.Request, error) {
+				return http.NewRequest("PUT", ts.URL, bytes.NewReader([]byte("body")))
+			})
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			resp.Body.Close()
+			So(h.requests, ShouldEqual, 2)
+		})
+	})
+
+	Convey("Given a server failing with another 400", t, func() {
+		h := &flakyHandler{failures: 1, code: http.StatusBadRequest,
+			message: "<Error><Code>InvalidArgument</Code></Error>"}
+		ts := httptest.NewServer(h)
+		defer ts.Close()
+
+		Convey("The request should not be retried, leaving the whole error to read", func() {
+			resp, err := policy.Do(http.DefaultClient, func() (*http.Request, error) {
+				return http.NewRequest("GET", ts.URL, nil)
+			})
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+			b, err := ioutil.ReadAll(resp.Body)
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "<Error><Code>InvalidArgument</Code></Error>\n")
+			resp.Body.Close()
+			So(h.requests, ShouldEqual, 1)
+		})
+	})
+
+	Convey("Given a server that resets the connection once", t, func() {
+		requests := 0
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if requests == 1 {
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+				return
+			}
+			io.WriteString(w, "Foo")
+		}))
+		defer ts.Close()
+
+		Convey("The request should be retried", func() {
+			resp, err := policy.Do(http.DefaultClient, func() (*http.Request, error) {
+				return http.NewRequest("GET", ts.URL, nil)
+			})
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			resp.Body.Close()
+			So(requests, ShouldEqual, 2)
+		})
+	})
+
+	Convey("The backoff should never exceed the max delay", t, func() {
+		for attempt := 0; attempt < 64; attempt++ {
+			So(policy.backoff(attempt), ShouldBeLessThan, policy.MaxDelay)
+		}
+	})
+}
+
+func TestS3Retry(t *testing.T) {
+	Convey("Given a S3 bucket that is throttling requests", t, func() {
+		srv := s3test.NewServer()
+		defer srv.Close()
+		srv.PutObject("mongotool", "object", []byte("Foo"))
+		srv.FailNext(2, http.StatusServiceUnavailable)
+		defer setFakeAwsKeys()()
+
+		store := NewS3(srv.BucketURL("mongotool"))
+		store.Retry = RetryPolicy{Attempts: 3, Delay: time.Millisecond}
+
+		Convey("Fetch should retry until it gets the object", func() {
+			r, err := store.Fetch("object")
+			So(err, ShouldBeNil)
+			b, err := ioutil.ReadAll(r)
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "Foo")
+			So(r.Close(), ShouldBeNil)
+			So(len(srv.Requests()), ShouldEqual, 3)
+		})
+
+		Convey("Save should retry the PUT with the same data", func() {
+			w, err := store.Save("saved")
+			So(err, ShouldBeNil)
+			_, err = io.WriteString(w, "Foo")
+			So(err, ShouldBeNil)
+			So(w.Close(), ShouldBeNil)
+			So(len(srv.Requests()), ShouldEqual, 3)
+			o, ok := srv.Object("mongotool", "saved")
+			So(ok, ShouldBeTrue)
+			So(string(o.Data), ShouldEqual, "Foo")
+		})
+
+		Convey("Requests slower than the client timeout should fail", func() {
+			srv.FailNext(0, 0)
+			srv.SetLatency(50 * time.Millisecond)
+			store.client.Timeout = 10 * time.Millisecond
+			store.Retry.Attempts = 1
+			_, err := store.Fetch("object")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -1,180 +1,507 @@
 package storage
 
 import (
-	"bytes"
+	"crypto/md5"
+	"encoding/hex"
 	"encoding/xml"
 	"errors"
 	"fmt"
-	"github.com/smartystreets/go-aws-auth"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
+	"unicode"
 )
 
-var signMu sync.Mutex
+// requestBuilder is something that can sign and return a http.Request for S3, sending sum as the
+// base64 MD5 of the body unless empty.
+type requestBuilder func(method, bucket, path string, body io.Reader, sum string) (req *http.Request, err error)
 
-// requestBuilder is something that can sign and return a http.Request for S3.
-type requestBuilder func(method, bucket, path string, body io.Reader) (req *http.Request, err error)
-
-// s3FileWriter takes care of buffering all written data for one S3 object until ready to be sent.
-type s3FileWriter struct {
-	bytes.Buffer
-	path    string
-	bucket  string
-	builder requestBuilder
-	closed  bool
+// S3 implements the SaveFetcher for Amazon S3.
+type S3 struct {
+	// The full path to the bucket host.
+	// Example: https://mongotool.s3.amazonaws.com
+	// Buckets addressed path-style include the bucket in the path.
+	// Example: http://minio:9000/mongotool
+	Bucket string
+	// Region is used for signing requests, it is guessed from the bucket host when empty.
+	Region string
+	// PartSize is how much data is buffered for each part of a multipart upload.
+	// S3 requires every part except the last one to be at least 5MB.
+	PartSize ByteSize
+	// PartConcurrency is how many parts of one object may be uploaded at the same time.
+	PartConcurrency int
+	// Retry is the policy for requests failing with transient errors.
+	Retry RetryPolicy
+	// Credentials provides the keys requests are signed with.
+	Credentials CredentialsProvider
+	// Encryption is the server-side encryption of saved objects. Objects saved with a customer key
+	// are fetched with the same key.
+	Encryption ServerSideEncryption
+	// StorageClass is the storage class of saved objects, such as STANDARD_IA or GLACIER.
+	// The default class of the bucket is used when empty.
+	StorageClass string
+	// Lock is the Object Lock retention and legal hold of saved objects.
+	Lock   ObjectLock
+	client *http.Client
 }
 
-func news3FileWriter(bucket, path string, builder requestBuilder) *s3FileWriter {
-	sf := s3FileWriter{
-		bucket:  bucket,
-		path:    path,
-		builder: builder,
+// NewS3Endpoint returns the S3 storage for a bucket on a S3 compatible endpoint, such as
+// https://s3.eu-west-1.amazonaws.com or http://minio:9000.
+// A pathStyle bucket is addressed as http://minio:9000/bucket instead of http://bucket.minio:9000.
+func NewS3Endpoint(endpoint, bucket, region string, pathStyle bool) (*S3, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
 	}
-	return &sf
-}
-
-// Close will send the buffered data to S3 using the requestBuilder.
-func (sf *s3FileWriter) Close() error {
-	if sf.closed {
-		return nil
+	if u.Scheme == "" || u.Host == "" {
+		return nil, errors.New("Expected an endpoint like https://s3.amazonaws.com, got: " + endpoint)
 	}
-	sf.closed = true
-
-	req, err := sf.builder("PUT", sf.bucket, sf.path, bytes.NewReader(sf.Bytes()))
-	if err != nil {
-		return err
+	if pathStyle {
+		u.Path = "/" + bucket
+	} else {
+		u.Host = bucket + "." + u.Host
+		u.Path = ""
 	}
-	client := http.DefaultClient
+	s := NewS3(u.String())
+	s.Region = region
+	return s, nil
+}
 
-	resp, err := client.Do(req)
+// ParseS3URL returns the S3 storage and root path of a target in one of the forms:
+//
+//	https://bucket.s3.amazonaws.com/root (virtual-hosted)
+//	http://minio:9000/bucket/root (pathStyle)
+//	s3://bucket/root (endpoint required unless on AWS)
+//
+// Endpoint, if set, replaces the scheme and host of http targets and defaults to AWS for s3:// targets.
+func ParseS3URL(target, endpoint, region string, pathStyle bool) (s *S3, root string, err error) {
+	u, err := url.Parse(target)
 	if err != nil {
-		return err
+		return nil, "", err
 	}
-	defer resp.Body.Close()
-
-	if code := resp.StatusCode; code != 200 {
-		msg, _ := ioutil.ReadAll(resp.Body)
-		return errors.New(
-			fmt.Sprintf("Expected 200 OK, got: (%d)\n%s", code, string(msg)),
-		)
+	switch u.Scheme {
+	case "s3":
+		if endpoint == "" {
+			endpoint = "https://s3.amazonaws.com"
+			if region != "" {
+				endpoint = "https://s3." + region + ".amazonaws.com"
+			}
+		}
+		s, err = NewS3Endpoint(endpoint, u.Host, region, pathStyle)
+		return s, u.Path, err
+	case "http", "https":
+		if endpoint == "" {
+			endpoint = u.Scheme + "://" + u.Host
+		}
+		if !pathStyle {
+			s = NewS3(endpoint)
+			s.Region = region
+			return s, u.Path, nil
+		}
+		parts := strings.SplitN(strings.TrimLeft(u.Path, "/"), "/", 2)
+		if parts[0] == "" {
+			return nil, "", errors.New("Expected a bucket in the path of: " + target)
+		}
+		if len(parts) == 2 {
+			root = "/" + parts[1]
+		}
+		s, err = NewS3Endpoint(endpoint, parts[0], region, true)
+		return s, root, err
 	}
+	return nil, "", errors.New("Not a S3 url: " + target)
+}
 
-	return nil
+func init() {
+	for _, scheme := range []string{"s3", "http", "https"} {
+		Register(scheme, openS3)
+	}
 }
 
-// S3 implements the SaveFetcher for Amazon S3.
-type S3 struct {
-	// The full path to the bucket host.
-	// Example: https://mongotool.s3.amazonaws.com
-	Bucket string
-	client *http.Client
+// openS3 opens S3 targets as parsed by ParseS3URL, taking the options:
+//
+//	endpoint           S3 compatible endpoint, such as http://minio:9000
+//	region             region to sign requests for
+//	path-style         address the bucket in the path, true or false
+//	profile            profile of the shared credentials file
+//	retries            times a request is attempted before giving up
+//	retry-delay        base delay between attempts, such as 200ms
+//	sse                server-side encryption, AES256 or aws:kms
+//	sse-kms-key-id     KMS key of aws:kms server-side encryption
+//	sse-c-key-file     file of a 32 bytes customer key for SSE-C, raw or hex
+//	storage-class      storage class of saved objects, such as GLACIER
+//	lock-mode          Object Lock retention mode, GOVERNANCE or COMPLIANCE
+//	lock-retain-until  date or duration from now saved objects are retained until
+//	lock-legal-hold    put saved objects under legal hold, true or false
+func openS3(u *url.URL) (SaveFetcher, string, error) {
+	q := u.Query()
+	pathStyle := false
+	if v := q.Get("path-style"); v != "" {
+		var err error
+		if pathStyle, err = strconv.ParseBool(v); err != nil {
+			return nil, "", fmt.Errorf("Invalid path-style %q", v)
+		}
+	}
+	target := *u
+	target.RawQuery = ""
+	s, root, err := ParseS3URL(target.String(), q.Get("endpoint"), q.Get("region"), pathStyle)
+	if err != nil {
+		return nil, "", err
+	}
+	if v := q.Get("retries"); v != "" {
+		if s.Retry.Attempts, err = strconv.Atoi(v); err != nil {
+			return nil, "", fmt.Errorf("Invalid retries %q", v)
+		}
+	}
+	if v := q.Get("retry-delay"); v != "" {
+		if s.Retry.Delay, err = time.ParseDuration(v); err != nil {
+			return nil, "", fmt.Errorf("Invalid retry-delay %q", v)
+		}
+	}
+	var customerKey []byte
+	if filename := q.Get("sse-c-key-file"); filename != "" {
+		if customerKey, err = ReadSecretFile(filename); err != nil {
+			return nil, "", err
+		}
+	}
+	if class := strings.ToUpper(q.Get("storage-class")); class != "" {
+		if !validStorageClass(class) {
+			return nil, "", fmt.Errorf("Unknown storage class %q, expected one of: %s", class, strings.Join(StorageClasses, ", "))
+		}
+		s.StorageClass = class
+	}
+	if s.Encryption, err = NewServerSideEncryption(q.Get("sse"), q.Get("sse-kms-key-id"), customerKey); err != nil {
+		return nil, "", err
+	}
+	legalHold := false
+	if v := q.Get("lock-legal-hold"); v != "" {
+		if legalHold, err = strconv.ParseBool(v); err != nil {
+			return nil, "", fmt.Errorf("Invalid lock-legal-hold %q", v)
+		}
+	}
+	if s.Lock, err = NewObjectLock(q.Get("lock-mode"), q.Get("lock-retain-until"), legalHold); err != nil {
+		return nil, "", err
+	}
+	s.Credentials = NewChainCredentials(q.Get("profile"))
+	return s, root, nil
 }
 
 func NewS3(bucket string) *S3 {
 	return &S3{
-		bucket,
-		&http.Client{
+		Bucket:          bucket,
+		PartSize:        DefaultPartSize,
+		PartConcurrency: DefaultPartConcurrency,
+		Retry:           DefaultRetryPolicy,
+		Credentials:     NewChainCredentials(""),
+		client: &http.Client{
 			// For some reason S3 will mess up subsequent GET's if keep alive.
 			Transport: &http.Transport{DisableKeepAlives: true},
 		},
 	}
 }
 
-// checkAwsKeys will look for they environment variables implicitly used by go-aws-auth
+func (s *S3) limitTransport(upload, download, requests *Limiter) {
+	s.client = limitClient(s.client, upload, download, requests)
+}
+
+// checkAwsKeys makes sure there are credentials to sign with before any request is sent.
 func (s S3) checkAwsKeys() error {
-	if os.Getenv("AWS_ACCESS_KEY_ID") == "" {
-		return errors.New("Missing AWS_ACCESS_KEY_ID environment variable")
+	_, err := s.Credentials.Credentials()
+	return err
+}
+
+// objectReq is the requestBuilder signing requests with the current credentials of the provider.
+func (s S3) objectReq(method, bucket, path string, body io.Reader) (*http.Request, error) {
+	return s.request(method, bucket, path, body, nil, "")
+}
+
+// uploadReq returns the requestBuilder of uploads, sending header along when creating the object.
+func (s S3) uploadReq(header http.Header) requestBuilder {
+	return func(method, bucket, path string, body io.Reader, sum string) (*http.Request, error) {
+		return s.request(method, bucket, path, body, header, sum)
+	}
+}
+
+// request builds a signed request, sending header along when it creates an object.
+// S3 verifies uploads against sum, their base64 MD5, which objects under Object Lock even require.
+func (s S3) request(method, bucket, path string, body io.Reader, header http.Header, sum string) (*http.Request, error) {
+	creds, err := s.Credentials.Credentials()
+	if err != nil {
+		return nil, err
 	}
-	if os.Getenv("AWS_SECRET_ACCESS_KEY") == "" {
-		return errors.New("Missing AWS_SECRET_ACCESS_KEY environment variable")
+	region := s.Region
+	if region == "" {
+		if u, err := url.Parse(bucket); err == nil {
+			region = guessRegion(u.Host)
+		}
 	}
-	return nil
+	h := s.Encryption.header(method, path)
+	if s3Creates(method, path) {
+		for name, values := range header {
+			h[name] = values
+		}
+		if s.StorageClass != "" {
+			h.Set("X-Amz-Storage-Class", s.StorageClass)
+		}
+		for name, values := range s.Lock.header() {
+			h[name] = values
+		}
+	}
+	if sum != "" {
+		h.Set("Content-Md5", sum)
+	}
+	return S3ObjectReqHeader(method, bucket, path, body, h, region, creds)
 }
 
 func (s S3) Save(path string) (io.WriteCloser, error) {
+	return s.SaveTags(path, nil)
+}
+
+// SaveTags saves the tags both as user metadata (x-amz-meta-*) and as object tags. S3 allows at most
+// 10 tags of limited length and characters, the rest of the tags are only kept as metadata.
+func (s S3) SaveTags(path string, tags Tagger) (io.WriteCloser, error) {
 	if err := s.checkAwsKeys(); err != nil {
 		return nil, err
 	}
-	return news3FileWriter(s.Bucket, path, S3ObjectReq), nil
+	var header http.Header
+	if tags != nil {
+		header = tagHeader(tags.Tags())
+	}
+	sf := news3FileWriter(s.Bucket, path, s.uploadReq(header))
+	sf.client = s.client
+	sf.retry = s.Retry
+	if s.PartSize >= MinPartSize {
+		sf.partSize = int(s.PartSize)
+	}
+	if s.PartConcurrency > 0 {
+		sf.sem = make(chan bool, s.PartConcurrency)
+	}
+	return sf, nil
+}
+
+// s3ListResult is the part of a ListObjects response we care about.
+type s3ListResult struct {
+	IsTruncated bool
+	NextMarker  string
+	Contents    []struct {
+		Key          string
+		LastModified time.Time
+		Size         int64
+	}
 }
 
+// Walk calls walkfn for every object under p, following the listing markers
+// until S3 reports that the listing is no longer truncated.
 func (s S3) Walk(p string, walkfn WalkFunc) error {
 	if err := s.checkAwsKeys(); err != nil {
 		return err
 	}
 	p = strings.TrimLeft(p, "/")
-	if string(p[0]) != "/" {
+	if p != "" && !strings.HasSuffix(p, "/") {
 		p += "/"
 	}
-	req, err := http.NewRequest("GET", s.Bucket, nil)
-	if err != nil {
-		return err
-	}
-	params := req.URL.Query()
-	params.Set("prefix", p)
-	req.URL.RawQuery = params.Encode()
 
-	signMu.Lock()
-	awsauth.Sign4(req)
-	signMu.Unlock()
+	marker := ""
+	for {
+		list, err := s.list(p, marker)
+		if err != nil {
+			return err
+		}
+		for _, entry := range list.Contents {
+			if err := walkfn(entry.Key, nil); err != nil {
+				return err
+			}
+		}
+		if !list.IsTruncated || len(list.Contents) == 0 {
+			return nil
+		}
+		// NextMarker is only returned when a delimiter is used, otherwise the last key is the marker.
+		if marker = list.NextMarker; marker == "" {
+			marker = list.Contents[len(list.Contents)-1].Key
+		}
+	}
+}
 
-	resp, err := s.client.Do(req)
+// list fetches one page of at most 1000 objects with the given prefix, starting after marker.
+func (s S3) list(prefix, marker string) (*s3ListResult, error) {
+	params := url.Values{"prefix": {prefix}}
+	if marker != "" {
+		params.Set("marker", marker)
+	}
+	resp, err := s.Retry.Do(s.client, func() (*http.Request, error) {
+		return s.objectReq("GET", s.Bucket, "?"+params.Encode(), nil)
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 	respBody, err := ioutil.ReadAll(resp.Body)
 	resp.Body.Close()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if code := resp.StatusCode; code != http.StatusOK {
-		return errors.New(fmt.Sprintf("Unexpected status code: %d\n%s", code, string(respBody)))
+		return nil, errors.New(fmt.Sprintf("Unexpected status code: %d\n%s", code, string(respBody)))
 	}
 
-	// FIXME: Limited to returning 1000 objects, the rest has to be iterated in follow up requests
-	bucketlist := struct {
-		Contents []struct {
-			Key          string
-			LastModified time.Time
-			Size         int64
-		}
-	}{}
-
-	err = xml.Unmarshal(respBody, &bucketlist)
-	if err != nil {
-		return err
-	}
-	for _, entry := range bucketlist.Contents {
-		walkfn(entry.Key, nil)
+	list := new(s3ListResult)
+	if err := xml.Unmarshal(respBody, list); err != nil {
+		return nil, err
 	}
-	return nil
+	return list, nil
 }
 
 func (s S3) Fetch(path string) (io.ReadCloser, error) {
 	if err := s.checkAwsKeys(); err != nil {
 		return nil, err
 	}
-	req, err := S3ObjectReq("GET", s.Bucket, path, nil)
-	if err != nil {
-		return nil, err
-	}
-	resp, err := s.client.Do(req)
+	resp, err := s.Retry.Do(s.client, func() (*http.Request, error) {
+		return s.objectReq("GET", s.Bucket, path, nil)
+	})
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		return nil, err
 	}
 	if code := resp.StatusCode; code != http.StatusOK {
-		// Don't output body here as it might be a huge file and we can return the body directly
-		return nil, errors.New(fmt.Sprintf("Unexpected status code: %d\n%s", code))
+		switch code {
+		case http.StatusNotFound:
+			resp.Body.Close()
+			return nil, &os.PathError{Op: "fetch", Path: path, Err: os.ErrNotExist}
+		case http.StatusForbidden:
+			// The error is small enough to be read, unlike bodies of other codes which might be objects.
+			if readS3Error(resp).Code == "InvalidObjectState" {
+				return nil, &ArchivedError{path}
+			}
+		default:
+			resp.Body.Close()
+		}
+		return nil, errors.New(fmt.Sprintf("Unexpected status code: %d", code))
+	}
+
+	return verifyETag(resp, path)
+}
+
+// verifyETag returns the body of resp failing with a ChecksumError at the end if it doesn't match the
+// ETag. Only ETags of objects uploaded in one part and not encrypted with SSE-KMS or SSE-C are their MD5.
+func verifyETag(resp *http.Response, path string) (io.ReadCloser, error) {
+	etag := strings.Trim(resp.Header.Get("ETag"), `"`)
+	sum, err := hex.DecodeString(etag)
+	if err != nil || len(sum) != md5.Size ||
+		strings.HasPrefix(resp.Header.Get("X-Amz-Server-Side-Encryption"), SSEKMS) ||
+		resp.Header.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") != "" {
+		return resp.Body, nil
+	}
+	return &verifyingReader{resp.Body, md5.New(), sum, path, "MD5"}, nil
+}
+
+// Stat sends a HEAD request for the object on path.
+func (s S3) Stat(path string) (ObjectInfo, error) {
+	if err := s.checkAwsKeys(); err != nil {
+		return ObjectInfo{}, err
+	}
+	resp, err := s.Retry.Do(s.client, func() (*http.Request, error) {
+		return s.objectReq("HEAD", s.Bucket, path, nil)
+	})
+	if err != nil {
+		return ObjectInfo{}, err
 	}
+	resp.Body.Close()
+	switch code := resp.StatusCode; code {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return ObjectInfo{}, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+	default:
+		return ObjectInfo{}, errors.New(fmt.Sprintf("Unexpected status code: %d", code))
+	}
+	info := ObjectInfo{
+		Path:         strings.TrimLeft(path, "/"),
+		Size:         resp.ContentLength,
+		ETag:         strings.Trim(resp.Header.Get("ETag"), `"`),
+		StorageClass: resp.Header.Get("X-Amz-Storage-Class"),
+		Archived:     archived(resp.Header),
+	}
+	// S3 leaves out the header for the default class.
+	if info.StorageClass == "" {
+		info.StorageClass = "STANDARD"
+	}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = t
+	}
+	for name, values := range resp.Header {
+		if strings.HasPrefix(name, "X-Amz-Meta-") {
+			if info.Tags == nil {
+				info.Tags = make(map[string]string)
+			}
+			info.Tags[strings.ToLower(strings.TrimPrefix(name, "X-Amz-Meta-"))] = decodeTag(values[0])
+		}
+	}
+	return info, nil
+}
+
+// Delete deletes the object on path. Like S3 itself, deleting a missing object is not an error.
+func (s S3) Delete(path string) error {
+	if err := s.checkAwsKeys(); err != nil {
+		return err
+	}
+	resp, err := s.Retry.Do(s.client, func() (*http.Request, error) {
+		return s.objectReq("DELETE", s.Bucket, path, nil)
+	})
+	if err != nil {
+		return err
+	}
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if code := resp.StatusCode; code != http.StatusNoContent && code != http.StatusOK {
+		return errors.New(fmt.Sprintf("Unexpected status code: %d\n%s", code, string(respBody)))
+	}
+	return nil
+}
+
+// maxS3Tags is how many tags S3 allows on one object.
+const maxS3Tags = 10
+
+// maxS3Metadata is how many bytes of user metadata S3 allows on one object.
+const maxS3Metadata = 2 * KB
+
+// tagHeader returns the headers saving tags as metadata and object tags. Tags beyond the limit of
+// user metadata are left out of it.
+func tagHeader(tags map[string]string) http.Header {
+	h := make(http.Header)
+	for name, value := range limitTags(encodeTags(tags), int(maxS3Metadata)) {
+		h.Set("X-Amz-Meta-"+name, value)
+	}
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tagging := url.Values{}
+	for _, name := range names {
+		value := tags[name]
+		if len(tagging) < maxS3Tags && len(name) <= 128 && len(value) <= 256 && validS3Tag(name) && validS3Tag(value) {
+			tagging.Set(name, value)
+		}
+	}
+	if len(tagging) > 0 {
+		h.Set("X-Amz-Tagging", tagging.Encode())
+	}
+	return h
+}
 
-	return resp.Body, nil
+// validS3Tag tells if s only holds the characters S3 allows in tags.
+func validS3Tag(s string) bool {
+	for _, r := range s {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsSpace(r) && !strings.ContainsRune("+-=._:/@", r) {
+			return false
+		}
+	}
+	return true
 }
 
 func fullPath(bucket, path string) string {
@@ -186,13 +513,20 @@ func fullPath(bucket, path string) string {
 	return bucket + path
 }
 
-func S3ObjectReq(method, bucket, path string, body io.Reader) (req *http.Request, err error) {
+// S3ObjectReq returns a request for the object on path in bucket, signed with creds for the region.
+// Temporary credentials will have their session token sent along.
+func S3ObjectReq(method, bucket, path string, body io.Reader, region string, creds Credentials) (req *http.Request, err error) {
+	return S3ObjectReqHeader(method, bucket, path, body, nil, region, creds)
+}
+
+// S3ObjectReqHeader is S3ObjectReq sending the given headers along, which are signed with the request.
+func S3ObjectReqHeader(method, bucket, path string, body io.Reader, header http.Header, region string, creds Credentials) (req *http.Request, err error) {
 	if req, err = http.NewRequest(method, fullPath(bucket, path), body); err != nil {
 		return
 	}
-
-	signMu.Lock()
-	awsauth.Sign4(req)
-	signMu.Unlock()
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	err = signV4(req, creds, region, time.Now())
 	return
 }
@@ -0,0 +1,276 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+)
+
+// s3Part is one uploaded part of a multipart upload.
+type s3Part struct {
+	PartNumber int
+	ETag       string
+}
+
+// s3FileWriter streams written data for one S3 object.
+// Data is buffered until a full part is available, which is then uploaded in the background as part
+// of a multipart upload. Objects smaller than one part are sent with a single PUT once closed.
+type s3FileWriter struct {
+	buf     bytes.Buffer
+	path    string
+	bucket  string
+	builder requestBuilder
+	client  *http.Client
+	retry   RetryPolicy
+	closed  bool
+
+	// partSize is how many bytes are buffered before they are sent as a part.
+	partSize int
+	// sem limits how many parts may be uploaded at the same time.
+	sem chan bool
+	// uploadId is set once the multipart upload has been initiated.
+	uploadId string
+
+	wg sync.WaitGroup
+	// mu protects parts and err, which are updated by the part uploads.
+	mu    sync.Mutex
+	parts []s3Part
+	err   error
+}
+
+func news3FileWriter(bucket, path string, builder requestBuilder) *s3FileWriter {
+	sf := s3FileWriter{
+		bucket:   bucket,
+		path:     path,
+		builder:  builder,
+		client:   http.DefaultClient,
+		retry:    DefaultRetryPolicy,
+		partSize: int(DefaultPartSize),
+		sem:      make(chan bool, DefaultPartConcurrency),
+	}
+	return &sf
+}
+
+// Len returns how many bytes are buffered and not yet sent.
+func (sf *s3FileWriter) Len() int {
+	return sf.buf.Len()
+}
+
+// Write buffers p and uploads every full part, blocking when too many parts are already in flight.
+func (sf *s3FileWriter) Write(p []byte) (int, error) {
+	if err := sf.error(); err != nil {
+		return 0, err
+	}
+	n, _ := sf.buf.Write(p)
+	for sf.buf.Len() >= sf.partSize {
+		if err := sf.uploadPart(sf.buf.Next(sf.partSize)); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Close sends whatever is left and completes the upload, aborting it if any part failed.
+func (sf *s3FileWriter) Close() error {
+	if sf.closed {
+		return nil
+	}
+	sf.closed = true
+
+	if sf.uploadId == "" {
+		if err := sf.error(); err != nil {
+			return err
+		}
+		_, err := sf.send("PUT", nil, sf.buf.Bytes())
+		return err
+	}
+
+	if sf.buf.Len() > 0 {
+		sf.uploadPart(sf.buf.Bytes())
+	}
+	sf.wg.Wait()
+
+	err := sf.error()
+	if err == nil {
+		err = sf.complete()
+	}
+	if err != nil {
+		sf.abort()
+	}
+	return err
+}
+
+// Abort gives up the upload, discarding the parts uploaded so far.
+func (sf *s3FileWriter) Abort() error {
+	if sf.closed {
+		return nil
+	}
+	sf.closed = true
+	sf.wg.Wait()
+	if sf.uploadId == "" {
+		return nil
+	}
+	return sf.abort()
+}
+
+// error returns the first error any part upload ran into.
+func (sf *s3FileWriter) error() error {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	return sf.err
+}
+
+func (sf *s3FileWriter) setError(err error) {
+	sf.mu.Lock()
+	if sf.err == nil {
+		sf.err = err
+	}
+	sf.mu.Unlock()
+}
+
+// uploadPart starts uploading a copy of data as the next part, initiating the multipart upload if needed.
+func (sf *s3FileWriter) uploadPart(data []byte) error {
+	if sf.uploadId == "" {
+		if err := sf.initiate(); err != nil {
+			sf.setError(err)
+			return err
+		}
+	}
+	// The buffer will be reused for following writes, so the part needs its own copy.
+	part := make([]byte, len(data))
+	copy(part, data)
+
+	sf.sem <- true
+	sf.mu.Lock()
+	sf.parts = append(sf.parts, s3Part{PartNumber: len(sf.parts) + 1})
+	n := len(sf.parts)
+	sf.mu.Unlock()
+
+	sf.wg.Add(1)
+	go func() {
+		defer func() {
+			<-sf.sem
+			sf.wg.Done()
+		}()
+		params := url.Values{
+			"partNumber": {strconv.Itoa(n)},
+			"uploadId":   {sf.uploadId},
+		}
+		h, err := sf.send("PUT", params, part)
+		if err != nil {
+			sf.setError(err)
+			return
+		}
+		sf.mu.Lock()
+		sf.parts[n-1].ETag = h.Get("ETag")
+		sf.mu.Unlock()
+	}()
+	return nil
+}
+
+// initiate starts a new multipart upload and remembers its upload id.
+func (sf *s3FileWriter) initiate() error {
+	resp := struct {
+		UploadId string
+	}{}
+	if err := sf.sendXML("POST", url.Values{"uploads": {""}}, nil, &resp); err != nil {
+		return err
+	}
+	if resp.UploadId == "" {
+		return errors.New("Missing UploadId when initiating multipart upload of " + sf.path)
+	}
+	sf.uploadId = resp.UploadId
+	return nil
+}
+
+// complete asks S3 to assemble the uploaded parts into the final object.
+func (sf *s3FileWriter) complete() error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: sf.parts})
+	if err != nil {
+		return err
+	}
+	// A failed complete could still be reported with 200 OK, so look for an error in the body.
+	resp := struct {
+		XMLName xml.Name
+		Code    string
+		Message string
+	}{}
+	if err := sf.sendXML("POST", url.Values{"uploadId": {sf.uploadId}}, body, &resp); err != nil {
+		return err
+	}
+	if resp.XMLName.Local == "Error" {
+		return errors.New(fmt.Sprintf("Could not complete multipart upload of %s: %s: %s", sf.path, resp.Code, resp.Message))
+	}
+	return nil
+}
+
+// abort discards all parts uploaded so far so that they are not stored (and billed) by S3.
+func (sf *s3FileWriter) abort() error {
+	resp, err := sf.do("DELETE", url.Values{"uploadId": {sf.uploadId}}, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// sendXML sends the request and unmarshals the XML response into v.
+func (sf *s3FileWriter) sendXML(method string, params url.Values, body []byte, v interface{}) error {
+	resp, err := sf.do(method, params, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if code := resp.StatusCode; code != 200 {
+		return errors.New(
+			fmt.Sprintf("Expected 200 OK, got: (%d)\n%s", code, string(msg)),
+		)
+	}
+	return xml.Unmarshal(msg, v)
+}
+
+// send sends the request and returns the response headers if it succeeded.
+func (sf *s3FileWriter) send(method string, params url.Values, body []byte) (http.Header, error) {
+	resp, err := sf.do(method, params, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if code := resp.StatusCode; code != 200 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, errors.New(
+			fmt.Sprintf("Expected 200 OK, got: (%d)\n%s", code, string(msg)),
+		)
+	}
+	return resp.Header, nil
+}
+
+// do sends a signed request for the object with params as query string, retrying according to the policy.
+func (sf *s3FileWriter) do(method string, params url.Values, body []byte) (*http.Response, error) {
+	path := sf.path
+	if len(params) > 0 {
+		path += "?" + params.Encode()
+	}
+	// The MD5 is computed once from the buffer, rather than by every attempt from a copy of it.
+	sum := ""
+	if method == "PUT" {
+		sum = md5Base64(body)
+	}
+	return sf.retry.Do(sf.client, func() (*http.Request, error) {
+		return sf.builder(method, sf.bucket, path, bytes.NewReader(body), sum)
+	})
+}
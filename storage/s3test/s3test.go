@@ -0,0 +1,608 @@
+// Package s3test implements an in-process S3 server for testing, addressing buckets path-style.
+//
+// It supports PUT, GET with ranges, HEAD, DELETE, ListObjects with pagination and multipart uploads,
+// and loosely checks that requests are signed with Signature Version 4, without verifying signatures.
+// Server-side encryption headers are stored with objects, and SSE-C keys have to match when reading.
+// Objects saved with the GLACIER or DEEP_ARCHIVE storage class have to be restored to be read.
+// Objects under Object Lock retention or legal hold can't be deleted or overwritten, as no versions are kept,
+// and uploading them requires Content-MD5.
+// Errors and latency can be injected to test retries and timeouts.
+package s3test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Object is an object saved on the server.
+type Object struct {
+	Data    []byte
+	ETag    string
+	ModTime time.Time
+	// Header holds the x-amz-* and Content-Type headers the object was saved with.
+	Header http.Header
+
+	// restored is when a restore of the archived object is done, zero unless one was requested.
+	restored time.Time
+}
+
+// archived tells if the object is of an archive storage class and not restored.
+func (o *Object) archived() bool {
+	switch o.Header.Get("X-Amz-Storage-Class") {
+	case "GLACIER", "DEEP_ARCHIVE":
+		return o.restored.IsZero() || time.Now().Before(o.restored)
+	}
+	return false
+}
+
+// locked tells if the object is under legal hold or retained.
+func (o *Object) locked() bool {
+	if o.Header.Get("X-Amz-Object-Lock-Legal-Hold") == "ON" {
+		return true
+	}
+	until, err := time.Parse(time.RFC3339, o.Header.Get("X-Amz-Object-Lock-Retain-Until-Date"))
+	return err == nil && time.Now().Before(until)
+}
+
+// lockRequested tells if a request creating an object asks for it to be locked.
+func lockRequested(header http.Header) bool {
+	return header.Get("X-Amz-Object-Lock-Mode") != "" || header.Get("X-Amz-Object-Lock-Legal-Hold") == "ON"
+}
+
+// Request is a request the server received.
+type Request struct {
+	Method string
+	Bucket string
+	Key    string
+	Query  map[string][]string
+	Header http.Header
+}
+
+type upload struct {
+	bucket, key string
+	header      http.Header
+	parts       map[int]*Object
+}
+
+// Server is a S3 server listening on a local address, see httptest.Server.
+type Server struct {
+	*httptest.Server
+
+	// PageSize is how many objects ListObjects returns at most, 1000 unless set.
+	PageSize int
+	// MinPartSize is the smallest size of every part but the last one of a multipart upload.
+	// S3 requires 5MB, while parts of any size are accepted when it is 0.
+	MinPartSize int
+	// AllowUnsigned accepts requests without a Signature Version 4 Authorization header.
+	AllowUnsigned bool
+	// RestoreDelay is how long restoring objects of the GLACIER and DEEP_ARCHIVE storage classes takes.
+	RestoreDelay time.Duration
+
+	mu       sync.Mutex
+	buckets  map[string]map[string]*Object
+	uploads  map[string]*upload
+	nextID   int
+	requests []Request
+	latency  time.Duration
+	failures int
+	failCode int
+	hook     func(r *http.Request) int
+}
+
+// NewServer starts a server without any buckets. Close it when done.
+func NewServer() *Server {
+	s := &Server{
+		PageSize: 1000,
+		buckets:  make(map[string]map[string]*Object),
+		uploads:  make(map[string]*upload),
+	}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// CreateBucket creates an empty bucket unless it already exists.
+func (s *Server) CreateBucket(bucket string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.buckets[bucket] == nil {
+		s.buckets[bucket] = make(map[string]*Object)
+	}
+}
+
+// BucketURL creates bucket and returns its url, such as http://127.0.0.1:4567/bucket.
+func (s *Server) BucketURL(bucket string) string {
+	s.CreateBucket(bucket)
+	return s.URL + "/" + bucket
+}
+
+// PutObject saves an object without going through a request, creating the bucket if needed.
+func (s *Server) PutObject(bucket, key string, data []byte) {
+	s.CreateBucket(bucket)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buckets[bucket][key] = newObject(data, nil)
+}
+
+// Object returns the object saved on key in bucket.
+func (s *Server) Object(bucket, key string) (*Object, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.buckets[bucket][key]
+	return o, ok
+}
+
+// Keys returns the keys of every object in bucket, sorted.
+func (s *Server) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keys(bucket)
+}
+
+func (s *Server) keys(bucket string) []string {
+	keys := make([]string, 0, len(s.buckets[bucket]))
+	for key := range s.buckets[bucket] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Uploads returns how many multipart uploads are in progress, neither completed nor aborted.
+func (s *Server) Uploads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.uploads)
+}
+
+// Requests returns every request received so far, including the failed ones.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// SetLatency delays every following request by d.
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = d
+}
+
+// FailNext fails the next n requests with the status code, such as 503 for SlowDown.
+func (s *Server) FailNext(n, code int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures, s.failCode = n, code
+}
+
+// SetHook calls hook before handling every request. Returning a status code other than 0 fails the
+// request with it.
+func (s *Server) SetHook(hook func(r *http.Request) int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hook = hook
+}
+
+func newObject(data []byte, header http.Header) *Object {
+	sum := md5.Sum(data)
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &Object{
+		Data:    data,
+		ETag:    `"` + hex.EncodeToString(sum[:]) + `"`,
+		ModTime: time.Now().UTC().Truncate(time.Second),
+		Header:  header,
+	}
+}
+
+// objectHeader picks the headers of r stored with an object.
+func objectHeader(r *http.Request) http.Header {
+	h := make(http.Header)
+	for name, values := range r.Header {
+		switch name {
+		case "X-Amz-Date", "X-Amz-Content-Sha256", "X-Amz-Security-Token", "X-Amz-Copy-Source",
+			"X-Amz-Server-Side-Encryption-Customer-Key":
+		default:
+			if strings.HasPrefix(name, "X-Amz-") || name == "Content-Type" {
+				h[name] = values
+			}
+		}
+	}
+	return h
+}
+
+// metadataSize returns the size of the user metadata in h, which S3 limits to 2KB.
+func metadataSize(h http.Header) int {
+	size := 0
+	for name, values := range h {
+		if strings.HasPrefix(name, "X-Amz-Meta-") {
+			size += len(name) - len("X-Amz-Meta-") + len(values[0])
+		}
+	}
+	return size
+}
+
+// writeError writes an error response the way S3 does.
+func writeError(w http.ResponseWriter, code int, s3Code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", s3Code, message)
+}
+
+// checkCustomerKey makes sure the request has the same SSE-C key as the object, or upload, having
+// header, and that the key matches its MD5.
+func checkCustomerKey(r *http.Request, header http.Header) string {
+	const prefix = "X-Amz-Server-Side-Encryption-Customer-"
+	key, err := base64.StdEncoding.DecodeString(r.Header.Get(prefix + "Key"))
+	sum := md5.Sum(key)
+	if err != nil || r.Header.Get(prefix+"Key-Md5") != base64.StdEncoding.EncodeToString(sum[:]) {
+		return "The calculated MD5 hash of the key did not match the hash that was provided"
+	}
+	if r.Header.Get(prefix+"Key-Md5") != header.Get(prefix+"Key-Md5") {
+		return "The provided encryption parameters did not match the ones used originally"
+	}
+	return ""
+}
+
+// checkSignature makes sure the request looks signed with Signature Version 4 for its payload,
+// without checking the signature itself.
+func checkSignature(r *http.Request, body []byte) string {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=") {
+		return "Missing Signature Version 4 Authorization header"
+	}
+	for _, part := range []string{"SignedHeaders=", "Signature="} {
+		if !strings.Contains(auth, part) {
+			return "Authorization header has no " + part
+		}
+	}
+	if r.Header.Get("X-Amz-Date") == "" {
+		return "Missing X-Amz-Date header"
+	}
+	signed := auth[strings.Index(auth, "SignedHeaders="):]
+	signed = ";" + strings.SplitN(strings.TrimPrefix(signed, "SignedHeaders="), ",", 2)[0] + ";"
+	for name := range r.Header {
+		if name = strings.ToLower(name); strings.HasPrefix(name, "x-amz-") && !strings.Contains(signed, ";"+name+";") {
+			return "Header " + name + " is not signed"
+		}
+	}
+	sum := sha256.Sum256(body)
+	if sha := r.Header.Get("X-Amz-Content-Sha256"); sha != "UNSIGNED-PAYLOAD" && sha != hex.EncodeToString(sum[:]) {
+		return "X-Amz-Content-Sha256 does not match the payload"
+	}
+	return ""
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	bucket, key := parts[0], ""
+	if len(parts) == 2 {
+		key = parts[1]
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, Request{r.Method, bucket, key, r.URL.Query(), r.Header})
+	latency, hook := s.latency, s.hook
+	code := 0
+	if s.failures > 0 {
+		s.failures--
+		code = s.failCode
+	}
+	s.mu.Unlock()
+
+	time.Sleep(latency)
+	if code == 0 && hook != nil {
+		code = hook(r)
+	}
+	if code != 0 {
+		s3Code := "InjectedError"
+		switch code {
+		case http.StatusServiceUnavailable:
+			s3Code = "SlowDown"
+		case http.StatusInternalServerError:
+			s3Code = "InternalError"
+		}
+		writeError(w, code, s3Code, "Injected by s3test")
+		return
+	}
+	if !s.AllowUnsigned {
+		if msg := checkSignature(r, body); msg != "" {
+			writeError(w, http.StatusForbidden, "SignatureDoesNotMatch", msg)
+			return
+		}
+	}
+	if r.Header.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") != "" {
+		if msg := checkCustomerKey(r, r.Header); msg != "" {
+			writeError(w, http.StatusBadRequest, "InvalidArgument", msg)
+			return
+		}
+	}
+	if metadataSize(r.Header) > 2048 {
+		writeError(w, http.StatusBadRequest, "MetadataTooLarge", "Your metadata headers exceed the maximum allowed metadata size")
+		return
+	}
+	if md5sum := r.Header.Get("Content-Md5"); md5sum != "" {
+		sum := md5.Sum(body)
+		if md5sum != base64.StdEncoding.EncodeToString(sum[:]) {
+			writeError(w, http.StatusBadRequest, "BadDigest", "Content-MD5 does not match the payload")
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+	q := r.URL.Query()
+	switch {
+	case key == "" && r.Method == "GET":
+		s.list(w, bucket, q)
+	case key == "":
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "Bucket operations are not supported")
+	case r.Method == "POST" && q["restore"] != nil:
+		o, ok := objects[key]
+		switch {
+		case !ok:
+			writeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist")
+		case !o.archived() && o.restored.IsZero():
+			writeError(w, http.StatusForbidden, "InvalidObjectState", "Restore is not allowed for the object's current storage class")
+		case o.archived() && !o.restored.IsZero():
+			writeError(w, http.StatusConflict, "RestoreAlreadyInProgress", "Object restore is already in progress")
+		case !o.restored.IsZero():
+			w.WriteHeader(http.StatusOK)
+		default:
+			o.restored = time.Now().Add(s.RestoreDelay)
+			w.WriteHeader(http.StatusAccepted)
+		}
+	case r.Method == "PUT" && lockRequested(r.Header) && r.Header.Get("Content-Md5") == "":
+		writeError(w, http.StatusBadRequest, "InvalidRequest", "Content-MD5 HTTP header is required for Put Object requests with Object Lock parameters")
+	case (r.Method == "PUT" && q.Get("uploadId") == "" || r.Method == "DELETE") && objects[key] != nil && objects[key].locked():
+		writeError(w, http.StatusForbidden, "AccessDenied", "Access Denied because object protected by object lock")
+	case r.Method == "POST" && q["uploads"] != nil:
+		s.nextID++
+		id := fmt.Sprintf("upload-%d", s.nextID)
+		s.uploads[id] = &upload{bucket, key, objectHeader(r), make(map[int]*Object)}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>", bucket, key, id)
+	case q.Get("uploadId") != "":
+		u, ok := s.uploads[q.Get("uploadId")]
+		if !ok || u.bucket != bucket || u.key != key {
+			writeError(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist")
+			return
+		}
+		s.multipart(w, r, q, u, body)
+	case r.Method == "PUT":
+		o := newObject(body, objectHeader(r))
+		objects[key] = o
+		w.Header().Set("ETag", o.ETag)
+	case r.Method == "GET" || r.Method == "HEAD":
+		o, ok := objects[key]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist")
+			return
+		}
+		if r.Method == "GET" && o.archived() {
+			writeError(w, http.StatusForbidden, "InvalidObjectState", "The operation is not valid for the object's storage class")
+			return
+		}
+		if o.Header.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") != "" {
+			if msg := checkCustomerKey(r, o.Header); msg != "" {
+				writeError(w, http.StatusBadRequest, "InvalidRequest", msg)
+				return
+			}
+		}
+		serveObject(w, r, o)
+	case r.Method == "DELETE":
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "Unsupported request")
+	}
+}
+
+// multipart handles uploading parts, completing and aborting the upload u.
+func (s *Server) multipart(w http.ResponseWriter, r *http.Request, q map[string][]string, u *upload, body []byte) {
+	id := q["uploadId"][0]
+	switch r.Method {
+	case "PUT":
+		n, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+		if err != nil || n < 1 || n > 10000 {
+			writeError(w, http.StatusBadRequest, "InvalidArgument", "Part number must be an integer between 1 and 10000")
+			return
+		}
+		if r.Header.Get("X-Amz-Server-Side-Encryption") != "" {
+			writeError(w, http.StatusBadRequest, "InvalidArgument", "Server-side encryption is set when initiating the upload")
+			return
+		}
+		if u.header.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") != "" {
+			if msg := checkCustomerKey(r, u.header); msg != "" {
+				writeError(w, http.StatusBadRequest, "InvalidRequest", msg)
+				return
+			}
+		}
+		if lockRequested(u.header) && r.Header.Get("Content-Md5") == "" {
+			writeError(w, http.StatusBadRequest, "InvalidRequest", "Content-MD5 HTTP header is required for Upload Part requests with Object Lock parameters")
+			return
+		}
+		part := newObject(body, nil)
+		u.parts[n] = part
+		w.Header().Set("ETag", part.ETag)
+	case "POST":
+		var complete struct {
+			Part []struct {
+				PartNumber int
+				ETag       string
+			}
+		}
+		if err := xml.Unmarshal(body, &complete); err != nil || len(complete.Part) == 0 {
+			writeError(w, http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed")
+			return
+		}
+		var data bytes.Buffer
+		for i, p := range complete.Part {
+			part, ok := u.parts[p.PartNumber]
+			if !ok || part.ETag != p.ETag {
+				writeError(w, http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found")
+				return
+			}
+			if i > 0 && p.PartNumber <= complete.Part[i-1].PartNumber {
+				writeError(w, http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order")
+				return
+			}
+			if i < len(complete.Part)-1 && len(part.Data) < s.MinPartSize {
+				writeError(w, http.StatusBadRequest, "EntityTooSmall", "Your proposed upload is smaller than the minimum allowed object size")
+				return
+			}
+			data.Write(part.Data)
+		}
+		if old := s.buckets[u.bucket][u.key]; old != nil && old.locked() {
+			writeError(w, http.StatusForbidden, "AccessDenied", "Access Denied because object protected by object lock")
+			return
+		}
+		o := newObject(data.Bytes(), u.header)
+		// Multipart ETags are not the MD5 of the object, but end with the number of parts.
+		o.ETag = fmt.Sprintf(`"%s-%d"`, strings.Trim(o.ETag, `"`), len(complete.Part))
+		s.buckets[u.bucket][u.key] = o
+		delete(s.uploads, id)
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><Key>%s</Key><ETag>%s</ETag></CompleteMultipartUploadResult>", u.key, o.ETag)
+	case "DELETE":
+		delete(s.uploads, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "Unsupported request")
+	}
+}
+
+// list writes one page of ListObjects for bucket.
+func (s *Server) list(w http.ResponseWriter, bucket string, q map[string][]string) {
+	get := func(name string) string {
+		if v := q[name]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	prefix, marker := get("prefix"), get("marker")
+	max := s.PageSize
+	if v := get("max-keys"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n < max {
+			max = n
+		}
+	}
+
+	var page []string
+	truncated := false
+	for _, key := range s.keys(bucket) {
+		if !strings.HasPrefix(key, prefix) || key <= marker {
+			continue
+		}
+		if len(page) == max {
+			truncated = true
+			break
+		}
+		page = append(page, key)
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprintf(w, `<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Name>%s</Name><Prefix>%s</Prefix><Marker>%s</Marker><MaxKeys>%d</MaxKeys><IsTruncated>%t</IsTruncated>`,
+		bucket, prefix, marker, max, truncated)
+	for _, key := range page {
+		o := s.buckets[bucket][key]
+		class := o.Header.Get("X-Amz-Storage-Class")
+		if class == "" {
+			class = "STANDARD"
+		}
+		fmt.Fprintf(w, "<Contents><Key>%s</Key><LastModified>%s</LastModified><ETag>%s</ETag><Size>%d</Size><StorageClass>%s</StorageClass></Contents>",
+			key, o.ModTime.Format("2006-01-02T15:04:05.000Z"), o.ETag, len(o.Data), class)
+	}
+	fmt.Fprint(w, "</ListBucketResult>")
+}
+
+// serveObject writes o, or the range of it asked for.
+func serveObject(w http.ResponseWriter, r *http.Request, o *Object) {
+	for name, values := range o.Header {
+		if strings.HasPrefix(name, "X-Amz-Meta-") || strings.HasPrefix(name, "X-Amz-Server-Side-Encryption") ||
+			strings.HasPrefix(name, "X-Amz-Object-Lock-") || name == "X-Amz-Storage-Class" || name == "Content-Type" {
+			w.Header()[name] = values
+		}
+	}
+	if !o.restored.IsZero() {
+		if o.archived() {
+			w.Header().Set("X-Amz-Restore", `ongoing-request="true"`)
+		} else {
+			w.Header().Set("X-Amz-Restore", `ongoing-request="false", expiry-date="`+o.restored.Add(24*time.Hour).Format(http.TimeFormat)+`"`)
+		}
+	}
+	w.Header().Set("ETag", o.ETag)
+	w.Header().Set("Last-Modified", o.ModTime.Format(http.TimeFormat))
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	data, code := o.Data, http.StatusOK
+	if rng := r.Header.Get("Range"); rng != "" {
+		start, end, ok := parseRange(rng, len(data))
+		if !ok {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", len(data)))
+			writeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable")
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		data, code = data[start:end+1], http.StatusPartialContent
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(code)
+	if r.Method != "HEAD" {
+		w.Write(data)
+	}
+}
+
+// parseRange parses a single range of the form bytes=start-end, bytes=start- or bytes=-suffix.
+func parseRange(rng string, size int) (start, end int, ok bool) {
+	if !strings.HasPrefix(rng, "bytes=") || strings.Contains(rng, ",") {
+		return 0, 0, false
+	}
+	bounds := strings.SplitN(strings.TrimPrefix(rng, "bytes="), "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, false
+	}
+	var err error
+	switch {
+	case bounds[0] == "":
+		n, err := strconv.Atoi(bounds[1])
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, size > 0
+	case bounds[1] == "":
+		end = size - 1
+	default:
+		if end, err = strconv.Atoi(bounds[1]); err != nil {
+			return 0, 0, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	if start, err = strconv.Atoi(bounds[0]); err != nil || start > end || start >= size {
+		return 0, 0, false
+	}
+	return start, end, true
+}
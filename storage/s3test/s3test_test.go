@@ -0,0 +1,107 @@
+package s3test
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func get(url, rng string) (*http.Response, string) {
+	req, _ := http.NewRequest("GET", url, nil)
+	if rng != "" {
+		req.Header.Set("Range", rng)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	So(err, ShouldBeNil)
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	return resp, string(b)
+}
+
+func TestServer(t *testing.T) {
+	Convey("Given a server with an object", t, func() {
+		srv := NewServer()
+		defer srv.Close()
+		srv.PutObject("bucket", "object", []byte("0123456789"))
+		url := srv.BucketURL("bucket") + "/object"
+
+		Convey("Unsigned requests should be refused", func() {
+			resp, body := get(url, "")
+			So(resp.StatusCode, ShouldEqual, http.StatusForbidden)
+			So(body, ShouldContainSubstring, "SignatureDoesNotMatch")
+		})
+
+		Convey("Given unsigned requests are allowed", func() {
+			srv.AllowUnsigned = true
+
+			Convey("Ranges of the object should be served", func() {
+				for rng, want := range map[string]string{
+					"bytes=2-4":  "234",
+					"bytes=7-":   "789",
+					"bytes=-2":   "89",
+					"bytes=8-20": "89",
+				} {
+					resp, body := get(url, rng)
+					So(resp.StatusCode, ShouldEqual, http.StatusPartialContent)
+					So(body, ShouldEqual, want)
+				}
+				resp, _ := get(url, "bytes=10-")
+				So(resp.StatusCode, ShouldEqual, http.StatusRequestedRangeNotSatisfiable)
+			})
+
+			Convey("Missing objects and buckets should give S3 errors", func() {
+				resp, body := get(url+"-missing", "")
+				So(resp.StatusCode, ShouldEqual, http.StatusNotFound)
+				So(body, ShouldContainSubstring, "NoSuchKey")
+				resp, body = get(srv.URL+"/missing/object", "")
+				So(resp.StatusCode, ShouldEqual, http.StatusNotFound)
+				So(body, ShouldContainSubstring, "NoSuchBucket")
+			})
+
+			Convey("Listings should be paginated", func() {
+				srv.PageSize = 1
+				srv.PutObject("bucket", "other", nil)
+				_, body := get(srv.URL+"/bucket", "")
+				So(body, ShouldContainSubstring, "<IsTruncated>true</IsTruncated>")
+				So(body, ShouldContainSubstring, "<Key>object</Key>")
+				_, body = get(srv.URL+"/bucket?marker=object", "")
+				So(body, ShouldContainSubstring, "<IsTruncated>false</IsTruncated>")
+				So(body, ShouldContainSubstring, "<Key>other</Key>")
+			})
+
+			Convey("Small parts should be refused when a minimum is set", func() {
+				srv.MinPartSize = 5
+				do := func(method, query, body string) (*http.Response, string) {
+					req, _ := http.NewRequest(method, srv.URL+"/bucket/big?"+query, strings.NewReader(body))
+					resp, err := http.DefaultClient.Do(req)
+					So(err, ShouldBeNil)
+					b, _ := ioutil.ReadAll(resp.Body)
+					resp.Body.Close()
+					return resp, string(b)
+				}
+				_, body := do("POST", "uploads", "")
+				So(body, ShouldContainSubstring, "<UploadId>upload-1</UploadId>")
+				r1, _ := do("PUT", "uploadId=upload-1&partNumber=1", "foo")
+				r2, _ := do("PUT", "uploadId=upload-1&partNumber=2", "bar")
+				complete := "<CompleteMultipartUpload><Part><PartNumber>1</PartNumber><ETag>" + r1.Header.Get("ETag") +
+					"</ETag></Part><Part><PartNumber>2</PartNumber><ETag>" + r2.Header.Get("ETag") + "</ETag></Part></CompleteMultipartUpload>"
+				resp, body := do("POST", "uploadId=upload-1", complete)
+				So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+				So(body, ShouldContainSubstring, "EntityTooSmall")
+				So(srv.Uploads(), ShouldEqual, 1)
+			})
+
+			Convey("Injected errors should be returned", func() {
+				srv.FailNext(1, http.StatusServiceUnavailable)
+				resp, body := get(url, "")
+				So(resp.StatusCode, ShouldEqual, http.StatusServiceUnavailable)
+				So(body, ShouldContainSubstring, "SlowDown")
+				resp, _ = get(url, "")
+				So(resp.StatusCode, ShouldEqual, http.StatusOK)
+				So(len(srv.Requests()), ShouldEqual, 2)
+			})
+		})
+	})
+}
@@ -0,0 +1,349 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SFTP implements the SaveFetcher for a directory on a remote host, reached over SSH.
+// Objects are saved the same way as on the Filesystem: written to a temporary file which is renamed
+// into place once closed, with tags in a sidecar file.
+type SFTP struct {
+	Client *sftp.Client
+	// Root is the directory objects are saved under, relative to the home directory unless absolute.
+	Root string
+	// conn is the SSH connection of the client when dialed by DialSFTP, closed along with it.
+	conn io.Closer
+}
+
+// NewSFTP returns the storage of root on the host the client is connected to.
+func NewSFTP(client *sftp.Client, root string) *SFTP {
+	return &SFTP{Client: client, Root: root}
+}
+
+func init() {
+	Register("sftp", openSFTP)
+}
+
+// openSFTP connects to targets like sftp://user@host:port/absolute/path, or sftp://host/~/path for a
+// path in the home directory, taking the options:
+//
+//	identity     private key file, otherwise keys of ssh-agent or ~/.ssh/id_ed25519, id_ecdsa and id_rsa
+//	known-hosts  known hosts file verifying the key of the host, defaults to ~/.ssh/known_hosts
+//	timeout      timeout of connecting, such as 30s
+func openSFTP(u *url.URL) (SaveFetcher, string, error) {
+	q := u.Query()
+	if u.Host == "" {
+		return nil, "", errors.New("Expected a target like sftp://user@host/path, got: " + u.String())
+	}
+	home := os.Getenv("HOME")
+	knownHosts := q.Get("known-hosts")
+	if knownHosts == "" {
+		knownHosts = path.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeys, err := knownhosts.New(knownHosts)
+	if err != nil {
+		return nil, "", fmt.Errorf("Could not read known hosts to verify %s: %v", u.Host, err)
+	}
+	auth, agentConn, err := sshAuth(q.Get("identity"), home)
+	if err != nil {
+		return nil, "", err
+	}
+	if agentConn != nil {
+		// ssh-agent is only needed to sign while authenticating.
+		defer agentConn.Close()
+	}
+	config := &ssh.ClientConfig{
+		User:            u.User.Username(),
+		Auth:            auth,
+		HostKeyCallback: hostKeys,
+		Timeout:         30 * time.Second,
+	}
+	if config.User == "" {
+		config.User = os.Getenv("USER")
+	}
+	if v := q.Get("timeout"); v != "" {
+		if config.Timeout, err = time.ParseDuration(v); err != nil {
+			return nil, "", fmt.Errorf("Invalid timeout %q", v)
+		}
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+	root := u.Path
+	if strings.HasPrefix(root, "/~/") || root == "/~" {
+		root = strings.TrimPrefix(strings.TrimPrefix(root, "/~"), "/")
+	}
+	s, err := DialSFTP(addr, config, root)
+	if err != nil {
+		return nil, "", err
+	}
+	return s, "", nil
+}
+
+// DialSFTP connects to the SFTP subsystem of the SSH server at addr, returning the storage of root.
+// The connection is closed by closing the storage.
+func DialSFTP(addr string, config *ssh.ClientConfig, root string) (*SFTP, error) {
+	conn, err := ssh.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, fmt.Errorf("Could not connect to %s: %v", addr, err)
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Could not start SFTP on %s: %v", addr, err)
+	}
+	s := NewSFTP(client, root)
+	s.conn = conn
+	return s, nil
+}
+
+// Close ends the SFTP session, and the SSH connection when dialed by DialSFTP.
+func (s *SFTP) Close() error {
+	err := s.Client.Close()
+	if s.conn != nil {
+		if cerr := s.conn.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// sshAuth returns the public key authentication of the identity file, or the keys of ssh-agent
+// followed by the default identity files of home. The connection to ssh-agent, if any, is returned
+// to be closed once authenticated.
+func sshAuth(identity, home string) ([]ssh.AuthMethod, io.Closer, error) {
+	if identity != "" {
+		signer, err := readIdentity(identity)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []ssh.AuthMethod{ssh.PublicKeys(signer)}, nil, nil
+	}
+	var auth []ssh.AuthMethod
+	var agentConn io.Closer
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+			agentConn = conn
+		}
+	}
+	var signers []ssh.Signer
+	for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		// Keys protected by a passphrase are left to ssh-agent.
+		if signer, err := readIdentity(path.Join(home, ".ssh", name)); err == nil {
+			signers = append(signers, signer)
+		}
+	}
+	if len(signers) > 0 {
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+	if len(auth) == 0 {
+		return nil, nil, errors.New("No SSH keys found, start ssh-agent or set the identity option")
+	}
+	return auth, agentConn, nil
+}
+
+func readIdentity(filename string) (ssh.Signer, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read SSH key %s, keys with a passphrase have to be added to ssh-agent: %v", filename, err)
+	}
+	return signer, nil
+}
+
+func (s *SFTP) Save(fpath string) (io.WriteCloser, error) {
+	return s.SaveTags(fpath, nil)
+}
+
+// SaveTags saves the tags in a sidecar file next to the object, the same way as the Filesystem.
+func (s *SFTP) SaveTags(fpath string, tags Tagger) (io.WriteCloser, error) {
+	fullpath := path.Join(s.Root, fpath)
+	if err := s.Client.MkdirAll(path.Dir(fullpath)); err != nil {
+		return nil, err
+	}
+	f, err := s.create(fullpath)
+	if err != nil {
+		return nil, err
+	}
+	w := &sftpFile{File: f, s: s, path: fullpath}
+	if tags != nil {
+		w.tags = tags.Tags()
+	}
+	return w, nil
+}
+
+// create creates a temporary file next to fullpath, named so that Walk ignores it.
+func (s *SFTP) create(fullpath string) (*sftp.File, error) {
+	dir, name := path.Split(fullpath)
+	for {
+		temp, err := tempName(name)
+		if err != nil {
+			return nil, err
+		}
+		f, err := s.Client.OpenFile(path.Join(dir, temp), os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+		if !os.IsExist(err) {
+			return f, err
+		}
+	}
+}
+
+// rename moves the temporary file into place, replacing any file already there. Plain SFTP renames
+// fail when the target exists, so the POSIX rename extension of OpenSSH is used when available.
+func (s *SFTP) rename(temp, fullpath string) error {
+	if _, ok := s.Client.HasExtension("posix-rename@openssh.com"); ok {
+		return s.Client.PosixRename(temp, fullpath)
+	}
+	if err := s.Client.Remove(fullpath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return s.Client.Rename(temp, fullpath)
+}
+
+// sftpFile is a temporary file that is renamed to its path once closed.
+type sftpFile struct {
+	*sftp.File
+	s    *SFTP
+	path string
+	tags map[string]string
+}
+
+func (f *sftpFile) Close() error {
+	err := f.File.Close()
+	// The tags go first, so that an object never shows up without them.
+	if err == nil {
+		err = f.saveTags()
+	}
+	if err == nil {
+		err = f.s.rename(f.File.Name(), f.path)
+	}
+	if err != nil {
+		f.s.Client.Remove(f.File.Name())
+	}
+	return err
+}
+
+// Abort removes the temporary file instead of renaming it into place.
+func (f *sftpFile) Abort() error {
+	f.File.Close()
+	return f.s.Client.Remove(f.File.Name())
+}
+
+// saveTags replaces the sidecar file of the object with its tags, or removes it if there are none.
+func (f *sftpFile) saveTags() error {
+	if f.tags == nil {
+		if err := f.s.Client.Remove(f.path + tagsSuffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	b, err := json.Marshal(f.tags)
+	if err != nil {
+		return err
+	}
+	fd, err := f.s.create(f.path + tagsSuffix)
+	if err != nil {
+		return err
+	}
+	_, err = fd.Write(b)
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = f.s.rename(fd.Name(), f.path+tagsSuffix)
+	}
+	if err != nil {
+		f.s.Client.Remove(fd.Name())
+	}
+	return err
+}
+
+// Walk walks the objects in lexical order, like filepath.Walk.
+func (s *SFTP) Walk(p string, wfunc WalkFunc) error {
+	fullpath := path.Join(s.Root, p)
+	info, err := s.Client.Stat(fullpath)
+	if err != nil {
+		return wfunc(s.relative(fullpath), err)
+	}
+	return s.walk(fullpath, info, wfunc)
+}
+
+func (s *SFTP) walk(fullpath string, info os.FileInfo, wfunc WalkFunc) error {
+	if !info.IsDir() {
+		if isTempFile(info.Name()) || strings.HasSuffix(info.Name(), tagsSuffix) {
+			return nil
+		}
+		return wfunc(s.relative(fullpath), nil)
+	}
+	entries, err := s.Client.ReadDir(fullpath)
+	if err != nil {
+		return wfunc(s.relative(fullpath), err)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	for _, entry := range entries {
+		if err := s.walk(path.Join(fullpath, entry.Name()), entry, wfunc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// relative returns the path of an object from the full path of its file.
+func (s *SFTP) relative(fullpath string) string {
+	return strings.TrimLeft(strings.TrimPrefix(fullpath, s.Root), "/")
+}
+
+func (s *SFTP) Fetch(fpath string) (io.ReadCloser, error) {
+	return s.Client.Open(path.Join(s.Root, fpath))
+}
+
+func (s *SFTP) Stat(fpath string) (ObjectInfo, error) {
+	info, err := s.Client.Stat(path.Join(s.Root, fpath))
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if info.IsDir() {
+		return ObjectInfo{}, &os.PathError{Op: "stat", Path: fpath, Err: errors.New("Is a directory")}
+	}
+	oi := ObjectInfo{Path: fpath, Size: info.Size(), ModTime: info.ModTime()}
+	r, err := s.Client.Open(path.Join(s.Root, fpath) + tagsSuffix)
+	if err == nil {
+		err = json.NewDecoder(r).Decode(&oi.Tags)
+		r.Close()
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return ObjectInfo{}, err
+	}
+	return oi, nil
+}
+
+// Delete deletes the object together with its tags.
+func (s *SFTP) Delete(fpath string) error {
+	fullpath := path.Join(s.Root, fpath)
+	if err := s.Client.Remove(fullpath); err != nil {
+		return err
+	}
+	if err := s.Client.Remove(fullpath + tagsSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
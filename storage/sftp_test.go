@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"github.com/duego/mongotool/storage/sftptest"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSFTP(t *testing.T) {
+	Convey("Given a SSH server", t, func() {
+		srv, err := sftptest.NewServer()
+		So(err, ShouldBeNil)
+		defer srv.Close()
+		dir, err := ioutil.TempDir("", "mongotool")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		identity := filepath.Join(dir, "id_ed25519")
+		knownHosts := filepath.Join(dir, "known_hosts")
+		So(srv.WriteIdentity(identity), ShouldBeNil)
+		So(srv.WriteKnownHosts(knownHosts), ShouldBeNil)
+		root := filepath.Join(dir, "backups")
+
+		open := func(identity, knownHosts string) (*SFTP, error) {
+			u, _ := url.Parse("sftp://mongotool@" + srv.Addr + root + "?identity=" + url.QueryEscape(identity) +
+				"&known-hosts=" + url.QueryEscape(knownHosts))
+			s, _, err := openSFTP(u)
+			if err != nil {
+				return nil, err
+			}
+			return s.(*SFTP), nil
+		}
+
+		Convey("Objects should be saved atomically under the root", func() {
+			store, err := open(identity, knownHosts)
+			So(err, ShouldBeNil)
+			w, err := SaveTagged(store, "dump/chunk", Tags{"database": "test"})
+			So(err, ShouldBeNil)
+			w.Write([]byte("foo"))
+			entries, _ := ioutil.ReadDir(filepath.Join(root, "dump"))
+			So(len(entries), ShouldEqual, 1)
+			So(isTempFile(entries[0].Name()), ShouldBeTrue)
+
+			So(w.Close(), ShouldBeNil)
+			b, err := ioutil.ReadFile(filepath.Join(root, "dump", "chunk"))
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "foo")
+			_, err = os.Stat(filepath.Join(root, "dump", "chunk"+tagsSuffix))
+			So(err, ShouldBeNil)
+
+			Convey("and replaced when saved again", func() {
+				w, err := store.Save("dump/chunk")
+				So(err, ShouldBeNil)
+				w.Write([]byte("bar"))
+				So(w.Close(), ShouldBeNil)
+				b, _ := ioutil.ReadFile(filepath.Join(root, "dump", "chunk"))
+				So(string(b), ShouldEqual, "bar")
+				_, err = os.Stat(filepath.Join(root, "dump", "chunk"+tagsSuffix))
+				So(os.IsNotExist(err), ShouldBeTrue)
+			})
+		})
+
+		Convey("Closing should end the connection", func() {
+			store, err := open(identity, knownHosts)
+			So(err, ShouldBeNil)
+			So(store.Close(), ShouldBeNil)
+			So(store.conn.Close(), ShouldNotBeNil)
+			_, err = store.Stat("dump/chunk")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("The connection to ssh-agent should be closed once authenticated", func() {
+			b, err := ioutil.ReadFile(identity)
+			So(err, ShouldBeNil)
+			key, err := ssh.ParseRawPrivateKey(b)
+			So(err, ShouldBeNil)
+			keyring := agent.NewKeyring()
+			So(keyring.Add(agent.AddedKey{PrivateKey: key}), ShouldBeNil)
+			sock := filepath.Join(dir, "agent.sock")
+			l, err := net.Listen("unix", sock)
+			So(err, ShouldBeNil)
+			defer l.Close()
+			closed := make(chan bool, 1)
+			go func() {
+				if conn, err := l.Accept(); err == nil {
+					agent.ServeAgent(keyring, conn)
+					closed <- true
+				}
+			}()
+			defer setenv(map[string]string{"SSH_AUTH_SOCK": sock})()
+
+			store, err := open("", knownHosts)
+			So(err, ShouldBeNil)
+			defer store.Close()
+			select {
+			case <-closed:
+			case <-time.After(5 * time.Second):
+				t.Error("ssh-agent connection left open")
+			}
+		})
+
+		Convey("An unknown host key should be refused", func() {
+			other, err := sftptest.NewServer()
+			So(err, ShouldBeNil)
+			defer other.Close()
+			So(other.WriteKnownHosts(knownHosts), ShouldBeNil)
+			_, err = open(identity, knownHosts)
+			So(err, ShouldNotBeNil)
+			So(srv.Logins(), ShouldEqual, 0)
+		})
+
+		Convey("An unauthorized key should be refused", func() {
+			other, err := sftptest.NewServer()
+			So(err, ShouldBeNil)
+			defer other.Close()
+			So(other.WriteIdentity(identity), ShouldBeNil)
+			_, err = open(identity, knownHosts)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("A missing known hosts file should be an error", func() {
+			_, err = open(identity, filepath.Join(dir, "missing"))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,173 @@
+// Package sftptest implements an in-process SSH server for testing, serving the SFTP subsystem on the
+// local filesystem. Clients authenticate with the public keys authorized on the server.
+package sftptest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io/ioutil"
+	"net"
+	"sync"
+)
+
+// Server is a SSH server listening on a local address.
+type Server struct {
+	// Addr is the host:port of the server.
+	Addr string
+	// HostKey is the public key the server identifies itself with.
+	HostKey ssh.PublicKey
+
+	listener net.Listener
+	mu       sync.Mutex
+	keys     map[string]bool
+	logins   int
+	conns    map[net.Conn]bool
+	wg       sync.WaitGroup
+}
+
+// NewServer starts a server with a new host key. Close it when done.
+func NewServer() (*Server, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		Addr:     l.Addr().String(),
+		HostKey:  signer.PublicKey(),
+		listener: l,
+		keys:     make(map[string]bool),
+		conns:    make(map[net.Conn]bool),
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if !s.keys[string(key.Marshal())] {
+				return nil, errors.New("sftptest: unauthorized key")
+			}
+			s.logins++
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+	s.wg.Add(1)
+	go s.serve(config)
+	return s, nil
+}
+
+// Authorize lets clients authenticate with key.
+func (s *Server) Authorize(key ssh.PublicKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[string(key.Marshal())] = true
+}
+
+// Logins returns how many times clients authenticated.
+func (s *Server) Logins() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.logins
+}
+
+// WriteKnownHosts writes a known hosts file holding the key of the server.
+func (s *Server) WriteKnownHosts(filename string) error {
+	line := knownhosts.Line([]string{knownhosts.Normalize(s.Addr)}, s.HostKey)
+	return ioutil.WriteFile(filename, []byte(line+"\n"), 0600)
+}
+
+// WriteIdentity writes a new private key in OpenSSH format to filename, authorizing it on the server.
+func (s *Server) WriteIdentity(filename string) error {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		return err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return err
+	}
+	s.Authorize(signer.PublicKey())
+	return ioutil.WriteFile(filename, pem.EncodeToMemory(block), 0600)
+}
+
+// Close stops accepting connections and closes the ones being served.
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serve(config *ssh.ServerConfig) {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn, config)
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// handle serves the SFTP subsystem on the sessions of a connection.
+func (s *Server) handle(conn net.Conn, config *ssh.ServerConfig) {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		ch, requests, err := nc.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					if server, err := sftp.NewServer(ch); err == nil {
+						server.Serve()
+					}
+					ch.Close()
+				}
+			}
+		}()
+	}
+}
@@ -0,0 +1,207 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	amzDateFormat  = "20060102T150405Z"
+	amzShortFormat = "20060102"
+)
+
+// signV4 signs req for S3 in region using AWS Signature Version 4.
+func signV4(req *http.Request, creds Credentials, region string, now time.Time) error {
+	payload, err := payloadHash(req)
+	if err != nil {
+		return err
+	}
+
+	now = now.UTC()
+	req.Header.Set("X-Amz-Date", now.Format(amzDateFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers, signed := canonicalHeaders(req)
+	canonical := strings.Join([]string{
+		req.Method,
+		canonicalURI(req.URL.Path),
+		canonicalQuery(req.URL.Query()),
+		headers,
+		signed,
+		payload,
+	}, "\n")
+
+	scope := strings.Join([]string{now.Format(amzShortFormat), region, "s3", "aws4_request"}, "/")
+	hashed := sha256.Sum256([]byte(canonical))
+	toSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		now.Format(amzDateFormat),
+		scope,
+		hex.EncodeToString(hashed[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), now.Format(amzShortFormat))
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signed, signature,
+	))
+	return nil
+}
+
+// payloadHash returns the hex SHA-256 of the body of req. Bodies that can be had again, such as the
+// buffers of upload parts, are hashed as they are rather than copied. Others are read to be hashed
+// and then put back, so that they can still be sent.
+func payloadHash(req *http.Request) (string, error) {
+	h := sha256.New()
+	switch {
+	case req.Body == nil:
+	case req.GetBody != nil:
+		body, err := req.GetBody()
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(h, body)
+		body.Close()
+		if err != nil {
+			return "", err
+		}
+	default:
+		b, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return "", err
+		}
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(b))
+		h.Write(b)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalHeaders returns the headers to sign in canonical form together with their names.
+// Host, content headers and every x-amz-* header are signed.
+func canonicalHeaders(req *http.Request) (canonical, signed string) {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	values := map[string]string{"host": host}
+	for name, v := range req.Header {
+		name = strings.ToLower(name)
+		switch {
+		case name == "content-md5", name == "content-type", name == "range", strings.HasPrefix(name, "x-amz-"):
+			trimmed := make([]string, len(v))
+			for i := range v {
+				trimmed[i] = strings.Join(strings.Fields(v[i]), " ")
+			}
+			values[name] = strings.Join(trimmed, ",")
+		}
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		buf.WriteString(name + ":" + values[name] + "\n")
+	}
+	return buf.String(), strings.Join(names, ";")
+}
+
+// canonicalURI encodes every path segment the way S3 does.
+func canonicalURI(path string) string {
+	if path == "" {
+		return "/"
+	}
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		segments[i] = uriEncode(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+// canonicalQuery sorts the query parameters by name and value.
+func canonicalQuery(q url.Values) string {
+	params := make([]string, 0, len(q))
+	for name, values := range q {
+		for _, v := range values {
+			params = append(params, uriEncode(name)+"="+uriEncode(v))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// uriEncode escapes everything but the unreserved characters of RFC 3986, as required by Signature Version 4.
+func uriEncode(s string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+// guessRegion figures out the region from the host name of an AWS endpoint, such as
+// bucket.s3.eu-west-1.amazonaws.com or bucket.s3-eu-west-1.amazonaws.com.
+// Other hosts use AWS_REGION, AWS_DEFAULT_REGION or finally us-east-1 like most S3 compatible services.
+func guessRegion(host string) string {
+	if i := strings.LastIndex(host, ":"); i >= 0 {
+		host = host[:i]
+	}
+	if strings.HasSuffix(host, ".amazonaws.com") {
+		// Look from the end, the bucket name could contain labels looking like the endpoint.
+		parts := strings.Split(strings.TrimSuffix(host, ".amazonaws.com"), ".")
+		for i := len(parts) - 1; i >= 0; i-- {
+			switch part := parts[i]; {
+			case part == "s3" || part == "s3-external-1":
+				for _, region := range parts[i+1:] {
+					if region != "dualstack" {
+						return region
+					}
+				}
+				return "us-east-1"
+			case strings.HasPrefix(part, "s3-"):
+				return strings.TrimPrefix(part, "s3-")
+			}
+		}
+		return "us-east-1"
+	}
+	for _, env := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region := os.Getenv(env); region != "" {
+			return region
+		}
+	}
+	return "us-east-1"
+}
@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Server-side encryption modes of S3.
+const (
+	SSES3  = "AES256"
+	SSEKMS = "aws:kms"
+)
+
+// ServerSideEncryption is how S3 encrypts saved objects.
+// Either Mode is set, for keys managed by S3 or KMS, or CustomerKey for keys provided with every request.
+type ServerSideEncryption struct {
+	// Mode is SSES3, SSEKMS or empty.
+	Mode string
+	// KMSKeyID is the KMS key used with SSEKMS, the default key of the account is used when empty.
+	KMSKeyID string
+	// CustomerKey is the 32 bytes key of SSE-C. The same key is needed to fetch the objects again.
+	CustomerKey []byte
+}
+
+// NewServerSideEncryption returns the encryption for a mode, which is one of "", "AES256" (or "s3"),
+// "aws:kms" (or "kms"), and a customer key for SSE-C. A KMS key id implies the mode "aws:kms".
+func NewServerSideEncryption(mode, kmsKeyID string, customerKey []byte) (sse ServerSideEncryption, err error) {
+	switch strings.ToLower(mode) {
+	case "":
+		if kmsKeyID != "" {
+			sse.Mode = SSEKMS
+		}
+	case "aes256", "s3":
+		sse.Mode = SSES3
+	case "aws:kms", "kms":
+		sse.Mode = SSEKMS
+	default:
+		return sse, fmt.Errorf("Unknown server-side encryption %q, expected AES256 or aws:kms", mode)
+	}
+	if kmsKeyID != "" && sse.Mode != SSEKMS {
+		return sse, fmt.Errorf("A KMS key id can't be used with server-side encryption %s", sse.Mode)
+	}
+	if customerKey != nil {
+		if sse.Mode != "" {
+			return sse, fmt.Errorf("A customer key can't be used with server-side encryption %s", sse.Mode)
+		}
+		if len(customerKey) != 32 {
+			return sse, fmt.Errorf("Expected a customer key of 32 bytes, got %d", len(customerKey))
+		}
+	}
+	sse.KMSKeyID = kmsKeyID
+	sse.CustomerKey = customerKey
+	return sse, nil
+}
+
+// header returns the headers of a request on path, which are sent signed along with it.
+// S3 only takes the mode when creating objects, while a customer key is needed by every request
+// reading or writing object data, parts included.
+func (sse ServerSideEncryption) header(method, path string) http.Header {
+	h := make(http.Header)
+	// Listings are requested on the bucket with only a query as path.
+	if strings.HasPrefix(path, "?") {
+		return h
+	}
+	create := s3Creates(method, path)
+	data := create || method == "PUT" || method == "GET" || method == "HEAD"
+
+	if create && sse.Mode != "" {
+		h.Set("X-Amz-Server-Side-Encryption", sse.Mode)
+		if sse.KMSKeyID != "" {
+			h.Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", sse.KMSKeyID)
+		}
+	}
+	if data && sse.CustomerKey != nil {
+		sum := md5.Sum(sse.CustomerKey)
+		h.Set("X-Amz-Server-Side-Encryption-Customer-Algorithm", "AES256")
+		h.Set("X-Amz-Server-Side-Encryption-Customer-Key", base64.StdEncoding.EncodeToString(sse.CustomerKey))
+		h.Set("X-Amz-Server-Side-Encryption-Customer-Key-Md5", base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	return h
+}
+
+// s3Creates tells if a request on path creates an object, either with a single PUT or by initiating
+// a multipart upload. Only these requests take the encryption, tags and metadata of the object.
+func s3Creates(method, path string) bool {
+	var q url.Values
+	if i := strings.Index(path, "?"); i >= 0 {
+		q, _ = url.ParseQuery(path[i+1:])
+	}
+	return method == "PUT" && q.Get("uploadId") == "" || method == "POST" && q["uploads"] != nil
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"bytes"
+	"github.com/duego/mongotool/storage/s3test"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"testing"
+)
+
+func TestServerSideEncryption(t *testing.T) {
+	Convey("Parsing server-side encryption", t, func() {
+		sse, err := NewServerSideEncryption("s3", "", nil)
+		So(err, ShouldBeNil)
+		So(sse.Mode, ShouldEqual, SSES3)
+
+		sse, err = NewServerSideEncryption("", "alias/backup", nil)
+		So(err, ShouldBeNil)
+		So(sse.Mode, ShouldEqual, SSEKMS)
+
+		_, err = NewServerSideEncryption("AES256", "alias/backup", nil)
+		So(err, ShouldNotBeNil)
+		_, err = NewServerSideEncryption("kms", "", make([]byte, 32))
+		So(err, ShouldNotBeNil)
+		_, err = NewServerSideEncryption("", "", make([]byte, 16))
+		So(err, ShouldNotBeNil)
+		_, err = NewServerSideEncryption("rot13", "", nil)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given a S3 bucket", t, func() {
+		srv := s3test.NewServer()
+		defer srv.Close()
+		defer setFakeAwsKeys()()
+		store := NewS3(srv.BucketURL("mongotool"))
+		store.PartSize = MinPartSize
+		large := bytes.Repeat([]byte("mongotool"), int(MinPartSize)/4)
+
+		save := func(path string, data []byte) error {
+			w, err := store.Save(path)
+			if err != nil {
+				return err
+			}
+			w.Write(data)
+			return w.Close()
+		}
+		fetch := func(path string) (string, error) {
+			r, err := store.Fetch(path)
+			if err != nil {
+				return "", err
+			}
+			defer r.Close()
+			b, err := ioutil.ReadAll(r)
+			return string(b), err
+		}
+
+		Convey("Objects should be saved with SSE-KMS, also when uploaded in parts", func() {
+			store.Encryption, _ = NewServerSideEncryption("aws:kms", "alias/backup", nil)
+			So(save("small", []byte("Foo")), ShouldBeNil)
+			So(save("large", large), ShouldBeNil)
+			for _, key := range []string{"small", "large"} {
+				o, _ := srv.Object("mongotool", key)
+				So(o.Header.Get("X-Amz-Server-Side-Encryption"), ShouldEqual, "aws:kms")
+				So(o.Header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"), ShouldEqual, "alias/backup")
+			}
+			for _, r := range srv.Requests() {
+				if r.Query["uploadId"] == nil {
+					So(r.Header.Get("Authorization"), ShouldContainSubstring, "x-amz-server-side-encryption")
+				} else {
+					So(r.Header.Get("X-Amz-Server-Side-Encryption"), ShouldEqual, "")
+				}
+			}
+		})
+
+		Convey("Given objects saved with a customer key", func() {
+			store.Encryption, _ = NewServerSideEncryption("", "", bytes.Repeat([]byte{1}, 32))
+			So(save("small", []byte("Foo")), ShouldBeNil)
+			So(save("large", large), ShouldBeNil)
+
+			Convey("They should be fetched with the same key", func() {
+				data, err := fetch("small")
+				So(err, ShouldBeNil)
+				So(data, ShouldEqual, "Foo")
+				data, err = fetch("large")
+				So(err, ShouldBeNil)
+				So(data, ShouldEqual, string(large))
+				_, err = store.Stat("large")
+				So(err, ShouldBeNil)
+			})
+			Convey("Fetching them with another key should fail", func() {
+				store.Encryption.CustomerKey = bytes.Repeat([]byte{2}, 32)
+				_, err := fetch("small")
+				So(err, ShouldNotBeNil)
+			})
+			Convey("Fetching them without a key should fail", func() {
+				store.Encryption = ServerSideEncryption{}
+				_, err := fetch("small")
+				So(err, ShouldNotBeNil)
+			})
+			Convey("Listing them should not need the key", func() {
+				var walked []string
+				err := store.Walk("", func(p string, err error) error {
+					walked = append(walked, p)
+					return err
+				})
+				So(err, ShouldBeNil)
+				So(walked, ShouldResemble, []string{"large", "small"})
+			})
+		})
+	})
+
+	Convey("SSE-C options should be read from a key file", t, func() {
+		defer setFakeAwsKeys()()
+		_, _, err := Open("s3://mongotool/dump?sse-c-key-file=/does/not/exist", nil)
+		So(err, ShouldNotBeNil)
+		store, _, err := Open("s3://mongotool/dump?sse=kms&sse-kms-key-id=alias/backup", nil)
+		So(err, ShouldBeNil)
+		So(store.(*S3).Encryption.KMSKeyID, ShouldEqual, "alias/backup")
+	})
+}
@@ -0,0 +1,227 @@
+// Package storagetest implements tests every storage is expected to pass.
+package storagetest
+
+import (
+	"bytes"
+	"errors"
+	"github.com/duego/mongotool/storage"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+// Prefix is the path every object saved by the tests is put under.
+const Prefix = "storagetest"
+
+// Run tests that store saves, fetches and walks objects the way the storage package expects.
+// Stat, Delete and tags are tested if the store has them. The store should have nothing under Prefix.
+func Run(t *testing.T, name string, store storage.SaveFetcher) {
+	Convey("Given the "+name+" storage", t, func() {
+		Convey("Objects of any size should round trip", func() {
+			for _, size := range []int{0, 3, 1 << 20} {
+				data := randomData(size)
+				So(save(store, Prefix+"/roundtrip/object", data), ShouldBeNil)
+				b, err := fetch(store, Prefix+"/roundtrip/object")
+				So(err, ShouldBeNil)
+				So(bytes.Equal(b, data), ShouldBeTrue)
+			}
+		})
+
+		Convey("Fetching a missing object should fail with a not exist error", func() {
+			_, err := fetch(store, Prefix+"/missing/object")
+			So(err, ShouldNotBeNil)
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("An object should not be fetched until closed", func() {
+			w, err := store.Save(Prefix + "/unclosed/object")
+			So(err, ShouldBeNil)
+			_, err = w.Write([]byte("foo"))
+			So(err, ShouldBeNil)
+			_, err = fetch(store, Prefix+"/unclosed/object")
+			So(err, ShouldNotBeNil)
+			So(w.Close(), ShouldBeNil)
+		})
+
+		Convey("Given nested objects", func() {
+			paths := []string{
+				Prefix + "/walk/a",
+				Prefix + "/walk/b/c",
+				Prefix + "/walk/b/d",
+				Prefix + "/walk/e",
+			}
+			for _, p := range paths {
+				So(save(store, p, []byte(p)), ShouldBeNil)
+			}
+
+			Convey("Walking should give all of them in order", func() {
+				found, err := walk(store, Prefix+"/walk")
+				So(err, ShouldBeNil)
+				So(found, ShouldResemble, paths)
+			})
+			Convey("Walking a nested prefix should only give the objects under it", func() {
+				found, err := walk(store, Prefix+"/walk/b")
+				So(err, ShouldBeNil)
+				So(found, ShouldResemble, paths[1:3])
+			})
+			Convey("A prefix should only match whole path elements", func() {
+				found, err := walk(store, Prefix+"/wal")
+				So(err, ShouldBeNil)
+				So(found, ShouldBeEmpty)
+			})
+			Convey("Walking should stop on the first error returned", func() {
+				stop := errors.New("stop")
+				calls := 0
+				err := storage.Walk(store, Prefix+"/walk", func(p string, err error) error {
+					calls++
+					return stop
+				})
+				So(err, ShouldEqual, stop)
+				So(calls, ShouldEqual, 1)
+			})
+		})
+
+		if _, ok := store.(storage.Stater); ok {
+			Convey("Stat should give the size of objects", func() {
+				So(save(store, Prefix+"/stat/object", []byte("foo")), ShouldBeNil)
+				info, err := storage.Stat(store, Prefix+"/stat/object")
+				So(err, ShouldBeNil)
+				So(info.Size, ShouldBeGreaterThan, 0)
+				_, err = storage.Stat(store, Prefix+"/stat/missing")
+				So(os.IsNotExist(err), ShouldBeTrue)
+			})
+		}
+
+		_, tagger := store.(storage.TagSaver)
+		if _, stater := store.(storage.Stater); tagger && stater {
+			Convey("Tags saved with an object should be stated", func() {
+				tags := storage.Tags{"database": "test", "dump-id": "1"}
+				w, err := storage.SaveTagged(store, Prefix+"/tags/object", tags)
+				So(err, ShouldBeNil)
+				So(w.Close(), ShouldBeNil)
+				info, err := storage.Stat(store, Prefix+"/tags/object")
+				So(err, ShouldBeNil)
+				So(info.Tags, ShouldResemble, map[string]string(tags))
+			})
+		}
+
+		if _, ok := store.(storage.Deleter); ok {
+			Convey("Deleted objects should be gone", func() {
+				So(save(store, Prefix+"/delete/object", []byte("foo")), ShouldBeNil)
+				So(storage.Delete(store, Prefix+"/delete/object"), ShouldBeNil)
+				_, err := fetch(store, Prefix+"/delete/object")
+				So(os.IsNotExist(err), ShouldBeTrue)
+			})
+		}
+	})
+}
+
+// RunWrapper runs the tests of Run on a wrapper of a Memory storage, such as the compression one,
+// and tests that errors of the wrapped storage get through.
+func RunWrapper(t *testing.T, name string, wrap func(storage.SaveFetcher) storage.SaveFetcher) {
+	Run(t, name, wrap(storage.NewMemory()))
+
+	Convey("Given the "+name+" storage wrapping a failing storage", t, func() {
+		failing := &failingStorage{Memory: storage.NewMemory()}
+		store := wrap(failing)
+
+		Convey("Errors writing should be returned by Write or Close", func() {
+			w, err := store.Save(Prefix + "/object")
+			So(err, ShouldBeNil)
+			failing.failWrite = true
+			_, err = w.Write(randomData(1 << 20))
+			if err == nil {
+				err = w.Close()
+			}
+			So(err, ShouldEqual, errFailing)
+		})
+		Convey("Errors closing should be returned by Close", func() {
+			failing.failClose = true
+			w, err := store.Save(Prefix + "/object")
+			So(err, ShouldBeNil)
+			_, err = w.Write([]byte("foo"))
+			So(err, ShouldBeNil)
+			So(w.Close(), ShouldEqual, errFailing)
+		})
+	})
+}
+
+var errFailing = errors.New("failing storage")
+
+// failingStorage fails writing or closing objects when told to.
+type failingStorage struct {
+	*storage.Memory
+	failWrite, failClose bool
+}
+
+type failingWriter struct {
+	io.WriteCloser
+	s *failingStorage
+}
+
+func (f *failingStorage) Save(path string) (io.WriteCloser, error) {
+	w, err := f.Memory.Save(path)
+	return &failingWriter{w, f}, err
+}
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	if f.s.failWrite {
+		return 0, errFailing
+	}
+	return f.WriteCloser.Write(p)
+}
+
+func (f *failingWriter) Close() error {
+	if f.s.failClose {
+		f.WriteCloser.Close()
+		return errFailing
+	}
+	return f.WriteCloser.Close()
+}
+
+func randomData(size int) []byte {
+	b := make([]byte, size)
+	rand.Read(b)
+	return b
+}
+
+func save(store storage.Saver, path string, data []byte) error {
+	w, err := store.Save(path)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func fetch(store storage.Fetcher, path string) ([]byte, error) {
+	r, err := store.Fetch(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// walk returns every path walked under path. A missing path gives nothing, even though some storages
+// report it as an error.
+func walk(store storage.Fetcher, path string) ([]string, error) {
+	var found []string
+	err := storage.Walk(store, path, func(p string, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		found = append(found, p)
+		return nil
+	})
+	return found, err
+}
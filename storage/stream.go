@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// Stream implements the SaveFetcher for one continuous stream, such as standard input and output.
+// Saved objects are written to the same writer one at a time, so that objects saved concurrently
+// are not interleaved. The reader is fetched as a single object regardless of the path asked for.
+type Stream struct {
+	r io.Reader
+	w io.Writer
+
+	// saving is held from Save until the returned writer is closed.
+	saving sync.Mutex
+	// mu protects fetched.
+	mu      sync.Mutex
+	fetched bool
+}
+
+func NewStream(r io.Reader, w io.Writer) *Stream {
+	return &Stream{r: r, w: w}
+}
+
+// streamWriter writes one object to the stream, letting the next one through once closed.
+type streamWriter struct {
+	s      *Stream
+	closed bool
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	if sw.closed {
+		return 0, errors.New("Write on closed stream object")
+	}
+	return sw.s.w.Write(p)
+}
+
+func (sw *streamWriter) Close() error {
+	if sw.closed {
+		return nil
+	}
+	sw.closed = true
+	sw.s.saving.Unlock()
+	return nil
+}
+
+// Save blocks until any previously saved object has been closed.
+func (s *Stream) Save(path string) (io.WriteCloser, error) {
+	if s.w == nil {
+		return nil, errors.New("Stream is not writable")
+	}
+	s.saving.Lock()
+	return &streamWriter{s: s}, nil
+}
+
+// Fetch returns the whole stream, it can only be done once.
+func (s *Stream) Fetch(path string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.r == nil {
+		return nil, errors.New("Stream is not readable")
+	}
+	if s.fetched {
+		return nil, errors.New("Stream has already been fetched")
+	}
+	s.fetched = true
+	return ioutil.NopCloser(s.r), nil
+}
+
+// Walk calls walkfn for every object under path if store is a Walker.
+// Any other store, such as a Stream, is treated as holding one single object at path.
+func Walk(store Fetcher, path string, walkfn WalkFunc) error {
+	if w, ok := store.(Walker); ok {
+		return w.Walk(path, walkfn)
+	}
+	return walkfn(path, nil)
+}
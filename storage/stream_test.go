@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"bytes"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestStream(t *testing.T) {
+	Convey("Given a Stream", t, func() {
+		var out bytes.Buffer
+		s := NewStream(strings.NewReader("Foo"), &out)
+
+		Convey("Objects saved concurrently should not be interleaved", func() {
+			var wg sync.WaitGroup
+			for _, c := range []string{"a", "b", "c"} {
+				wg.Add(1)
+				go func(c string) {
+					defer wg.Done()
+					w, err := s.Save("object")
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					for n := 0; n < 100; n++ {
+						io.WriteString(w, c)
+					}
+					w.Close()
+				}(c)
+			}
+			wg.Wait()
+			So(out.Len(), ShouldEqual, 300)
+			for _, c := range []string{"a", "b", "c"} {
+				So(out.String(), ShouldContainSubstring, strings.Repeat(c, 100))
+			}
+		})
+
+		Convey("The reader should be fetched once", func() {
+			r, err := s.Fetch("object")
+			So(err, ShouldBeNil)
+			b, err := ioutil.ReadAll(r)
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "Foo")
+			So(r.Close(), ShouldBeNil)
+
+			_, err = s.Fetch("object")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Walking should give the single object", func() {
+			var walked []string
+			err := Walk(s, "root", func(p string, err error) error {
+				walked = append(walked, p)
+				return err
+			})
+			So(err, ShouldBeNil)
+			So(walked, ShouldResemble, []string{"root"})
+		})
+
+		Convey("Walking through compression should also give the single object", func() {
+			total := 0
+			err := NewGzipSaveFetcher(s).(Walker).Walk("root", func(p string, err error) error {
+				total++
+				return err
+			})
+			So(err, ShouldBeNil)
+			So(total, ShouldEqual, 1)
+		})
+	})
+}
@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/duego/mongotool/storage/s3test"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestTags(t *testing.T) {
+	tags := Tags{
+		"database":    "test",
+		"collections": "users,orders",
+		"dump-id":     "20261017T120000Z-abc",
+		"codec":       "zstd",
+	}
+	saveTagged := func(store Saver, path string) error {
+		w, err := SaveTagged(store, path, tags)
+		if err != nil {
+			return err
+		}
+		io.WriteString(w, "Foo")
+		return w.Close()
+	}
+
+	Convey("Tags should get through the compression and encryption wrappers", t, func() {
+		key, _ := NewKey("", make([]byte, 32))
+		m := NewMemory()
+		store := NewCompressSaveFetcher(NewEncryptedSaveFetcher(m, key), Gzip, DefaultLevel)
+		So(saveTagged(store, "object"), ShouldBeNil)
+		info, err := Stat(store, "object")
+		So(err, ShouldBeNil)
+		So(info.Tags, ShouldResemble, map[string]string(tags))
+	})
+
+	Convey("Given a filesystem", t, func() {
+		dir, err := ioutil.TempDir("", "mongotool")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		store := Filesystem{dir}
+		So(saveTagged(store, "dump/object"), ShouldBeNil)
+
+		Convey("Tags should be kept in a sidecar file", func() {
+			So(path.Join(dir, "dump/object"+tagsSuffix), shouldExistInFilesystem)
+			info, err := store.Stat("dump/object")
+			So(err, ShouldBeNil)
+			So(info.Tags, ShouldResemble, map[string]string(tags))
+		})
+		Convey("Walking should not give the sidecar file", func() {
+			var walked []string
+			store.Walk("dump", func(p string, err error) error {
+				walked = append(walked, p)
+				return err
+			})
+			So(walked, ShouldResemble, []string{"dump/object"})
+		})
+		Convey("Saving the object again without tags should remove them", func() {
+			w, _ := store.Save("dump/object")
+			So(w.Close(), ShouldBeNil)
+			info, err := store.Stat("dump/object")
+			So(err, ShouldBeNil)
+			So(info.Tags, ShouldBeNil)
+		})
+		Convey("Deleting the object should delete its tags", func() {
+			So(store.Delete("dump/object"), ShouldBeNil)
+			_, err := os.Stat(path.Join(dir, "dump/object"+tagsSuffix))
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+	})
+
+	Convey("Given a S3 bucket", t, func() {
+		srv := s3test.NewServer()
+		defer srv.Close()
+		defer setFakeAwsKeys()()
+		store := NewS3(srv.BucketURL("mongotool"))
+		store.PartSize = MinPartSize
+
+		Convey("Tags should be saved as metadata, and as object tags when S3 allows them", func() {
+			So(saveTagged(store, "small"), ShouldBeNil)
+			w, err := store.SaveTags("large", tags)
+			So(err, ShouldBeNil)
+			io.Copy(w, strings.NewReader(strings.Repeat("a", int(MinPartSize)+1)))
+			So(w.Close(), ShouldBeNil)
+
+			for _, key := range []string{"small", "large"} {
+				o, _ := srv.Object("mongotool", key)
+				So(o.Header.Get("X-Amz-Meta-Collections"), ShouldEqual, "users,orders")
+				tagging, err := url.ParseQuery(o.Header.Get("X-Amz-Tagging"))
+				So(err, ShouldBeNil)
+				So(tagging.Get("dump-id"), ShouldEqual, "20261017T120000Z-abc")
+				So(tagging["collections"], ShouldBeNil)
+
+				info, err := store.Stat(key)
+				So(err, ShouldBeNil)
+				So(info.Tags, ShouldResemble, map[string]string(tags))
+			}
+		})
+
+		Convey("Tags beyond the size S3 allows for metadata should be left out of it", func() {
+			many := Tags{"database": "test", "codec": "zstd"}
+			var collections []string
+			for n := 0; n < 300; n++ {
+				collections = append(collections, fmt.Sprintf("collection%03d", n))
+			}
+			many["collections"] = strings.Join(collections, ",")
+			w, err := store.SaveTags("many", many)
+			So(err, ShouldBeNil)
+			io.WriteString(w, "Foo")
+			So(w.Close(), ShouldBeNil)
+
+			info, err := store.Stat("many")
+			So(err, ShouldBeNil)
+			So(info.Tags, ShouldResemble, map[string]string{"database": "test", "codec": "zstd"})
+		})
+
+		Convey("Tags that aren't ASCII should be encoded", func() {
+			w, err := store.SaveTags("utf8", Tags{"collections": "användare,beställningar"})
+			So(err, ShouldBeNil)
+			io.WriteString(w, "Foo")
+			So(w.Close(), ShouldBeNil)
+
+			o, _ := srv.Object("mongotool", "utf8")
+			So(o.Header.Get("X-Amz-Meta-Collections"), ShouldStartWith, "=?UTF-8?b?")
+			info, err := store.Stat("utf8")
+			So(err, ShouldBeNil)
+			So(info.Tags["collections"], ShouldEqual, "användare,beställningar")
+		})
+
+		Convey("No more than 10 object tags should be sent", func() {
+			many := Tags{}
+			for _, c := range "abcdefghijkl" {
+				many[string(c)] = "x"
+			}
+			h := tagHeader(many)
+			tagging, _ := url.ParseQuery(h.Get("X-Amz-Tagging"))
+			So(len(tagging), ShouldEqual, maxS3Tags)
+			So(h.Get("X-Amz-Meta-L"), ShouldEqual, "x")
+		})
+	})
+}